@@ -0,0 +1,87 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+const (
+	// ReasonReady is used as the reason of the Ready condition when the AzureKeyVaultSecret is ready
+	ReasonReady = "Ready"
+
+	// ReasonAzureNotChecked is used as the reason of the Ready condition before the object
+	// has been read from Azure Key Vault
+	ReasonAzureNotChecked = "AzureNotChecked"
+
+	// ReasonNotSynced is used as the reason of the Ready condition before the Secret has been synced
+	ReasonNotSynced = "NotSynced"
+
+	// ReasonAzureReachable is used as the reason of the AzureReachable condition when the object
+	// was read from Azure Key Vault
+	ReasonAzureReachable = "AzureReachable"
+)
+
+// getCondition returns the condition of conditionType, or nil if not set
+func getCondition(status *akv.AzureKeyVaultSecretStatus, conditionType akv.AzureKeyVaultSecretConditionType) *akv.AzureKeyVaultSecretCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition sets the condition of conditionType, only changing the transition time
+// when the status of the condition changes
+func setCondition(status *akv.AzureKeyVaultSecretStatus, conditionType akv.AzureKeyVaultSecretConditionType, conditionStatus corev1.ConditionStatus, reason, message string, now metav1.Time) {
+	condition := getCondition(status, conditionType)
+	if condition == nil {
+		status.Conditions = append(status.Conditions, akv.AzureKeyVaultSecretCondition{Type: conditionType})
+		condition = &status.Conditions[len(status.Conditions)-1]
+	}
+
+	if condition.Status != conditionStatus {
+		condition.LastTransitionTime = now
+	}
+	condition.Status = conditionStatus
+	condition.Reason = reason
+	condition.Message = message
+}
+
+// setReadyCondition sets the Ready condition, which is true when both the Synced and
+// AzureReachable conditions are true
+func setReadyCondition(status *akv.AzureKeyVaultSecretStatus, now metav1.Time) {
+	synced := getCondition(status, akv.AzureKeyVaultSecretSynced)
+	azureReachable := getCondition(status, akv.AzureKeyVaultSecretAzureReachable)
+
+	switch {
+	case synced == nil:
+		setCondition(status, akv.AzureKeyVaultSecretReady, corev1.ConditionFalse, ReasonNotSynced, "Secret not synced yet", now)
+	case synced.Status != corev1.ConditionTrue:
+		setCondition(status, akv.AzureKeyVaultSecretReady, corev1.ConditionFalse, synced.Reason, synced.Message, now)
+	case azureReachable == nil:
+		setCondition(status, akv.AzureKeyVaultSecretReady, corev1.ConditionFalse, ReasonAzureNotChecked, "Azure Key Vault not checked yet", now)
+	case azureReachable.Status != corev1.ConditionTrue:
+		setCondition(status, akv.AzureKeyVaultSecretReady, corev1.ConditionFalse, azureReachable.Reason, azureReachable.Message, now)
+	default:
+		setCondition(status, akv.AzureKeyVaultSecretReady, corev1.ConditionTrue, ReasonReady, "Secret is synced with Azure Key Vault", now)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func TestSetConditionTransitionTime(t *testing.T) {
+	status := &akv.AzureKeyVaultSecretStatus{}
+	first := metav1.NewTime(time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC))
+	second := metav1.NewTime(first.Add(time.Minute))
+	third := metav1.NewTime(second.Add(time.Minute))
+
+	setCondition(status, akv.AzureKeyVaultSecretSynced, corev1.ConditionTrue, SuccessSynced, "synced", first)
+	setCondition(status, akv.AzureKeyVaultSecretSynced, corev1.ConditionTrue, SuccessSynced, "synced again", second)
+
+	condition := getCondition(status, akv.AzureKeyVaultSecretSynced)
+	if len(status.Conditions) != 1 {
+		t.Fatalf("expected 1 condition but got %d", len(status.Conditions))
+	}
+	if !condition.LastTransitionTime.Equal(&first) {
+		t.Errorf("expected transition time to stay at %v when status is unchanged, but got %v", first, condition.LastTransitionTime)
+	}
+	if condition.Message != "synced again" {
+		t.Errorf("expected message to be updated, but got '%s'", condition.Message)
+	}
+
+	setCondition(status, akv.AzureKeyVaultSecretSynced, corev1.ConditionFalse, ErrSecretSync, "failed", third)
+	if condition = getCondition(status, akv.AzureKeyVaultSecretSynced); !condition.LastTransitionTime.Equal(&third) {
+		t.Errorf("expected transition time to change to %v when status changes, but got %v", third, condition.LastTransitionTime)
+	}
+}
+
+func TestSetReadyCondition(t *testing.T) {
+	now := metav1.Now()
+
+	tests := []struct {
+		name           string
+		synced         corev1.ConditionStatus
+		azureReachable corev1.ConditionStatus
+		expectedStatus corev1.ConditionStatus
+		expectedReason string
+	}{
+		{name: "not synced yet", expectedStatus: corev1.ConditionFalse, expectedReason: ReasonNotSynced},
+		{name: "azure not checked yet", synced: corev1.ConditionTrue, expectedStatus: corev1.ConditionFalse, expectedReason: ReasonAzureNotChecked},
+		{name: "secret sync failed", synced: corev1.ConditionFalse, azureReachable: corev1.ConditionTrue, expectedStatus: corev1.ConditionFalse, expectedReason: ErrSecretSync},
+		{name: "azure unreachable", synced: corev1.ConditionTrue, azureReachable: corev1.ConditionFalse, expectedStatus: corev1.ConditionFalse, expectedReason: ErrAzureVault},
+		{name: "ready", synced: corev1.ConditionTrue, azureReachable: corev1.ConditionTrue, expectedStatus: corev1.ConditionTrue, expectedReason: ReasonReady},
+	}
+
+	for _, test := range tests {
+		status := &akv.AzureKeyVaultSecretStatus{}
+		if test.synced != "" {
+			reason := SuccessSynced
+			if test.synced != corev1.ConditionTrue {
+				reason = ErrSecretSync
+			}
+			setCondition(status, akv.AzureKeyVaultSecretSynced, test.synced, reason, "", now)
+		}
+		if test.azureReachable != "" {
+			reason := ReasonAzureReachable
+			if test.azureReachable != corev1.ConditionTrue {
+				reason = ErrAzureVault
+			}
+			setCondition(status, akv.AzureKeyVaultSecretAzureReachable, test.azureReachable, reason, "", now)
+		}
+
+		setReadyCondition(status, now)
+
+		ready := getCondition(status, akv.AzureKeyVaultSecretReady)
+		if ready.Status != test.expectedStatus || ready.Reason != test.expectedReason {
+			t.Errorf("%s: expected Ready to be %s with reason %s, but got %s with reason %s", test.name, test.expectedStatus, test.expectedReason, ready.Status, ready.Reason)
+		}
+	}
+}
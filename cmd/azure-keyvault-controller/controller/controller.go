@@ -21,6 +21,7 @@ package controller
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -33,6 +34,7 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
 	keyvaultScheme "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/scheme"
 	informers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/informers/externalversions/azurekeyvault/v1alpha1"
@@ -50,6 +52,26 @@ const (
 	// to sync due to a Secret of the same name already existing.
 	ErrAzureVault = "ErrAzureVault"
 
+	// ErrVaultNotAllowed is used as part of the Event 'reason' when a AzureKeyVaultSecret
+	// uses a vault its namespace is not allowed to use
+	ErrVaultNotAllowed = "ErrVaultNotAllowed"
+
+	// ErrSecretSync is used as the reason of the Synced condition when a AzureKeyVaultSecret
+	// fails to create or update its Secret
+	ErrSecretSync = "ErrSecretSync"
+
+	// ErrCertificateKeyMismatch is used as part of the Event 'reason' when a AzureKeyVaultSecret
+	// fails to sync because the private key of the certificate does not match the certificate
+	ErrCertificateKeyMismatch = "ErrCertificateKeyMismatch"
+
+	// WarningCertificateExpiring is used as part of the Event 'reason' when a certificate synced
+	// by a AzureKeyVaultSecret is about to expire
+	WarningCertificateExpiring = "CertificateExpiring"
+
+	// WarningCertificateExpired is used as part of the Event 'reason' when a certificate synced
+	// by a AzureKeyVaultSecret has expired
+	WarningCertificateExpired = "CertificateExpired"
+
 	// FailedAzureKeyVault is the message used for Events when a resource
 	// fails to get secret from Azure Key Vault
 	FailedAzureKeyVault = "Failed to get secret for '%s' from Azure Key Vault '%s'"
@@ -65,6 +87,18 @@ const (
 	// MessageResourceSyncedWithAzure is the message used for an Event fired when a AzureKeyVaultSecret
 	// is synced successfully after getting updated secret from Azure Key Vault
 	MessageResourceSyncedWithAzure = "AzureKeyVaultSecret synced successfully with Azure Key Vault"
+
+	// MessageCertificateKeyMismatch is the message used for Events when the private key of
+	// a certificate in Azure Key Vault does not match the certificate
+	MessageCertificateKeyMismatch = "Private key of certificate '%s' in Azure Key Vault '%s' does not match the certificate - refusing to update Secret"
+
+	// MessageCertificateExpiring is the message used for Events when a certificate in
+	// Azure Key Vault is about to expire
+	MessageCertificateExpiring = "Certificate '%s' in Azure Key Vault '%s' expires in %d days, at %s - renew it in Azure Key Vault"
+
+	// MessageCertificateExpired is the message used for Events when a certificate in
+	// Azure Key Vault has expired
+	MessageCertificateExpired = "Certificate '%s' in Azure Key Vault '%s' expired at %s - renew it in Azure Key Vault"
 )
 
 // Controller is the controller implementation for AzureKeyVaultSecret resources
@@ -75,6 +109,16 @@ type Controller struct {
 	secretsSynced              cache.InformerSynced
 	azureKeyVaultSecretsSynced cache.InformerSynced
 
+	// azureKeyVaultSecretsIndexer finds AzureKeyVaultSecrets by the vault objects they sync
+	azureKeyVaultSecretsIndexer cache.Indexer
+
+	// running is set while the workers are running
+	running int32
+
+	// fallbackPollInterval is the default poll interval when changes are received from
+	// Event Grid, or 0 to poll at the normal rate of workqueueAzure
+	fallbackPollInterval time.Duration
+
 	// workqueue is a rate limited work queue. This is used to queue work to be
 	// processed instead of performing it as soon as a change happens. This
 	// means we can ensure we only process a fixed amount of resources at a
@@ -90,13 +134,16 @@ func NewController(handler *Handler, secretInformer coreinformers.SecretInformer
 	// Add azure-keyvault-controller types to the default Kubernetes Scheme so Events can be
 	// logged for azure-keyvault-controller types.
 	utilruntime.Must(keyvaultScheme.AddToScheme(scheme.Scheme))
+	utilruntime.Must(azureKeyVaultSecretsInformer.Informer().AddIndexers(cache.Indexers{vaultObjectIndex: vaultObjectIndexFunc}))
 
 	controller := &Controller{
-		handler:                    handler,
-		secretsSynced:              secretInformer.Informer().HasSynced,
-		azureKeyVaultSecretsSynced: azureKeyVaultSecretsInformer.Informer().HasSynced,
-		workqueue:                  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "AzureKeyVaultSecrets"),
-		workqueueAzure:             workqueue.NewNamedRateLimitingQueue(workqueue.NewItemFastSlowRateLimiter(azureFrequency.Normal, azureFrequency.Slow, azureFrequency.MaxFailuresBeforeSlowingDown), "AzureKeyVault"),
+		handler:                     handler,
+		secretsSynced:               secretInformer.Informer().HasSynced,
+		azureKeyVaultSecretsSynced:  azureKeyVaultSecretsInformer.Informer().HasSynced,
+		azureKeyVaultSecretsIndexer: azureKeyVaultSecretsInformer.Informer().GetIndexer(),
+		workqueue:                   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), workqueueName),
+		workqueueAzure:              workqueue.NewNamedRateLimitingQueue(workqueue.NewItemFastSlowRateLimiter(azureFrequency.Normal, azureFrequency.Slow, azureFrequency.MaxFailuresBeforeSlowingDown), workqueueAzureName),
+		fallbackPollInterval:        azureFrequency.Fallback,
 	}
 
 	log.Info("Setting up event handlers")
@@ -126,6 +173,13 @@ func NewController(handler *Handler, secretInformer coreinformers.SecretInformer
 
 			log.Debugf("AzureKeyVaultSecret '%s' changed. Adding to queue.", newSecret.Name)
 			controller.enqueueAzureKeyVaultSecret(new)
+
+			if newSecret.Generation != oldSecret.Generation {
+				// Spec has changed (like a new object version), so get it from Azure
+				// right away - also when polling is disabled for this object
+				log.Debugf("AzureKeyVaultSecret '%s' spec changed. Adding to Azure queue.", newSecret.Name)
+				controller.enqueueAzureSync(new)
+			}
 		},
 		DeleteFunc: func(obj interface{}) {
 			secret := obj.(*akv.AzureKeyVaultSecret)
@@ -186,7 +240,7 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 
 	// Wait for the caches to be synced before starting workers
 	log.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.secretsSynced, c.azureKeyVaultSecretsSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, append([]cache.InformerSynced{c.secretsSynced, c.azureKeyVaultSecretsSynced}, c.handler.workloadsSynced...)...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -197,6 +251,9 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 		go wait.Until(c.runAzureWorker, time.Second, stopCh)
 	}
 
+	atomic.StoreInt32(&c.running, 1)
+	defer atomic.StoreInt32(&c.running, 0)
+
 	log.Info("Started workers")
 	<-stopCh
 	log.Info("Shutting down workers")
@@ -204,6 +261,22 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	return nil
 }
 
+// HasSynced returns true when the informer caches of the controller are synced
+func (c *Controller) HasSynced() bool {
+	for _, synced := range c.handler.workloadsSynced {
+		if !synced() {
+			return false
+		}
+	}
+	return c.secretsSynced() && c.azureKeyVaultSecretsSynced()
+}
+
+// IsRunning returns true while the workers of the controller are running, which is only
+// on the leader when using leader election
+func (c *Controller) IsRunning() bool {
+	return atomic.LoadInt32(&c.running) == 1
+}
+
 // runWorker is a long-running function that will continually call the
 // processNextWorkItem function in order to read and process a message on the
 // workqueue.
@@ -241,8 +314,10 @@ func (c *Controller) processNextWorkItem(queue workqueue.RateLimitingInterface,
 		}
 
 		var err error
+		queueName := workqueueName
 		if syncAzure {
 			log.Debugf("Handling '%s' in Azure queue...", key)
+			queueName = workqueueAzureName
 			successMsg = "Successfully synced AzureKeyVaultSecret '%s' with Azure Key Vault"
 			err = c.handler.azureSyncHandler(key)
 		} else {
@@ -251,13 +326,28 @@ func (c *Controller) processNextWorkItem(queue workqueue.RateLimitingInterface,
 			err = c.handler.kubernetesSyncHandler(key)
 		}
 
+		// Only record metrics for AzureKeyVaultSecrets still existing, to avoid
+		// bringing back metrics removed when deleted
+		if _, getErr := c.handler.getAzureKeyVaultSecret(key); getErr == nil {
+			recordSync(queueName, key, err)
+		}
+
 		if err != nil {
+			// A throttled vault tells when to retry, so the rate limiter is skipped
+			if throttled, ok := vault.IsThrottled(err); ok && throttled.RetryAfter > 0 {
+				queue.AddAfter(key, throttled.RetryAfter)
+				return fmt.Errorf("error syncing '%s': %s, requeuing in %s", key, err.Error(), throttled.RetryAfter)
+			}
 			queue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
 		}
 
 		queue.Forget(obj)
 		log.Infof(successMsg, key)
+
+		if syncAzure {
+			c.scheduleNextAzurePoll(key)
+		}
 		return nil
 	}(obj)
 
@@ -304,9 +394,95 @@ func (c *Controller) enqueueAzurePoll(obj interface{}) {
 		utilruntime.HandleError(err)
 		return
 	}
+
+	azureKeyVaultSecret := obj.(*akv.AzureKeyVaultSecret)
+	if !shouldPollAzure(azureKeyVaultSecret) {
+		log.Debugf("Polling Azure disabled for AzureKeyVaultSecret '%s'. Skipping.", key)
+		return
+	}
+
+	if interval := c.pollInterval(azureKeyVaultSecret); interval > 0 {
+		c.workqueueAzure.AddAfter(key, interval)
+		return
+	}
 	c.workqueueAzure.AddRateLimited(key)
 }
 
+// enqueueAzureSync takes a AzureKeyVaultSecret resource and puts it onto the Azure
+// work queue for immediate processing, regardless of its poll settings. This method
+// should *not* be passed resources of any type other than AzureKeyVaultSecret.
+func (c *Controller) enqueueAzureSync(obj interface{}) {
+	var key string
+	var err error
+	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.workqueueAzure.Add(key)
+}
+
+// scheduleNextAzurePoll puts the AzureKeyVaultSecret back on the Azure work queue
+// when it has its own poll interval, since it may be shorter than the informer resync
+func (c *Controller) scheduleNextAzurePoll(key string) {
+	azureKeyVaultSecret, err := c.handler.getAzureKeyVaultSecret(key)
+	if err != nil {
+		return
+	}
+
+	if !shouldPollAzure(azureKeyVaultSecret) {
+		return
+	}
+
+	if interval := c.pollInterval(azureKeyVaultSecret); interval > 0 {
+		c.workqueueAzure.AddAfter(key, interval)
+	}
+}
+
+// pollInterval returns the poll interval of the AzureKeyVaultSecret, or the fallback poll
+// interval when changes are received from Event Grid. 0 means the normal poll frequency.
+func (c *Controller) pollInterval(azureKeyVaultSecret *akv.AzureKeyVaultSecret) time.Duration {
+	if interval := azurePollInterval(azureKeyVaultSecret); interval > 0 {
+		return interval
+	}
+	return c.fallbackPollInterval
+}
+
+// shouldPollAzure returns true if the AzureKeyVaultSecret should be polled for changes in
+// Azure Key Vault. Objects with a fixed version never change, so they are not polled
+// unless explicitly asked to. When syncing multiple objects, it is polled if any of
+// the objects should be polled.
+func shouldPollAzure(azureKeyVaultSecret *akv.AzureKeyVaultSecret) bool {
+	for _, object := range vaultObjects(azureKeyVaultSecret) {
+		if shouldPollObject(object) {
+			return true
+		}
+	}
+	return false
+}
+
+func shouldPollObject(object akv.AzureKeyVaultObject) bool {
+	if object.Poll != nil {
+		return *object.Poll
+	}
+	return object.Version == ""
+}
+
+// azurePollInterval returns the poll interval set for the AzureKeyVaultSecret, or 0 if
+// the default poll frequency should be used. When syncing multiple objects, the
+// shortest interval of the polled objects is used.
+func azurePollInterval(azureKeyVaultSecret *akv.AzureKeyVaultSecret) time.Duration {
+	var interval time.Duration
+	for _, object := range vaultObjects(azureKeyVaultSecret) {
+		if object.PollInterval == nil || !shouldPollObject(object) {
+			continue
+		}
+		if interval == 0 || object.PollInterval.Duration < interval {
+			interval = object.PollInterval.Duration
+		}
+	}
+	return interval
+}
+
 // dequeueAzureKeyVaultSecret takes a AzureKeyVaultSecret resource and converts it into a namespace/name
 // string which is then put onto the work queue for deltion. This method should *not* be
 // passed resources of any type other than AzureKeyVaultSecret.
@@ -326,4 +502,5 @@ func (c *Controller) enqueueDeleteAzureKeyVaultSecret(obj interface{}) {
 		return
 	}
 	c.workqueueAzure.Forget(key)
+	forgetSyncMetrics(key)
 }
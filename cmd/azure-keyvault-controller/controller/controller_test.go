@@ -0,0 +1,128 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v1alpha1"
+)
+
+func TestShouldPollAzure(t *testing.T) {
+	enabled := true
+	disabled := false
+
+	akvs := secret()
+	if !shouldPollAzure(akvs) {
+		t.Error("should poll by default")
+	}
+
+	akvs.Spec.Vault.Object.Version = "some-version"
+	if shouldPollAzure(akvs) {
+		t.Error("should not poll by default when version is fixed")
+	}
+
+	akvs.Spec.Vault.Object.Poll = &enabled
+	if !shouldPollAzure(akvs) {
+		t.Error("should poll when explicitly enabled for fixed version")
+	}
+
+	akvs = secret()
+	akvs.Spec.Vault.Object.Poll = &disabled
+	if shouldPollAzure(akvs) {
+		t.Error("should not poll when explicitly disabled")
+	}
+}
+
+func TestAzurePollInterval(t *testing.T) {
+	akvs := secret()
+	if interval := azurePollInterval(akvs); interval != 0 {
+		t.Errorf("expected no poll interval by default but got %s", interval)
+	}
+
+	akvs.Spec.Vault.Object.PollInterval = &metav1.Duration{Duration: 30 * time.Second}
+	if interval := azurePollInterval(akvs); interval != 30*time.Second {
+		t.Errorf("expected poll interval of 30s but got %s", interval)
+	}
+}
+
+// recordingQueue records how items are requeued
+type recordingQueue struct {
+	workqueue.RateLimitingInterface
+	rateLimited []interface{}
+	delays      map[interface{}]time.Duration
+}
+
+func (q *recordingQueue) AddRateLimited(item interface{}) {
+	q.rateLimited = append(q.rateLimited, item)
+}
+
+func (q *recordingQueue) AddAfter(item interface{}, duration time.Duration) {
+	q.delays[item] = duration
+}
+
+func TestProcessThrottledWorkItem(t *testing.T) {
+	azureKeyVaultSecret := secret()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(azureKeyVaultSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	if _, err := clientset.AzurekeyvaultV1alpha1().AzureKeyVaultSecrets(azureKeyVaultSecret.Namespace).Create(azureKeyVaultSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	retryAfter := 42 * time.Second
+	controller := &Controller{
+		handler: &Handler{
+			azureKeyvaultClientset:     clientset,
+			azureKeyVaultSecretsLister: listers.NewAzureKeyVaultSecretLister(indexer),
+			recorder:                   record.NewFakeRecorder(10),
+			clock:                      &Clock{},
+			vaultService: &fakeVaultService{
+				fakeSecretErr: &vault.ThrottledError{Vault: azureKeyVaultSecret.Spec.Vault.Name, StatusCode: 429, RetryAfter: retryAfter},
+			},
+		},
+	}
+
+	key := azureKeyVaultSecret.Namespace + "/" + azureKeyVaultSecret.Name
+	queue := &recordingQueue{
+		RateLimitingInterface: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		delays:                make(map[interface{}]time.Duration),
+	}
+	defer queue.ShutDown()
+	queue.Add(key)
+
+	if !controller.processNextWorkItem(queue, true) {
+		t.Fatal("expected queue to keep running")
+	}
+	if delay, ok := queue.delays[key]; !ok || delay != retryAfter {
+		t.Errorf("expected '%s' to be requeued after %s, but got %s", key, retryAfter, delay)
+	}
+	if len(queue.rateLimited) != 0 {
+		t.Errorf("expected throttled '%s' not to be rate limited, but got %v", key, queue.rateLimited)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+const (
+	// vaultObjectIndex indexes AzureKeyVaultSecrets by the vault and name of the objects
+	// they sync. AzureKeyVaultSecrets using a selector are indexed by the vault only.
+	vaultObjectIndex = "vaultObject"
+
+	eventTypeSubscriptionValidation = "Microsoft.EventGrid.SubscriptionValidationEvent"
+	eventTypeSecretNewVersion       = "Microsoft.KeyVault.SecretNewVersionCreated"
+	eventTypeCertificateNewVersion  = "Microsoft.KeyVault.CertificateNewVersionCreated"
+	eventTypeKeyNewVersion          = "Microsoft.KeyVault.KeyNewVersionCreated"
+
+	// maxEventGridRequestSize limits the size of requests from Event Grid, which sends at
+	// most 1 MB in each request
+	maxEventGridRequestSize = 1 << 20
+)
+
+// eventGridEvent is an event in the Azure Event Grid event schema
+type eventGridEvent struct {
+	ID        string          `json:"id"`
+	EventType string          `json:"eventType"`
+	Subject   string          `json:"subject"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// keyVaultEventData is the data of events from Azure Key Vault
+type keyVaultEventData struct {
+	VaultName  string `json:"VaultName"`
+	ObjectType string `json:"ObjectType"`
+	ObjectName string `json:"ObjectName"`
+	Version    string `json:"Version"`
+}
+
+// subscriptionValidationData is the data of the event sent by Event Grid to validate a
+// new subscription
+type subscriptionValidationData struct {
+	ValidationCode string `json:"validationCode"`
+}
+
+// EventGridHandler receives Azure Event Grid events for new versions of objects in Azure
+// Key Vault, syncing the AzureKeyVaultSecrets using them right away instead of waiting
+// for the next poll
+type EventGridHandler struct {
+	controller *Controller
+	token      string
+}
+
+// EventGridHandler returns a new EventGridHandler enqueuing AzureKeyVaultSecrets on the
+// controller. Requests must have token in the token query parameter, so all requests are
+// refused when token is empty.
+func (c *Controller) EventGridHandler(token string) *EventGridHandler {
+	return &EventGridHandler{
+		controller: c,
+		token:      token,
+	}
+}
+
+func (h *EventGridHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(h.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var events []eventGridEvent
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxEventGridRequestSize)).Decode(&events); err != nil {
+		http.Error(w, "invalid event grid events", http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range events {
+		if event.EventType != eventTypeSubscriptionValidation {
+			continue
+		}
+
+		var data subscriptionValidationData
+		if err := json.Unmarshal(event.Data, &data); err != nil || data.ValidationCode == "" {
+			http.Error(w, "invalid subscription validation event", http.StatusBadRequest)
+			return
+		}
+
+		log.Infof("Validating Event Grid subscription for '%s'", event.Subject)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"validationResponse": data.ValidationCode})
+		return
+	}
+
+	// Standby replicas do not process the workqueues, so Event Grid is asked to retry,
+	// hopefully reaching the leader
+	if !h.controller.IsRunning() {
+		http.Error(w, "controller not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, event := range events {
+		switch event.EventType {
+		case eventTypeSecretNewVersion, eventTypeCertificateNewVersion, eventTypeKeyNewVersion:
+		default:
+			log.Debugf("Ignoring Event Grid event '%s' of type '%s'", event.ID, event.EventType)
+			continue
+		}
+
+		var data keyVaultEventData
+		if err := json.Unmarshal(event.Data, &data); err != nil || data.VaultName == "" || data.ObjectName == "" {
+			log.Warningf("Ignoring invalid Event Grid event '%s' of type '%s'", event.ID, event.EventType)
+			continue
+		}
+
+		enqueued := h.controller.enqueueVaultObjectChange(data.VaultName, data.ObjectName)
+		log.Infof("New version '%s' of %s '%s' in Azure Key Vault '%s' - syncing %d AzureKeyVaultSecrets", data.Version, strings.ToLower(data.ObjectType), data.ObjectName, data.VaultName, enqueued)
+		recordEventGridEvent(event.EventType, enqueued)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// enqueueVaultObjectChange puts all AzureKeyVaultSecrets syncing the named object in the
+// vault onto the Azure work queue for immediate processing, including those using a
+// selector on the vault. The number of AzureKeyVaultSecrets enqueued is returned.
+func (c *Controller) enqueueVaultObjectChange(vaultName, objectName string) int {
+	keys := make(map[string]bool)
+	for _, indexKey := range []string{vaultObjectIndexKey(vaultName, objectName), vaultObjectIndexKey(vaultName, "")} {
+		objs, err := c.azureKeyVaultSecretsIndexer.ByIndex(vaultObjectIndex, indexKey)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+
+		for _, obj := range objs {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil || keys[key] {
+				continue
+			}
+			keys[key] = true
+			c.workqueueAzure.Add(key)
+		}
+	}
+	return len(keys)
+}
+
+// vaultObjectIndexFunc returns the vault object index keys of a AzureKeyVaultSecret
+func vaultObjectIndexFunc(obj interface{}) ([]string, error) {
+	azureKeyVaultSecret, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, object := range vaultObjects(azureKeyVaultSecret) {
+		keys = append(keys, vaultObjectIndexKey(azureKeyVaultSecret.Spec.Vault.Name, object.Name))
+	}
+	return keys, nil
+}
+
+// vaultObjectIndexKey returns the index key of an object in a vault, or of the vault itself
+// if objectName is empty. Names in Azure Key Vault are case-insensitive.
+func vaultObjectIndexKey(vaultName, objectName string) string {
+	return strings.ToLower(vaultName + "/" + objectName)
+}
@@ -0,0 +1,111 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func newEventGridTestController(t *testing.T, secrets ...*akv.AzureKeyVaultSecret) *Controller {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{vaultObjectIndex: vaultObjectIndexFunc})
+	for _, secret := range secrets {
+		if err := indexer.Add(secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Controller{
+		azureKeyVaultSecretsIndexer: indexer,
+		workqueueAzure:              workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		running:                     1,
+	}
+}
+
+func postEvents(handler http.Handler, target, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	return recorder
+}
+
+func TestEventGridSubscriptionValidation(t *testing.T) {
+	handler := newEventGridTestController(t).EventGridHandler("some-token")
+
+	resp := postEvents(handler, "/events?token=some-token", `[{"id":"1","eventType":"Microsoft.EventGrid.SubscriptionValidationEvent","data":{"validationCode":"some-code"}}]`)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"validationResponse":"some-code"`) {
+		t.Errorf("expected validation response, but got %d '%s'", resp.Code, resp.Body.String())
+	}
+}
+
+func TestEventGridEnqueuesAffectedSecrets(t *testing.T) {
+	affected := secret()
+	affected.Name = "affected"
+	affected.Spec.Vault.Object.Name = "My-Secret"
+
+	selected := multiObjectSecret()
+	selected.Name = "selected"
+	selected.Spec.Vault.Selector = &akv.AzureKeyVaultSecretSelector{}
+
+	unaffected := secret()
+	unaffected.Name = "unaffected"
+	unaffected.Spec.Vault.Object.Name = "other-secret"
+
+	controller := newEventGridTestController(t, affected, selected, unaffected)
+	handler := controller.EventGridHandler("some-token")
+
+	body := `[{"id":"1","eventType":"Microsoft.KeyVault.SecretNewVersionCreated","data":{"VaultName":"` + affected.Spec.Vault.Name + `","ObjectType":"Secret","ObjectName":"my-secret","Version":"abc"}}]`
+	if resp := postEvents(handler, "/events?token=some-token", body); resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.Code)
+	}
+
+	if controller.workqueueAzure.Len() != 2 {
+		t.Errorf("expected the affected and selecting AzureKeyVaultSecrets to be enqueued, but got %d", controller.workqueueAzure.Len())
+	}
+}
+
+func TestEventGridRequiresToken(t *testing.T) {
+	handler := newEventGridTestController(t).EventGridHandler("some-token")
+
+	if resp := postEvents(handler, "/events", `[]`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without token but got %d", resp.Code)
+	}
+	if resp := postEvents(handler, "/events?token=some-token", `[]`); resp.Code != http.StatusOK {
+		t.Errorf("expected status 200 with token but got %d", resp.Code)
+	}
+
+	withoutToken := newEventGridTestController(t).EventGridHandler("")
+	if resp := postEvents(withoutToken, "/events?token=", `[]`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 when no token is configured but got %d", resp.Code)
+	}
+}
+
+func TestEventGridAsksForRetryWhenNotRunning(t *testing.T) {
+	controller := newEventGridTestController(t)
+	controller.running = 0
+
+	body := `[{"id":"1","eventType":"Microsoft.KeyVault.SecretNewVersionCreated","data":{"VaultName":"some-vault","ObjectName":"some-secret"}}]`
+	if resp := postEvents(controller.EventGridHandler("some-token"), "/events?token=some-token", body); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 on standby replica but got %d", resp.Code)
+	}
+}
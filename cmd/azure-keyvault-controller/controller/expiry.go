@@ -0,0 +1,151 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+// newCertificateStatus returns the status of the leaf certificate of cert, or nil if
+// cert has no certificates
+func newCertificateStatus(cert *vault.Certificate) *akv.AzureKeyVaultCertificateStatus {
+	if cert == nil || len(cert.Certificates) == 0 {
+		return nil
+	}
+
+	leaf := cert.Certificates[0]
+	thumbprint := sha1.Sum(leaf.Raw)
+
+	var names []string
+	for _, name := range leaf.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, email := range leaf.EmailAddresses {
+		names = append(names, "email:"+email)
+	}
+	for _, uri := range leaf.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+
+	return &akv.AzureKeyVaultCertificateStatus{
+		Subject:                 leaf.Subject.String(),
+		Issuer:                  leaf.Issuer.String(),
+		NotBefore:               metav1.NewTime(leaf.NotBefore),
+		NotAfter:                metav1.NewTime(leaf.NotAfter),
+		Thumbprint:              strings.ToUpper(hex.EncodeToString(thumbprint[:])),
+		SubjectAlternativeNames: names,
+	}
+}
+
+// updateCertificateStatuses sets the certificate status of the AzureKeyVaultSecret and of
+// each of objectStatuses, recording expiry warnings compared to the current status. Objects
+// that failed keep the certificate status they had.
+func (h *Handler) updateCertificateStatuses(azureKeyVaultSecret *akv.AzureKeyVaultSecret, status *akv.AzureKeyVaultSecretStatus, certificate *akv.AzureKeyVaultCertificateStatus, objectStatuses []akv.AzureKeyVaultObjectStatus, now time.Time) {
+	if certificate != nil {
+		h.checkCertificateExpiry(azureKeyVaultSecret, azureKeyVaultSecret.Spec.Vault.Object.Name, status.Certificate, certificate, now)
+		status.Certificate = certificate
+	}
+
+	for i := range objectStatuses {
+		objectStatus := &objectStatuses[i]
+		previous := findObjectStatus(status.Objects, objectStatus.Name, objectStatus.Type)
+
+		if objectStatus.Certificate == nil {
+			if objectStatus.Error != "" && previous != nil {
+				objectStatus.Certificate = previous.Certificate
+			}
+			continue
+		}
+
+		var previousCertificate *akv.AzureKeyVaultCertificateStatus
+		if previous != nil {
+			previousCertificate = previous.Certificate
+		}
+		h.checkCertificateExpiry(azureKeyVaultSecret, objectStatus.Name, previousCertificate, objectStatus.Certificate, now)
+	}
+}
+
+// checkCertificateExpiry records a Warning event when the certificate has passed one of the
+// expiry warning thresholds since the last warning, so each threshold is warned about only
+// once for each certificate. previous is the status of the certificate last synced.
+func (h *Handler) checkCertificateExpiry(azureKeyVaultSecret *akv.AzureKeyVaultSecret, objectName string, previous, current *akv.AzureKeyVaultCertificateStatus, now time.Time) {
+	if previous != nil && previous.Thumbprint == current.Thumbprint {
+		current.ExpiryWarningThreshold = previous.ExpiryWarningThreshold
+	}
+
+	remaining := current.NotAfter.Sub(now)
+	threshold, ok := h.expiryThreshold(remaining)
+	if !ok {
+		return
+	}
+	if current.ExpiryWarningThreshold != nil && current.ExpiryWarningThreshold.Duration <= threshold {
+		return
+	}
+
+	reason := WarningCertificateExpiring
+	msg := fmt.Sprintf(MessageCertificateExpiring, objectName, azureKeyVaultSecret.Spec.Vault.Name, int(math.Ceil(remaining.Hours()/24)), current.NotAfter.UTC().Format(time.RFC3339))
+	if threshold == 0 {
+		reason = WarningCertificateExpired
+		msg = fmt.Sprintf(MessageCertificateExpired, objectName, azureKeyVaultSecret.Spec.Vault.Name, current.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	log.Warning(msg)
+	h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, reason, msg)
+	current.ExpiryWarningThreshold = &metav1.Duration{Duration: threshold}
+}
+
+// expiryThreshold returns the smallest expiry warning threshold the remaining time before
+// expiry is within, or 0 if the certificate has expired. False is returned if the
+// certificate is not within any of the thresholds.
+func (h *Handler) expiryThreshold(remaining time.Duration) (time.Duration, bool) {
+	if remaining <= 0 {
+		return 0, true
+	}
+
+	var threshold time.Duration
+	for _, t := range h.certificateExpiryThresholds {
+		if remaining <= t && (threshold == 0 || t < threshold) {
+			threshold = t
+		}
+	}
+	return threshold, threshold > 0
+}
+
+func findObjectStatus(statuses []akv.AzureKeyVaultObjectStatus, name string, objectType akv.AzureKeyVaultObjectType) *akv.AzureKeyVaultObjectStatus {
+	for i := range statuses {
+		if statuses[i].Name == name && statuses[i].Type == objectType {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func TestNewCertificateStatus(t *testing.T) {
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	cert := &vault.Certificate{
+		Certificates: []*x509.Certificate{{
+			Raw:         []byte("some certificate"),
+			Subject:     pkix.Name{CommonName: "example.com"},
+			Issuer:      pkix.Name{CommonName: "Some CA"},
+			NotAfter:    notAfter,
+			DNSNames:    []string{"example.com", "www.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		}},
+	}
+
+	status := newCertificateStatus(cert)
+	if status.Subject != "CN=example.com" || status.Issuer != "CN=Some CA" {
+		t.Errorf("unexpected subject '%s' or issuer '%s'", status.Subject, status.Issuer)
+	}
+	if !status.NotAfter.Time.Equal(notAfter) {
+		t.Errorf("expected notAfter %s but got %s", notAfter, status.NotAfter)
+	}
+	if status.Thumbprint != "88F6128855332CFDFB885268DD79E408645E6DBD" {
+		t.Errorf("unexpected thumbprint '%s'", status.Thumbprint)
+	}
+	if strings.Join(status.SubjectAlternativeNames, ",") != "DNS:example.com,DNS:www.example.com,IP:10.0.0.1" {
+		t.Errorf("unexpected subject alternative names %v", status.SubjectAlternativeNames)
+	}
+
+	if newCertificateStatus(&vault.Certificate{}) != nil {
+		t.Error("expected no status for certificate without certificates")
+	}
+}
+
+func TestCheckCertificateExpiry(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	recorder := record.NewFakeRecorder(10)
+	handler := &Handler{
+		recorder:                    recorder,
+		certificateExpiryThresholds: []time.Duration{30 * day, 14 * day, 7 * day},
+	}
+	akvs := secret()
+
+	check := func(previous *akv.AzureKeyVaultCertificateStatus, remaining time.Duration) *akv.AzureKeyVaultCertificateStatus {
+		current := &akv.AzureKeyVaultCertificateStatus{
+			Thumbprint: "ABC",
+			NotAfter:   metav1.NewTime(now.Add(remaining)),
+		}
+		handler.checkCertificateExpiry(akvs, "some-cert", previous, current, now)
+		return current
+	}
+
+	expectEvent := func(reason string) {
+		t.Helper()
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, reason) {
+				t.Errorf("expected %s event, but got '%s'", reason, event)
+			}
+		default:
+			if reason != "" {
+				t.Errorf("expected %s event", reason)
+			}
+			return
+		}
+		if reason == "" {
+			t.Error("expected no event")
+		}
+	}
+
+	status := check(nil, 60*day)
+	expectEvent("")
+	if status.ExpiryWarningThreshold != nil {
+		t.Error("expected no warning threshold outside all thresholds")
+	}
+
+	status = check(status, 20*day)
+	expectEvent(WarningCertificateExpiring)
+	if status.ExpiryWarningThreshold == nil || status.ExpiryWarningThreshold.Duration != 30*day {
+		t.Errorf("expected warning threshold of 30 days but got %v", status.ExpiryWarningThreshold)
+	}
+
+	status = check(status, 15*day)
+	expectEvent("")
+
+	status = check(status, 6*day)
+	expectEvent(WarningCertificateExpiring)
+	if status.ExpiryWarningThreshold.Duration != 7*day {
+		t.Errorf("expected warning threshold of 7 days but got %v", status.ExpiryWarningThreshold)
+	}
+
+	status = check(status, -time.Hour)
+	expectEvent(WarningCertificateExpired)
+	check(status, -2*time.Hour)
+	expectEvent("")
+
+	// A renewed certificate is warned about again
+	status.Thumbprint = "DEF"
+	check(status, 6*day)
+	expectEvent(WarningCertificateExpiring)
+}
+
+func TestUpdateCertificateStatusesKeepsFailedObjects(t *testing.T) {
+	handler := &Handler{recorder: record.NewFakeRecorder(10)}
+	akvs := secret()
+
+	previous := &akv.AzureKeyVaultCertificateStatus{Thumbprint: "ABC", NotAfter: metav1.NewTime(time.Now().Add(time.Hour))}
+	status := &akv.AzureKeyVaultSecretStatus{
+		Objects: []akv.AzureKeyVaultObjectStatus{{Name: "some-cert", Type: akv.AzureKeyVaultObjectTypeCertificate, Certificate: previous}},
+	}
+	objectStatuses := []akv.AzureKeyVaultObjectStatus{{Name: "some-cert", Type: akv.AzureKeyVaultObjectTypeCertificate, Error: "some error"}}
+
+	handler.updateCertificateStatuses(akvs, status, nil, objectStatuses, time.Now())
+	if objectStatuses[0].Certificate != previous {
+		t.Error("expected failed object to keep its certificate status")
+	}
+}
@@ -20,25 +20,25 @@ limitations under the License.
 package controller
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/hex"
 	"fmt"
-	"sort"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/policy"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
@@ -56,12 +56,29 @@ type Handler struct {
 	secretsLister              corelisters.SecretLister
 	azureKeyVaultSecretsLister listers.AzureKeyVaultSecretLister
 
+	// deploymentsLister, statefulSetsLister and daemonSetsLister find workloads to roll out
+	// when their Secret changes, and are nil unless rollout of workloads is enabled
+	deploymentsLister  appslisters.DeploymentLister
+	statefulSetsLister appslisters.StatefulSetLister
+	daemonSetsLister   appslisters.DaemonSetLister
+	workloadsSynced    []cache.InformerSynced
+
 	// recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
 	recorder record.EventRecorder
 
 	vaultService vault.Service
 	clock        Timer
+
+	// certificateExpiryThresholds are the times before expiry of a certificate to
+	// record Warning events at
+	certificateExpiryThresholds []time.Duration
+
+	// secretHashKey is the key of the HMAC of Secret values stored in the status
+	secretHashKey []byte
+
+	// vaultNamespaces are the namespaces allowed to use each vault
+	vaultNamespaces policy.VaultNamespaces
 }
 
 // AzurePollFrequency controls time durations to wait between polls to Azure Key Vault for changes
@@ -74,19 +91,45 @@ type AzurePollFrequency struct {
 
 	// Slow is the time duration to wait between polls to Azure Key Vault for changes, after MaxFailuresBeforeSlowingDown is reached
 	Slow time.Duration
+
+	// Fallback is the time duration to wait between polls to Azure Key Vault when changes are
+	// received from Event Grid, replacing Normal. Failures are still retried as usual.
+	Fallback time.Duration
 }
 
 //NewHandler returns a new Handler
-func NewHandler(kubeclientset kubernetes.Interface, azureKeyvaultClientset clientset.Interface, secretLister corelisters.SecretLister, azureKeyVaultSecretsLister listers.AzureKeyVaultSecretLister, recorder record.EventRecorder, vaultService vault.Service, azureFrequency AzurePollFrequency) *Handler {
-	return &Handler{
-		kubeclientset:              kubeclientset,
-		azureKeyvaultClientset:     azureKeyvaultClientset,
-		secretsLister:              secretLister,
-		azureKeyVaultSecretsLister: azureKeyVaultSecretsLister,
-		recorder:                   recorder,
-		vaultService:               vaultService,
-		clock:                      &Clock{},
+func NewHandler(kubeclientset kubernetes.Interface, azureKeyvaultClientset clientset.Interface, secretLister corelisters.SecretLister, azureKeyVaultSecretsLister listers.AzureKeyVaultSecretLister, workloadInformers appsinformers.Interface, recorder record.EventRecorder, vaultService vault.Service, azureFrequency AzurePollFrequency, certificateExpiryThresholds []time.Duration, vaultCacheTTL time.Duration, secretHashKey []byte, vaultNamespaces policy.VaultNamespaces) *Handler {
+	// Requests are instrumented before caching, so metrics only count requests sent to Azure
+	vaultService = newInstrumentedVaultService(vaultService)
+	if vaultCacheTTL > 0 {
+		vaultService = vault.NewCachedService(vaultService, vaultCacheTTL)
+	}
+
+	handler := &Handler{
+		kubeclientset:               kubeclientset,
+		azureKeyvaultClientset:      azureKeyvaultClientset,
+		secretsLister:               secretLister,
+		azureKeyVaultSecretsLister:  azureKeyVaultSecretsLister,
+		recorder:                    recorder,
+		vaultService:                vaultService,
+		clock:                       &Clock{},
+		certificateExpiryThresholds: certificateExpiryThresholds,
+		secretHashKey:               secretHashKey,
+		vaultNamespaces:             vaultNamespaces,
+	}
+
+	// Rollout of workloads is enabled by giving the informers of workloads
+	if workloadInformers != nil {
+		handler.deploymentsLister = workloadInformers.Deployments().Lister()
+		handler.statefulSetsLister = workloadInformers.StatefulSets().Lister()
+		handler.daemonSetsLister = workloadInformers.DaemonSets().Lister()
+		handler.workloadsSynced = []cache.InformerSynced{
+			workloadInformers.Deployments().Informer().HasSynced,
+			workloadInformers.StatefulSets().Informer().HasSynced,
+			workloadInformers.DaemonSets().Informer().HasSynced,
+		}
 	}
+	return handler
 }
 
 // kubernetesSyncHandler compares the actual state with the desired, and attempts to
@@ -104,7 +147,12 @@ func (h *Handler) kubernetesSyncHandler(key string) error {
 		return err
 	}
 
+	if err = h.checkVaultAllowed(azureKeyVaultSecret, akv.AzureKeyVaultSecretSynced); err != nil {
+		return err
+	}
+
 	if secret, err = h.getOrCreateKubernetesSecret(azureKeyVaultSecret); err != nil {
+		h.updateStatusFailed(azureKeyVaultSecret, akv.AzureKeyVaultSecretSynced, ErrSecretSync, err, nil)
 		return err
 	}
 
@@ -112,9 +160,17 @@ func (h *Handler) kubernetesSyncHandler(key string) error {
 		msg := fmt.Sprintf(MessageResourceExists, secret.Name)
 		log.Warning(msg)
 		h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, ErrResourceExists, msg)
+		h.updateStatusFailed(azureKeyVaultSecret, akv.AzureKeyVaultSecretSynced, ErrResourceExists, fmt.Errorf(msg), nil)
 		return fmt.Errorf(msg)
 	}
 
+	err = h.updateStatus(azureKeyVaultSecret, func(status *akv.AzureKeyVaultSecretStatus, now metav1.Time) {
+		setCondition(status, akv.AzureKeyVaultSecretSynced, corev1.ConditionTrue, SuccessSynced, MessageResourceSynced, now)
+	})
+	if err != nil {
+		log.Warningf("Failed to update status for AzureKeyVaultSecret '%s', error: %+v", key, err)
+	}
+
 	h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
 	return nil
 }
@@ -123,6 +179,9 @@ func (h *Handler) azureSyncHandler(key string) error {
 	var azureKeyVaultSecret *akv.AzureKeyVaultSecret
 	var secret *corev1.Secret
 	var secretValue map[string][]byte
+	var certificateStatus *akv.AzureKeyVaultCertificateStatus
+	var objectVersion *vault.ObjectVersion
+	var objectStatuses []akv.AzureKeyVaultObjectStatus
 	var err error
 
 	log.Debugf("Checking state for %s in Azure", key)
@@ -133,57 +192,147 @@ func (h *Handler) azureSyncHandler(key string) error {
 		return err
 	}
 
+	if err = h.checkVaultAllowed(azureKeyVaultSecret, akv.AzureKeyVaultSecretAzureReachable); err != nil {
+		return err
+	}
+
+	h.invalidateVaultCache(azureKeyVaultSecret)
+
+	log.Debugf("Checking versions for %s in Azure", key)
+	if h.azureObjectsUnchanged(azureKeyVaultSecret) {
+		log.Debugf("Objects for %s are unchanged in Azure Key Vault", key)
+		certificateStatus, objectStatuses = syncedObjectStatuses(azureKeyVaultSecret)
+		if err = h.updateAzureKeyVaultSecretStatus(azureKeyVaultSecret, azureKeyVaultSecret.Status.SecretHash, nil, certificateStatus, objectStatuses); err != nil {
+			return err
+		}
+
+		recordAzureSync(azureKeyVaultSecret, h.clock.Now().Time)
+		recordCertificateExpiry(azureKeyVaultSecret, certificateStatus, objectStatuses)
+		return nil
+	}
+
 	log.Debugf("Getting secret value for %s in Azure", key)
-	if secretValue, err = h.getSecretFromKeyVault(azureKeyVaultSecret); err != nil {
+	if secretValue, certificateStatus, objectVersion, objectStatuses, err = h.getSecretsFromKeyVault(azureKeyVaultSecret); err != nil {
 		msg := fmt.Sprintf(FailedAzureKeyVault, azureKeyVaultSecret.Name, azureKeyVaultSecret.Spec.Vault.Name)
-		log.Errorf("failed to get secret value for '%s' from Azure Key vault '%s' using object name '%s', error: %+v", key, azureKeyVaultSecret.Spec.Vault.Name, azureKeyVaultSecret.Spec.Vault.Object.Name, err)
+		log.Errorf("failed to get secret value for '%s' from Azure Key vault '%s' using object name '%s', error: %+v", key, azureKeyVaultSecret.Spec.Vault.Name, objectNames(azureKeyVaultSecret), err)
 		h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, ErrAzureVault, msg)
+		h.updateStatusFailed(azureKeyVaultSecret, akv.AzureKeyVaultSecretAzureReachable, ErrAzureVault, err, objectStatuses)
+		if throttled, ok := vault.IsThrottled(err); ok {
+			return throttled
+		}
 		return fmt.Errorf(msg)
 	}
 
-	secretHash := getMD5Hash(secretValue)
+	secretHash := h.getSecretHash(secretValue)
 
 	log.Debugf("Checking if secret value for %s has changed in Azure", key)
-	if azureKeyVaultSecret.Status.SecretHash != secretHash {
+	previousSecretHash := azureKeyVaultSecret.Status.SecretHash
+	secretChanged := !h.secretHashMatches(previousSecretHash, secretValue)
+	if secretChanged {
 		log.Infof("Secret has changed in Azure Key Vault for AzureKeyvVaultSecret %s. Updating Secret now.", azureKeyVaultSecret.Name)
 
 		if secret, err = h.kubeclientset.CoreV1().Secrets(azureKeyVaultSecret.Namespace).Update(createNewSecret(azureKeyVaultSecret, secretValue)); err != nil {
 			log.Warningf("Failed to create Secret, Error: %+v", err)
+			h.updateStatusFailed(azureKeyVaultSecret, akv.AzureKeyVaultSecretSynced, ErrSecretSync, err, nil)
 			return err
 		}
-
-		log.Warningf("Secret value will now change for Secret '%s'. Any resources (like Pods) using this Secrets must be restarted to pick up the new value. Details: https://github.com/kubernetes/kubernetes/issues/22368", secret.Name)
 		h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeNormal, SuccessSynced, MessageResourceSyncedWithAzure)
 	}
 
+	// The status is updated before rolling out workloads, so a failed status update retried
+	// later does not roll them out a second time for the same change
 	log.Debugf("Updating status for AzureKeyVaultSecret '%s'", azureKeyVaultSecret.Name)
-	if err = h.updateAzureKeyVaultSecretStatus(azureKeyVaultSecret, secretHash); err != nil {
+	if err = h.updateAzureKeyVaultSecretStatus(azureKeyVaultSecret, secretHash, objectVersion, certificateStatus, objectStatuses); err != nil {
 		return err
 	}
 
+	if secretChanged {
+		rolledOut := 0
+		if previousSecretHash != "" && h.rolloutEnabled() {
+			rolledOut = h.rolloutWorkloads(azureKeyVaultSecret, secret.Name)
+		}
+
+		if rolledOut == 0 {
+			log.Warningf("Secret value will now change for Secret '%s'. Any resources (like Pods) using this Secrets must be restarted to pick up the new value. Details: https://github.com/kubernetes/kubernetes/issues/22368", secret.Name)
+		}
+	}
+
+	recordAzureSync(azureKeyVaultSecret, h.clock.Now().Time)
+	recordCertificateExpiry(azureKeyVaultSecret, certificateStatus, objectStatuses)
 	return nil
 }
 
-func (h *Handler) getSecretFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret) (map[string][]byte, error) {
+// checkVaultAllowed returns an error if the AzureKeyVaultSecret uses a vault its namespace
+// is not allowed to use, recording it as a failure of conditionType. The policy is checked
+// on every sync, as the vault can be changed after the AzureKeyVaultSecret was created.
+func (h *Handler) checkVaultAllowed(azureKeyVaultSecret *akv.AzureKeyVaultSecret, conditionType akv.AzureKeyVaultSecretConditionType) error {
+	err := h.vaultNamespaces.Check(azureKeyVaultSecret)
+	if err != nil {
+		log.Warning(err.Error())
+		h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, ErrVaultNotAllowed, err.Error())
+		h.updateStatusFailed(azureKeyVaultSecret, conditionType, ErrVaultNotAllowed, err, nil)
+	}
+	return err
+}
+
+// invalidateVaultCache removes the objects of the AzureKeyVaultSecret from the vault cache
+// before polling Azure Key Vault, so changes are picked up. Objects with a fixed version
+// never change and stay cached. With a selector, the whole vault is invalidated.
+func (h *Handler) invalidateVaultCache(azureKeyVaultSecret *akv.AzureKeyVaultSecret) {
+	invalidator, ok := h.vaultService.(vault.CacheInvalidator)
+	if !ok {
+		return
+	}
+
+	for _, object := range vaultObjects(azureKeyVaultSecret) {
+		if object.Version != "" {
+			continue
+		}
+		vaultSpec := azureKeyVaultSecret.Spec.Vault.DeepCopy()
+		vaultSpec.Object = object
+		invalidator.Invalidate(vaultSpec)
+	}
+}
+
+// getSecretFromKeyVault gets the object of the AzureKeyVaultSecret from Azure Key Vault as
+// values of a Secret, along with the version of the object the values were read from. When
+// the object is a certificate, the status of the certificate is also returned.
+func (h *Handler) getSecretFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret) (map[string][]byte, *akv.AzureKeyVaultCertificateStatus, *vault.ObjectVersion, error) {
 	var secretHandler KubernetesSecretHandler
+	var certificateHandler *AzureCertificateHandler
 
 	switch azureKeyVaultSecret.Spec.Vault.Object.Type {
 	case akv.AzureKeyVaultObjectTypeSecret:
 		transformator, err := transformers.CreateTransformator(&azureKeyVaultSecret.Spec.Output)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 		secretHandler = NewAzureSecretHandler(azureKeyVaultSecret, h.vaultService, *transformator)
 	case akv.AzureKeyVaultObjectTypeCertificate:
-		secretHandler = NewAzureCertificateHandler(azureKeyVaultSecret, h.vaultService)
+		certificateHandler = NewAzureCertificateHandler(azureKeyVaultSecret, h.vaultService)
+		secretHandler = certificateHandler
 	case akv.AzureKeyVaultObjectTypeKey:
 		secretHandler = NewAzureKeyHandler(azureKeyVaultSecret, h.vaultService)
 	case akv.AzureKeyVaultObjectTypeMultiKeyValueSecret:
 		secretHandler = NewAzureMultiKeySecretHandler(azureKeyVaultSecret, h.vaultService)
 	default:
-		return nil, fmt.Errorf("azure key vault object type '%s' not currently supported", azureKeyVaultSecret.Spec.Vault.Object.Type)
+		return nil, nil, nil, fmt.Errorf("azure key vault object type '%s' not currently supported", azureKeyVaultSecret.Spec.Vault.Object.Type)
+	}
+
+	values, err := secretHandler.Handle()
+	if err == vault.ErrKeyPairMismatch {
+		msg := fmt.Sprintf(MessageCertificateKeyMismatch, azureKeyVaultSecret.Spec.Vault.Object.Name, azureKeyVaultSecret.Spec.Vault.Name)
+		log.Warning(msg)
+		h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, ErrCertificateKeyMismatch, msg)
+	}
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	return secretHandler.Handle()
+
+	if certificateHandler != nil {
+		return values, newCertificateStatus(certificateHandler.certificate), secretHandler.Version(), nil
+	}
+	return values, nil, secretHandler.Version(), nil
 }
 
 func (h *Handler) getAzureKeyVaultSecret(key string) (*akv.AzureKeyVaultSecret, error) {
@@ -203,6 +352,9 @@ func (h *Handler) getAzureKeyVaultSecret(key string) (*akv.AzureKeyVaultSecret,
 func (h *Handler) getOrCreateKubernetesSecret(azureKeyVaultSecret *akv.AzureKeyVaultSecret) (*corev1.Secret, error) {
 	var secret *corev1.Secret
 	var secretValues map[string][]byte
+	var certificateStatus *akv.AzureKeyVaultCertificateStatus
+	var objectVersion *vault.ObjectVersion
+	var objectStatuses []akv.AzureKeyVaultObjectStatus
 	var err error
 
 	secretName := azureKeyVaultSecret.Spec.Output.Secret.Name
@@ -212,7 +364,10 @@ func (h *Handler) getOrCreateKubernetesSecret(azureKeyVaultSecret *akv.AzureKeyV
 
 	if secret, err = h.secretsLister.Secrets(azureKeyVaultSecret.Namespace).Get(secretName); err != nil {
 		if errors.IsNotFound(err) {
-			secretValues, err = h.getSecretFromKeyVault(azureKeyVaultSecret)
+			secretValues, certificateStatus, objectVersion, objectStatuses, err = h.getSecretsFromKeyVault(azureKeyVaultSecret)
+			if throttled, ok := vault.IsThrottled(err); ok {
+				return nil, throttled
+			}
 			if err != nil {
 				return nil, fmt.Errorf("failed to get secret from Azure Key Vault for secret '%s'/'%s', error: %+v", azureKeyVaultSecret.Namespace, azureKeyVaultSecret.Name, err)
 			}
@@ -222,7 +377,7 @@ func (h *Handler) getOrCreateKubernetesSecret(azureKeyVaultSecret *akv.AzureKeyV
 			}
 
 			log.Infof("Updating status for AzureKeyVaultSecret '%s'", azureKeyVaultSecret.Name)
-			if err = h.updateAzureKeyVaultSecretStatus(azureKeyVaultSecret, getMD5Hash(secretValues)); err != nil {
+			if err = h.updateAzureKeyVaultSecretStatus(azureKeyVaultSecret, h.getSecretHash(secretValues), objectVersion, certificateStatus, objectStatuses); err != nil {
 				return nil, err
 			}
 
@@ -266,20 +421,75 @@ func hasAzureKeyVaultSecretChanged(vaultSecret *akv.AzureKeyVaultSecret, secret
 			return true
 		}
 	}
+
+	for _, entry := range vaultSecret.Spec.Vault.Objects {
+		if entry.DataKey == "" {
+			continue
+		}
+		if _, ok := secret.Data[entry.DataKey]; !ok {
+			return true
+		}
+	}
 	return false
 }
 
-func (h *Handler) updateAzureKeyVaultSecretStatus(azureKeyVaultSecret *akv.AzureKeyVaultSecret, secretHash string) error {
+// updateAzureKeyVaultSecretStatus records a successful sync with Azure Key Vault in the
+// status. The version of the object is kept as it is when objectVersion is nil.
+func (h *Handler) updateAzureKeyVaultSecretStatus(azureKeyVaultSecret *akv.AzureKeyVaultSecret, secretHash string, objectVersion *vault.ObjectVersion, certificateStatus *akv.AzureKeyVaultCertificateStatus, objectStatuses []akv.AzureKeyVaultObjectStatus) error {
 	secretName := determineSecretName(azureKeyVaultSecret)
 
+	return h.updateStatus(azureKeyVaultSecret, func(status *akv.AzureKeyVaultSecretStatus, now metav1.Time) {
+		status.SecretHash = secretHash
+		status.LastAzureUpdate = now
+		status.SecretName = secretName
+		status.LastError = ""
+		status.SyncedGeneration = azureKeyVaultSecret.Generation
+		if objectVersion != nil {
+			status.ObjectVersion = objectVersion.Version
+			status.ObjectUpdated = objectUpdatedTime(objectVersion)
+		}
+		h.updateCertificateStatuses(azureKeyVaultSecret, status, certificateStatus, objectStatuses, now.Time)
+		status.Objects = objectStatuses
+		setCondition(status, akv.AzureKeyVaultSecretAzureReachable, corev1.ConditionTrue, ReasonAzureReachable, fmt.Sprintf("Got '%s' from Azure Key Vault '%s'", objectNames(azureKeyVaultSecret), azureKeyVaultSecret.Spec.Vault.Name), now)
+		setCondition(status, akv.AzureKeyVaultSecretSynced, corev1.ConditionTrue, SuccessSynced, MessageResourceSyncedWithAzure, now)
+	})
+}
+
+// updateStatusFailed records a failed sync in the status, setting the condition of
+// conditionType to false. The status of each object is replaced when objectStatuses
+// is set. Failing to update the status is only logged, so the original error is the
+// one handled.
+func (h *Handler) updateStatusFailed(azureKeyVaultSecret *akv.AzureKeyVaultSecret, conditionType akv.AzureKeyVaultSecretConditionType, reason string, syncErr error, objectStatuses []akv.AzureKeyVaultObjectStatus) {
+	err := h.updateStatus(azureKeyVaultSecret, func(status *akv.AzureKeyVaultSecretStatus, now metav1.Time) {
+		status.LastError = syncErr.Error()
+		if objectStatuses != nil {
+			h.updateCertificateStatuses(azureKeyVaultSecret, status, nil, objectStatuses, now.Time)
+			status.Objects = objectStatuses
+		}
+		setCondition(status, conditionType, corev1.ConditionFalse, reason, syncErr.Error(), now)
+	})
+	if err != nil {
+		log.Warningf("Failed to update status for AzureKeyVaultSecret %s/%s, error: %+v", azureKeyVaultSecret.Namespace, azureKeyVaultSecret.Name, err)
+	}
+}
+
+// updateStatus applies update to a copy of the status of the AzureKeyVaultSecret, and
+// updates the status in Kubernetes if it changed
+func (h *Handler) updateStatus(azureKeyVaultSecret *akv.AzureKeyVaultSecret, update func(status *akv.AzureKeyVaultSecretStatus, now metav1.Time)) error {
 	// NEVER modify objects from the store. It's a read-only, local cache.
 	// You can use DeepCopy() to make a deep copy of original object and modify this copy
 	// Or create a copy manually for better performance
-
 	azureKeyVaultSecretCopy := azureKeyVaultSecret.DeepCopy()
-	azureKeyVaultSecretCopy.Status.SecretHash = secretHash
-	azureKeyVaultSecretCopy.Status.LastAzureUpdate = h.clock.Now()
-	azureKeyVaultSecretCopy.Status.SecretName = secretName
+
+	now := h.clock.Now()
+	update(&azureKeyVaultSecretCopy.Status, now)
+	azureKeyVaultSecretCopy.Status.ObservedGeneration = azureKeyVaultSecret.Generation
+	setReadyCondition(&azureKeyVaultSecretCopy.Status, now)
+
+	// Avoid updates (and the events they trigger) when nothing changed
+	if equality.Semantic.DeepEqual(azureKeyVaultSecret.Status, azureKeyVaultSecretCopy.Status) {
+		return nil
+	}
 
 	// If the CustomResourceSubresources feature gate is not enabled,
 	// we must use Update instead of UpdateStatus to update the Status block of the AzureKeyVaultSecret resource.
@@ -382,26 +592,3 @@ func determineSecretType(azureKeyVaultSecret *akv.AzureKeyVaultSecret) corev1.Se
 
 	return azureKeyVaultSecret.Spec.Output.Secret.Type
 }
-
-func getMD5Hash(values map[string][]byte) string {
-	var mergedValues bytes.Buffer
-
-	keys := sortValueKeys(values)
-
-	for _, k := range keys {
-		mergedValues.WriteString(k + string(values[k]))
-	}
-
-	hasher := md5.New()
-	hasher.Write([]byte(mergedValues.String()))
-	return hex.EncodeToString(hasher.Sum(nil))
-}
-
-func sortValueKeys(values map[string][]byte) []string {
-	var keys []string
-	for k := range values {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	return keys
-}
@@ -0,0 +1,84 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/policy"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v1alpha1"
+)
+
+func TestSyncRefusesVaultNotAllowed(t *testing.T) {
+	azureKeyVaultSecret := secret()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(azureKeyVaultSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	vaultNamespaces, err := policy.ParseVaultNamespaces(azureKeyVaultSecret.Spec.Vault.Name + "=some-other-namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Created through the client, as the fake clientset guesses another resource for objects it is given
+	clientset := fake.NewSimpleClientset()
+	if _, err := clientset.AzurekeyvaultV1alpha1().AzureKeyVaultSecrets(azureKeyVaultSecret.Namespace).Create(azureKeyVaultSecret); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(10)
+
+	// The vault service is not set, so reading the vault fails the test
+	handler := &Handler{
+		azureKeyvaultClientset:     clientset,
+		azureKeyVaultSecretsLister: listers.NewAzureKeyVaultSecretLister(indexer),
+		recorder:                   recorder,
+		clock:                      &Clock{},
+		vaultNamespaces:            vaultNamespaces,
+	}
+
+	key := azureKeyVaultSecret.Namespace + "/" + azureKeyVaultSecret.Name
+	if err := handler.azureSyncHandler(key); err == nil {
+		t.Error("expected error syncing AzureKeyVaultSecret using a vault its namespace is not allowed to use")
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, ErrVaultNotAllowed) {
+			t.Errorf("expected %s event, but got '%s'", ErrVaultNotAllowed, event)
+		}
+	default:
+		t.Errorf("expected %s event", ErrVaultNotAllowed)
+	}
+
+	updated, err := clientset.AzurekeyvaultV1alpha1().AzureKeyVaultSecrets(azureKeyVaultSecret.Namespace).Get(azureKeyVaultSecret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition := getCondition(&updated.Status, akv.AzureKeyVaultSecretAzureReachable)
+	if condition == nil || condition.Status != corev1.ConditionFalse || condition.Reason != ErrVaultNotAllowed {
+		t.Errorf("expected AzureReachable condition to be false with reason %s, but got %+v", ErrVaultNotAllowed, condition)
+	}
+}
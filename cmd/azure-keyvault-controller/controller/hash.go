@@ -0,0 +1,91 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// secretHashPrefix marks secret hashes made with getSecretHash, telling them apart from
+// the unprefixed MD5 hashes of earlier versions
+const secretHashPrefix = "hmac-sha256:"
+
+// getSecretHash returns a HMAC-SHA256 of the values of a Secret, keyed by the secret hash
+// key of the controller, so the hash in the status can not be used to guess values. Each
+// key and value is prefixed by its length, so different values never hash the same.
+func (h *Handler) getSecretHash(values map[string][]byte) string {
+	mac := hmac.New(sha256.New, h.secretHashKey)
+
+	var length [8]byte
+	write := func(b []byte) {
+		binary.BigEndian.PutUint64(length[:], uint64(len(b)))
+		mac.Write(length[:])
+		mac.Write(b)
+	}
+
+	for _, k := range sortValueKeys(values) {
+		write([]byte(k))
+		write(values[k])
+	}
+	return secretHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// secretHashMatches returns true if hash is the hash of values. Unprefixed MD5 hashes from
+// earlier versions are still compared, so upgrading does not update every Secret. Such
+// hashes are replaced by the next status update.
+func (h *Handler) secretHashMatches(hash string, values map[string][]byte) bool {
+	if hash == "" {
+		return false
+	}
+	if !strings.HasPrefix(hash, secretHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(getLegacyMD5Hash(values))) == 1
+	}
+	return hmac.Equal([]byte(hash), []byte(h.getSecretHash(values)))
+}
+
+// getLegacyMD5Hash returns the MD5 hash of the values of a Secret, as stored in the status
+// by earlier versions of the controller. Only used to compare existing hashes.
+func getLegacyMD5Hash(values map[string][]byte) string {
+	var mergedValues bytes.Buffer
+
+	keys := sortValueKeys(values)
+
+	for _, k := range keys {
+		mergedValues.WriteString(k + string(values[k]))
+	}
+
+	hasher := md5.New()
+	hasher.Write([]byte(mergedValues.String()))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func sortValueKeys(values map[string][]byte) []string {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,68 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetSecretHashIsUnambiguous(t *testing.T) {
+	handler := &Handler{secretHashKey: []byte("some-key")}
+
+	first := handler.getSecretHash(map[string][]byte{"ab": []byte("c")})
+	second := handler.getSecretHash(map[string][]byte{"a": []byte("bc")})
+	if first == second {
+		t.Error("expected different keys and values to hash differently")
+	}
+	if !strings.HasPrefix(first, secretHashPrefix) {
+		t.Errorf("expected hash to start with '%s' but got '%s'", secretHashPrefix, first)
+	}
+}
+
+func TestGetSecretHashIsKeyed(t *testing.T) {
+	values := map[string][]byte{"some-key": []byte("some value")}
+
+	first := (&Handler{secretHashKey: []byte("first-key")}).getSecretHash(values)
+	second := (&Handler{secretHashKey: []byte("second-key")}).getSecretHash(values)
+	if first == second {
+		t.Error("expected hashes with different keys to differ")
+	}
+}
+
+func TestSecretHashMatches(t *testing.T) {
+	handler := &Handler{secretHashKey: []byte("some-key")}
+	values := map[string][]byte{"some-key": []byte("some value")}
+
+	if !handler.secretHashMatches(handler.getSecretHash(values), values) {
+		t.Error("expected hash of values to match")
+	}
+	if handler.secretHashMatches(handler.getSecretHash(values), map[string][]byte{"some-key": []byte("other value")}) {
+		t.Error("expected hash of other values not to match")
+	}
+	if handler.secretHashMatches("", values) {
+		t.Error("expected empty hash not to match")
+	}
+
+	// Hashes stored by earlier versions are still recognized
+	if !handler.secretHashMatches(getLegacyMD5Hash(values), values) {
+		t.Error("expected legacy MD5 hash of values to match")
+	}
+	if handler.secretHashMatches(getLegacyMD5Hash(values), map[string][]byte{"some-key": []byte("other value")}) {
+		t.Error("expected legacy MD5 hash of other values not to match")
+	}
+}
@@ -0,0 +1,437 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+const (
+	metricsNamespace = "akv2k8s"
+	metricsSubsystem = "controller"
+
+	// workqueueName is the name of the queue syncing AzureKeyVaultSecrets with Kubernetes Secrets
+	workqueueName = "AzureKeyVaultSecrets"
+
+	// workqueueAzureName is the name of the queue syncing AzureKeyVaultSecrets with Azure Key Vault
+	workqueueAzureName = "AzureKeyVault"
+
+	metricsResultSuccess   = "success"
+	metricsResultError     = "error"
+	metricsResultThrottled = "throttled"
+	metricsResultMatched   = "matched"
+	metricsResultUnmatched = "unmatched"
+
+	// metricsObjectTypeSecretList is the object type label of requests listing secrets
+	metricsObjectTypeSecretList akv.AzureKeyVaultObjectType = "secret-list"
+)
+
+var (
+	workqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "workqueue_depth",
+		Help:      "Current number of items waiting in a workqueue.",
+	}, []string{"name"})
+
+	workqueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "workqueue_adds_total",
+		Help:      "Total number of items added to a workqueue.",
+	}, []string{"name"})
+
+	workqueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "workqueue_queue_duration_seconds",
+		Help:      "How long in seconds an item stays in a workqueue before being processed.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"name"})
+
+	workqueueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "workqueue_work_duration_seconds",
+		Help:      "How long in seconds processing an item from a workqueue takes.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"name"})
+
+	workqueueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "workqueue_unfinished_work_seconds",
+		Help:      "How many seconds of work in progress in a workqueue has not been observed by workqueue_work_duration_seconds.",
+	}, []string{"name"})
+
+	workqueueLongestRunningProcessor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "workqueue_longest_running_processor_seconds",
+		Help:      "How many seconds the longest running item in a workqueue has been processed.",
+	}, []string{"name"})
+
+	workqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "workqueue_retries_total",
+		Help:      "Total number of items requeued in a workqueue after failing.",
+	}, []string{"name"})
+
+	vaultRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "vault_requests_total",
+		Help:      "Total number of requests to Azure Key Vault.",
+	}, []string{"vault", "object_type", "result"})
+
+	vaultRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "vault_request_duration_seconds",
+		Help:      "How long in seconds requests to Azure Key Vault take.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"vault", "object_type", "result"})
+
+	syncTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "sync_total",
+		Help:      "Total number of syncs of AzureKeyVaultSecrets, by workqueue and result.",
+	}, []string{"namespace", "name", "queue", "result"})
+
+	eventGridEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "event_grid_events_total",
+		Help:      "Total number of Azure Key Vault events received from Event Grid, by whether any AzureKeyVaultSecret uses the object.",
+	}, []string{"event_type", "result"})
+
+	azureSyncAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "azure_sync_age_seconds"),
+		"Time in seconds since the AzureKeyVaultSecret was last synced successfully with Azure Key Vault.",
+		[]string{"namespace", "name"}, nil)
+
+	certificateExpiryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "certificate_expiry_timestamp_seconds"),
+		"Time in seconds since epoch when each certificate synced by the AzureKeyVaultSecret expires.",
+		[]string{"namespace", "name", "vault", "object"}, nil)
+
+	controllerState = newStateCollector()
+)
+
+func init() {
+	prometheus.MustRegister(
+		workqueueDepth,
+		workqueueAdds,
+		workqueueLatency,
+		workqueueWorkDuration,
+		workqueueUnfinishedWork,
+		workqueueLongestRunningProcessor,
+		workqueueRetries,
+		vaultRequests,
+		vaultRequestDuration,
+		syncTotal,
+		eventGridEvents,
+		controllerState,
+	)
+
+	workqueue.SetProvider(workqueueMetricsProvider{})
+}
+
+// stateCollector reports metrics computed at scrape time, like the time since
+// AzureKeyVaultSecrets were last synced with Azure
+type stateCollector struct {
+	mu                  sync.Mutex
+	lastAzureSyncs      map[string]time.Time
+	certificateExpiries map[string][]certificateExpiry
+	now                 func() time.Time
+}
+
+// certificateExpiry is when a certificate synced by a AzureKeyVaultSecret expires
+type certificateExpiry struct {
+	vault    string
+	object   string
+	notAfter time.Time
+}
+
+func newStateCollector() *stateCollector {
+	return &stateCollector{
+		lastAzureSyncs:      make(map[string]time.Time),
+		certificateExpiries: make(map[string][]certificateExpiry),
+		now:                 time.Now,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (s *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- azureSyncAgeDesc
+	ch <- certificateExpiryDesc
+}
+
+// Collect implements prometheus.Collector
+func (s *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for key, lastSync := range s.lastAzureSyncs {
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(azureSyncAgeDesc, prometheus.GaugeValue, now.Sub(lastSync).Seconds(), namespace, name)
+	}
+
+	for key, expiries := range s.certificateExpiries {
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			continue
+		}
+		for _, expiry := range expiries {
+			ch <- prometheus.MustNewConstMetric(certificateExpiryDesc, prometheus.GaugeValue, float64(expiry.notAfter.Unix()), namespace, name, expiry.vault, expiry.object)
+		}
+	}
+}
+
+func (s *stateCollector) setLastAzureSync(key string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAzureSyncs[key] = t
+}
+
+func (s *stateCollector) setCertificateExpiries(key string, expiries []certificateExpiry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(expiries) == 0 {
+		delete(s.certificateExpiries, key)
+		return
+	}
+	s.certificateExpiries[key] = expiries
+}
+
+func (s *stateCollector) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lastAzureSyncs, key)
+	delete(s.certificateExpiries, key)
+}
+
+// workqueueMetricsProvider reports metrics for named workqueues
+type workqueueMetricsProvider struct{}
+
+func (workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return microsecondsObserver{workqueueLatency.WithLabelValues(name)}
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return microsecondsObserver{workqueueWorkDuration.WithLabelValues(name)}
+}
+
+func (workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLongestRunningProcessorMicrosecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return microsecondsGauge{workqueueLongestRunningProcessor.WithLabelValues(name)}
+}
+
+// NewRetriesMetric is not used, as the workqueue counts every delayed add as a retry,
+// including scheduled polls of Azure Key Vault. Failed syncs are counted by recordSync.
+func (workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return noopCounter{}
+}
+
+// microsecondsObserver observes durations reported by workqueues in microseconds as seconds
+type microsecondsObserver struct {
+	observer prometheus.Observer
+}
+
+func (o microsecondsObserver) Observe(microseconds float64) {
+	o.observer.Observe(microseconds / float64(time.Second/time.Microsecond))
+}
+
+// microsecondsGauge sets durations reported by workqueues in microseconds as seconds
+type microsecondsGauge struct {
+	gauge prometheus.Gauge
+}
+
+func (g microsecondsGauge) Set(microseconds float64) {
+	g.gauge.Set(microseconds / float64(time.Second/time.Microsecond))
+}
+
+type noopCounter struct{}
+
+func (noopCounter) Inc() {}
+
+// recordSync records the result of syncing the AzureKeyVaultSecret with key in the named workqueue
+func recordSync(queueName string, key string, err error) {
+	result := metricsResultSuccess
+	if err != nil {
+		result = metricsResultError
+		workqueueRetries.WithLabelValues(queueName).Inc()
+	}
+
+	namespace, name, splitErr := cache.SplitMetaNamespaceKey(key)
+	if splitErr != nil {
+		return
+	}
+	syncTotal.WithLabelValues(namespace, name, queueName, result).Inc()
+}
+
+// recordEventGridEvent records an event from Event Grid, and whether any AzureKeyVaultSecrets
+// were enqueued for it
+func recordEventGridEvent(eventType string, enqueued int) {
+	result := metricsResultMatched
+	if enqueued == 0 {
+		result = metricsResultUnmatched
+	}
+	eventGridEvents.WithLabelValues(eventType, result).Inc()
+}
+
+// recordAzureSync records that the AzureKeyVaultSecret was successfully synced with Azure Key Vault
+func recordAzureSync(azureKeyVaultSecret *akv.AzureKeyVaultSecret, t time.Time) {
+	key, err := cache.MetaNamespaceKeyFunc(azureKeyVaultSecret)
+	if err != nil {
+		return
+	}
+	controllerState.setLastAzureSync(key, t)
+}
+
+// recordCertificateExpiry records when the certificates synced by the AzureKeyVaultSecret
+// expire, replacing the certificates previously recorded
+func recordCertificateExpiry(azureKeyVaultSecret *akv.AzureKeyVaultSecret, certificateStatus *akv.AzureKeyVaultCertificateStatus, objectStatuses []akv.AzureKeyVaultObjectStatus) {
+	key, err := cache.MetaNamespaceKeyFunc(azureKeyVaultSecret)
+	if err != nil {
+		return
+	}
+
+	var expiries []certificateExpiry
+	if certificateStatus != nil {
+		expiries = append(expiries, certificateExpiry{
+			vault:    azureKeyVaultSecret.Spec.Vault.Name,
+			object:   azureKeyVaultSecret.Spec.Vault.Object.Name,
+			notAfter: certificateStatus.NotAfter.Time,
+		})
+	}
+	for _, objectStatus := range objectStatuses {
+		if objectStatus.Certificate != nil {
+			expiries = append(expiries, certificateExpiry{
+				vault:    azureKeyVaultSecret.Spec.Vault.Name,
+				object:   objectStatus.Name,
+				notAfter: objectStatus.Certificate.NotAfter.Time,
+			})
+		}
+	}
+	controllerState.setCertificateExpiries(key, expiries)
+}
+
+// forgetSyncMetrics removes metrics for a deleted AzureKeyVaultSecret
+func forgetSyncMetrics(key string) {
+	controllerState.forget(key)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return
+	}
+	for _, queueName := range []string{workqueueName, workqueueAzureName} {
+		for _, result := range []string{metricsResultSuccess, metricsResultError} {
+			syncTotal.DeleteLabelValues(namespace, name, queueName, result)
+		}
+	}
+}
+
+// instrumentedVaultService records metrics for requests to Azure Key Vault
+type instrumentedVaultService struct {
+	vaultService vault.Service
+}
+
+// newInstrumentedVaultService wraps a vault Service, recording metrics for every request
+func newInstrumentedVaultService(vaultService vault.Service) vault.Service {
+	return &instrumentedVaultService{
+		vaultService: vaultService,
+	}
+}
+
+func (s *instrumentedVaultService) GetSecret(vaultSpec *akv.AzureKeyVault) (string, error) {
+	start := time.Now()
+	secret, err := s.vaultService.GetSecret(vaultSpec)
+	recordVaultRequest(vaultSpec, akv.AzureKeyVaultObjectTypeSecret, start, err)
+	return secret, err
+}
+
+func (s *instrumentedVaultService) GetSecretWithVersion(vaultSpec *akv.AzureKeyVault) (string, *vault.ObjectVersion, error) {
+	start := time.Now()
+	secret, version, err := s.vaultService.GetSecretWithVersion(vaultSpec)
+	recordVaultRequest(vaultSpec, akv.AzureKeyVaultObjectTypeSecret, start, err)
+	return secret, version, err
+}
+
+func (s *instrumentedVaultService) GetKey(vaultSpec *akv.AzureKeyVault) (*vault.Key, error) {
+	start := time.Now()
+	key, err := s.vaultService.GetKey(vaultSpec)
+	recordVaultRequest(vaultSpec, akv.AzureKeyVaultObjectTypeKey, start, err)
+	return key, err
+}
+
+func (s *instrumentedVaultService) GetCertificate(vaultSpec *akv.AzureKeyVault, exportPrivateKey bool) (*vault.Certificate, error) {
+	start := time.Now()
+	cert, err := s.vaultService.GetCertificate(vaultSpec, exportPrivateKey)
+	recordVaultRequest(vaultSpec, akv.AzureKeyVaultObjectTypeCertificate, start, err)
+	return cert, err
+}
+
+func (s *instrumentedVaultService) GetObjectVersion(vaultSpec *akv.AzureKeyVault) (*vault.ObjectVersion, error) {
+	start := time.Now()
+	version, err := s.vaultService.GetObjectVersion(vaultSpec)
+	recordVaultRequest(vaultSpec, vaultSpec.Object.Type, start, err)
+	return version, err
+}
+
+func (s *instrumentedVaultService) ListSecrets(vaultSpec *akv.AzureKeyVault) ([]vault.SecretItem, error) {
+	start := time.Now()
+	items, err := s.vaultService.ListSecrets(vaultSpec)
+	recordVaultRequest(vaultSpec, metricsObjectTypeSecretList, start, err)
+	return items, err
+}
+
+func recordVaultRequest(vaultSpec *akv.AzureKeyVault, objectType akv.AzureKeyVaultObjectType, start time.Time, err error) {
+	result := metricsResultSuccess
+	if _, throttled := vault.IsThrottled(err); throttled {
+		result = metricsResultThrottled
+	} else if err != nil {
+		result = metricsResultError
+	}
+	vaultRequests.WithLabelValues(vaultSpec.Name, string(objectType), result).Inc()
+	vaultRequestDuration.WithLabelValues(vaultSpec.Name, string(objectType), result).Observe(time.Since(start).Seconds())
+}
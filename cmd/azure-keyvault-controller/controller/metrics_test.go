@@ -0,0 +1,106 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func TestInstrumentedVaultService(t *testing.T) {
+	akvs := secret()
+	service := newInstrumentedVaultService(&fakeVaultService{fakeSecretValue: "some value"})
+
+	if _, err := service.GetSecret(&akvs.Spec.Vault); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := testutil.ToFloat64(vaultRequests.WithLabelValues(akvs.Spec.Vault.Name, "secret", metricsResultSuccess))
+	if requests != 1 {
+		t.Errorf("expected 1 successful request to vault but got %v", requests)
+	}
+}
+
+func TestRecordSync(t *testing.T) {
+	recordSync(workqueueAzureName, "default/metrics-test", nil)
+	recordSync(workqueueAzureName, "default/metrics-test", fmt.Errorf("some error"))
+
+	if count := testutil.ToFloat64(syncTotal.WithLabelValues("default", "metrics-test", workqueueAzureName, metricsResultSuccess)); count != 1 {
+		t.Errorf("expected 1 successful sync but got %v", count)
+	}
+	if count := testutil.ToFloat64(syncTotal.WithLabelValues("default", "metrics-test", workqueueAzureName, metricsResultError)); count != 1 {
+		t.Errorf("expected 1 failed sync but got %v", count)
+	}
+
+	forgetSyncMetrics("default/metrics-test")
+	if count := testutil.ToFloat64(syncTotal.WithLabelValues("default", "metrics-test", workqueueAzureName, metricsResultSuccess)); count != 0 {
+		t.Errorf("expected sync metrics to be removed but got %v", count)
+	}
+}
+
+func TestWorkqueueMetrics(t *testing.T) {
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test-queue")
+	defer queue.ShutDown()
+
+	queue.Add("some-key")
+	queue.Add("some-key")
+	if depth := testutil.ToFloat64(workqueueDepth.WithLabelValues("test-queue")); depth != 1 {
+		t.Errorf("expected depth 1 but got %v", depth)
+	}
+
+	item, _ := queue.Get()
+	queue.Done(item)
+	if depth := testutil.ToFloat64(workqueueDepth.WithLabelValues("test-queue")); depth != 0 {
+		t.Errorf("expected depth 0 after processing but got %v", depth)
+	}
+	if adds := testutil.ToFloat64(workqueueAdds.WithLabelValues("test-queue")); adds != 1 {
+		t.Errorf("expected 1 add but got %v", adds)
+	}
+}
+
+func TestMicrosecondsGauge(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_seconds"})
+	microsecondsGauge{gauge}.Set(1500000)
+	if seconds := testutil.ToFloat64(gauge); seconds != 1.5 {
+		t.Errorf("expected 1.5 seconds but got %v", seconds)
+	}
+}
+
+func TestRecordCertificateExpiry(t *testing.T) {
+	akvs := secret()
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	recordCertificateExpiry(akvs, &akv.AzureKeyVaultCertificateStatus{NotAfter: metav1.NewTime(notAfter)}, nil)
+
+	key := akvs.Namespace + "/" + akvs.Name
+	expiries := controllerState.certificateExpiries[key]
+	if len(expiries) != 1 || expiries[0].object != akvs.Spec.Vault.Object.Name || !expiries[0].notAfter.Equal(notAfter) {
+		t.Errorf("unexpected certificate expiries %+v", expiries)
+	}
+
+	forgetSyncMetrics(key)
+	if _, ok := controllerState.certificateExpiries[key]; ok {
+		t.Error("expected certificate expiries to be removed")
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+// hasMultipleObjects returns true if the AzureKeyVaultSecret syncs multiple objects
+// into the same Secret, using spec.vault.objects or spec.vault.selector instead of
+// spec.vault.object
+func hasMultipleObjects(azureKeyVaultSecret *akv.AzureKeyVaultSecret) bool {
+	return len(azureKeyVaultSecret.Spec.Vault.Objects) > 0 || azureKeyVaultSecret.Spec.Vault.Selector != nil
+}
+
+// vaultObjects returns all Azure Key Vault objects synced by the AzureKeyVaultSecret. When
+// using a selector, the objects are not known until listing the vault, so a single unnamed
+// object with the poll settings of the selector is returned.
+func vaultObjects(azureKeyVaultSecret *akv.AzureKeyVaultSecret) []akv.AzureKeyVaultObject {
+	if selector := azureKeyVaultSecret.Spec.Vault.Selector; selector != nil {
+		return []akv.AzureKeyVaultObject{{
+			Type:         akv.AzureKeyVaultObjectTypeSecret,
+			PollInterval: selector.PollInterval,
+		}}
+	}
+
+	if !hasMultipleObjects(azureKeyVaultSecret) {
+		return []akv.AzureKeyVaultObject{azureKeyVaultSecret.Spec.Vault.Object}
+	}
+
+	objects := make([]akv.AzureKeyVaultObject, 0, len(azureKeyVaultSecret.Spec.Vault.Objects))
+	for _, entry := range azureKeyVaultSecret.Spec.Vault.Objects {
+		objects = append(objects, entry.AzureKeyVaultObject)
+	}
+	return objects
+}
+
+// objectNames returns the names of all Azure Key Vault objects synced by the
+// AzureKeyVaultSecret, for use in logs and messages
+func objectNames(azureKeyVaultSecret *akv.AzureKeyVaultSecret) string {
+	if azureKeyVaultSecret.Spec.Vault.Selector != nil {
+		return "secrets matching selector"
+	}
+
+	var names []string
+	for _, object := range vaultObjects(azureKeyVaultSecret) {
+		names = append(names, object.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// newObjectEntrySecret returns a copy of the AzureKeyVaultSecret syncing only the given
+// entry, so the entry can be handled like any single object AzureKeyVaultSecret
+func newObjectEntrySecret(azureKeyVaultSecret *akv.AzureKeyVaultSecret, entry akv.AzureKeyVaultObjectEntry) *akv.AzureKeyVaultSecret {
+	entrySecret := azureKeyVaultSecret.DeepCopy()
+	entrySecret.Spec.Vault.Object = *entry.AzureKeyVaultObject.DeepCopy()
+	entrySecret.Spec.Vault.Objects = nil
+	entrySecret.Spec.Vault.Selector = nil
+	entrySecret.Spec.Output.Secret.DataKey = entry.DataKey
+	entrySecret.Spec.Output.Transforms = entry.Transforms
+	return entrySecret
+}
+
+// getSecretsFromKeyVault gets all objects of the AzureKeyVaultSecret from Azure Key Vault,
+// merging them into the values of one Secret. When spec.vault.objects or spec.vault.selector
+// is used, the status of each object is also returned, and otherwise the version of the object
+// and the status of the certificate when the object is a certificate. If any object fails, an
+// error listing the failing objects is returned, leaving the Secret as it is.
+func (h *Handler) getSecretsFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret) (map[string][]byte, *akv.AzureKeyVaultCertificateStatus, *vault.ObjectVersion, []akv.AzureKeyVaultObjectStatus, error) {
+	if !hasMultipleObjects(azureKeyVaultSecret) {
+		values, certificateStatus, version, err := h.getSecretFromKeyVault(azureKeyVaultSecret)
+		return values, certificateStatus, version, nil, err
+	}
+
+	entries := azureKeyVaultSecret.Spec.Vault.Objects
+	if azureKeyVaultSecret.Spec.Vault.Selector != nil {
+		if len(entries) > 0 {
+			return nil, nil, nil, nil, fmt.Errorf("spec.vault.objects and spec.vault.selector cannot be used together")
+		}
+
+		var err error
+		if entries, err = h.selectObjectEntries(azureKeyVaultSecret); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	values, statuses, err := h.getObjectEntriesFromKeyVault(azureKeyVaultSecret, entries)
+	return values, nil, nil, statuses, err
+}
+
+// getObjectEntriesFromKeyVault gets each of the entries from Azure Key Vault, merging them
+// into the values of one Secret
+func (h *Handler) getObjectEntriesFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret, entries []akv.AzureKeyVaultObjectEntry) (map[string][]byte, []akv.AzureKeyVaultObjectStatus, error) {
+	values := make(map[string][]byte)
+	valueOwners := make(map[string]string)
+	statuses := make([]akv.AzureKeyVaultObjectStatus, 0, len(entries))
+	var failed []string
+	var throttled *vault.ThrottledError
+
+	for _, entry := range entries {
+		status := akv.AzureKeyVaultObjectStatus{
+			Name:    entry.Name,
+			Type:    entry.Type,
+			DataKey: entry.DataKey,
+		}
+
+		entrySecret := newObjectEntrySecret(azureKeyVaultSecret, entry)
+		entryValues, certificateStatus, version, err := h.getSecretFromKeyVault(entrySecret)
+		if err == nil {
+			for k := range entryValues {
+				if owner, exists := valueOwners[k]; exists {
+					err = fmt.Errorf("key '%s' is already set by object '%s'", k, owner)
+					break
+				}
+			}
+		}
+
+		if err != nil {
+			log.Warningf("Failed to get object '%s' from Azure Key Vault '%s' for AzureKeyVaultSecret %s/%s, error: %+v", entry.Name, azureKeyVaultSecret.Spec.Vault.Name, azureKeyVaultSecret.Namespace, azureKeyVaultSecret.Name, err)
+			status.Error = err.Error()
+			failed = append(failed, entry.Name)
+			if entryThrottled, ok := vault.IsThrottled(err); ok && (throttled == nil || entryThrottled.RetryAfter > throttled.RetryAfter) {
+				throttled = entryThrottled
+			}
+			statuses = append(statuses, status)
+			continue
+		}
+
+		for k, v := range entryValues {
+			values[k] = v
+			valueOwners[k] = entry.Name
+		}
+		if version != nil {
+			status.Version = version.Version
+			status.Updated = objectUpdatedTime(version)
+		}
+		status.Certificate = certificateStatus
+		statuses = append(statuses, status)
+	}
+
+	// All objects are in the same vault, so retry when the vault is no longer throttled
+	if throttled != nil {
+		return nil, statuses, throttled
+	}
+	if len(failed) > 0 {
+		return nil, statuses, fmt.Errorf("failed to get %d of %d objects from Azure Key Vault: %s", len(failed), len(statuses), strings.Join(failed, ", "))
+	}
+	return values, statuses, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func multiObjectSecret(entries ...akv.AzureKeyVaultObjectEntry) *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+	akvs.Spec.Vault.Objects = entries
+	return akvs
+}
+
+func objectEntry(name, dataKey string, transforms ...string) akv.AzureKeyVaultObjectEntry {
+	return akv.AzureKeyVaultObjectEntry{
+		AzureKeyVaultObject: akv.AzureKeyVaultObject{Name: name, Type: akv.AzureKeyVaultObjectTypeSecret},
+		DataKey:             dataKey,
+		Transforms:          transforms,
+	}
+}
+
+func TestGetSecretsFromKeyVaultWithMultipleObjects(t *testing.T) {
+	handler := &Handler{vaultService: &fakeVaultService{fakeSecretValue: " some value "}}
+	akvs := multiObjectSecret(
+		objectEntry("first-secret", "FIRST"),
+		objectEntry("second-secret", "SECOND", "trim"),
+	)
+
+	values, _, _, statuses, err := handler.getSecretsFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Errorf("expected 2 values but got %d", len(values))
+	}
+	if string(values["FIRST"]) != " some value " {
+		t.Errorf("expected untransformed value for FIRST but got '%s'", values["FIRST"])
+	}
+	if string(values["SECOND"]) != "some value" {
+		t.Errorf("expected trimmed value for SECOND but got '%s'", values["SECOND"])
+	}
+	if len(statuses) != 2 || statuses[0].Version != "some-version" || statuses[0].Error != "" {
+		t.Errorf("expected a successful status with version for each object but got %+v", statuses)
+	}
+}
+
+func TestGetSecretsFromKeyVaultReportsFailingObjects(t *testing.T) {
+	handler := &Handler{vaultService: &fakeVaultService{fakeSecretValue: "some value"}}
+	akvs := multiObjectSecret(
+		objectEntry("first-secret", "SAME"),
+		objectEntry("second-secret", "SAME"),
+		objectEntry("third-secret", ""),
+	)
+
+	values, _, _, statuses, err := handler.getSecretsFromKeyVault(akvs)
+	if err == nil {
+		t.Fatal("expected error when objects fail")
+	}
+	if values != nil {
+		t.Error("expected no values when objects fail")
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("expected a status for each object but got %d", len(statuses))
+	}
+	if statuses[0].Error != "" {
+		t.Errorf("expected first object to succeed but got '%s'", statuses[0].Error)
+	}
+	if statuses[1].Error == "" {
+		t.Error("expected second object to fail with duplicate data key")
+	}
+	if statuses[2].Error == "" {
+		t.Error("expected third object to fail without data key")
+	}
+}
+
+func TestPollMultipleObjects(t *testing.T) {
+	disabled := false
+	fixed := objectEntry("fixed-secret", "FIXED")
+	fixed.Version = "some-version"
+	slow := objectEntry("slow-secret", "SLOW")
+	slow.PollInterval = &metav1.Duration{Duration: time.Hour}
+	fast := objectEntry("fast-secret", "FAST")
+	fast.PollInterval = &metav1.Duration{Duration: time.Minute}
+	fast.Poll = &disabled
+
+	if shouldPollAzure(multiObjectSecret(fixed, fast)) {
+		t.Error("should not poll when no object is polled")
+	}
+
+	akvs := multiObjectSecret(fixed, slow, fast)
+	if !shouldPollAzure(akvs) {
+		t.Error("should poll when any object is polled")
+	}
+	if interval := azurePollInterval(akvs); interval != time.Hour {
+		t.Errorf("expected poll interval of polled objects only but got %s", interval)
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+const (
+	// RolloutAnnotation opts in to automatic rollout of Deployments, StatefulSets and DaemonSets
+	// using the Secret of a AzureKeyVaultSecret, when the secret changes in Azure Key Vault and
+	// the controller is started with --rollout-workloads.
+	// Set it on the AzureKeyVaultSecret to roll out all workloads using the Secret, or on a
+	// workload to opt in or out for that workload only. The value is the RolloutStrategy.
+	RolloutAnnotation = "spv.no/rollout"
+
+	// RestartedAtAnnotation is set on the pod template of workloads to trigger a rollout
+	RestartedAtAnnotation = "spv.no/restartedAt"
+
+	// SuccessRollout is used as part of the Event 'reason' when a rollout of a workload is triggered
+	SuccessRollout = "RolloutTriggered"
+
+	// ErrRollout is used as part of the Event 'reason' when a rollout of a workload fails
+	ErrRollout = "ErrRollout"
+
+	// MessageRolloutTriggered is the message used for Events when a rollout of a workload is triggered
+	MessageRolloutTriggered = "Secret '%s' changed in Azure Key Vault - rolling out %s '%s' using strategy '%s'"
+
+	// MessageRolloutFailed is the message used for Events when a rollout of a workload fails
+	MessageRolloutFailed = "Secret '%s' changed in Azure Key Vault - failed to roll out %s '%s': %s"
+)
+
+// RolloutStrategy controls how workloads are rolled out when their Secret changes
+type RolloutStrategy string
+
+const (
+	// RolloutStrategyNone does not roll out the workload
+	RolloutStrategyNone RolloutStrategy = "none"
+
+	// RolloutStrategyRolling patches the pod template, letting the workload roll out
+	// according to its own update strategy
+	RolloutStrategyRolling RolloutStrategy = "rolling"
+
+	// RolloutStrategyForce patches the pod template like RolloutStrategyRolling, and in
+	// addition deletes the pods of StatefulSets and DaemonSets using the OnDelete update strategy
+	RolloutStrategyForce RolloutStrategy = "force"
+)
+
+// rolloutWorkload is a Deployment, StatefulSet or DaemonSet that can be rolled out
+type rolloutWorkload struct {
+	kind     string
+	object   metav1.Object
+	runtime  runtime.Object
+	podSpec  *corev1.PodSpec
+	selector *metav1.LabelSelector
+	onDelete bool
+	patch    func(data []byte) error
+}
+
+// parseRolloutStrategy parses the value of the RolloutAnnotation, returning an empty
+// strategy if not set
+func parseRolloutStrategy(value string) (RolloutStrategy, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return "", nil
+	case "true", string(RolloutStrategyRolling):
+		return RolloutStrategyRolling, nil
+	case "false", string(RolloutStrategyNone):
+		return RolloutStrategyNone, nil
+	case string(RolloutStrategyForce):
+		return RolloutStrategyForce, nil
+	default:
+		return "", fmt.Errorf("rollout strategy '%s' not supported", value)
+	}
+}
+
+// rolloutEnabled returns true if the controller rolls out workloads, which requires the
+// listers of workloads
+func (h *Handler) rolloutEnabled() bool {
+	return h.deploymentsLister != nil && h.statefulSetsLister != nil && h.daemonSetsLister != nil
+}
+
+// rolloutWorkloads triggers a rollout of all Deployments, StatefulSets and DaemonSets in the
+// namespace of the AzureKeyVaultSecret using secretName, that have opted in to rollout. It
+// returns the number of workloads rolled out.
+func (h *Handler) rolloutWorkloads(azureKeyVaultSecret *akv.AzureKeyVaultSecret, secretName string) int {
+	defaultStrategy, err := parseRolloutStrategy(azureKeyVaultSecret.Annotations[RolloutAnnotation])
+	if err != nil {
+		log.Warningf("Invalid annotation '%s' on AzureKeyVaultSecret %s/%s, error: %+v", RolloutAnnotation, azureKeyVaultSecret.Namespace, azureKeyVaultSecret.Name, err)
+		h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, ErrRollout, err.Error())
+	}
+
+	workloads, err := h.getWorkloads(azureKeyVaultSecret.Namespace)
+	if err != nil {
+		log.Errorf("Failed to get workloads using Secret %s/%s for rollout, error: %+v", azureKeyVaultSecret.Namespace, secretName, err)
+		return 0
+	}
+
+	patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"%s":"%s"}}}}}`, RestartedAtAnnotation, h.clock.Now().Format(time.RFC3339)))
+	rolledOut := 0
+
+	for _, workload := range workloads {
+		if !podSpecUsesSecret(workload.podSpec, secretName) {
+			continue
+		}
+
+		strategy := defaultStrategy
+		workloadStrategy, err := parseRolloutStrategy(workload.object.GetAnnotations()[RolloutAnnotation])
+		if err != nil {
+			log.Warningf("Invalid annotation '%s' on %s %s/%s, error: %+v", RolloutAnnotation, workload.kind, workload.object.GetNamespace(), workload.object.GetName(), err)
+			h.recorder.Event(workload.runtime, corev1.EventTypeWarning, ErrRollout, err.Error())
+		} else if workloadStrategy != "" {
+			strategy = workloadStrategy
+		}
+
+		if strategy == "" || strategy == RolloutStrategyNone {
+			continue
+		}
+
+		log.Infof("Secret %s/%s changed, rolling out %s '%s' using strategy '%s'", azureKeyVaultSecret.Namespace, secretName, workload.kind, workload.object.GetName(), strategy)
+		if err = h.rolloutWorkload(workload, strategy, patch); err != nil {
+			msg := fmt.Sprintf(MessageRolloutFailed, secretName, workload.kind, workload.object.GetName(), err.Error())
+			log.Error(msg)
+			h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, ErrRollout, msg)
+			h.recorder.Event(workload.runtime, corev1.EventTypeWarning, ErrRollout, msg)
+			continue
+		}
+
+		msg := fmt.Sprintf(MessageRolloutTriggered, secretName, workload.kind, workload.object.GetName(), strategy)
+		h.recorder.Event(azureKeyVaultSecret, corev1.EventTypeNormal, SuccessRollout, msg)
+		h.recorder.Event(workload.runtime, corev1.EventTypeNormal, SuccessRollout, msg)
+		rolledOut++
+	}
+
+	return rolledOut
+}
+
+func (h *Handler) rolloutWorkload(workload rolloutWorkload, strategy RolloutStrategy, patch []byte) error {
+	if err := workload.patch(patch); err != nil {
+		return err
+	}
+
+	if strategy != RolloutStrategyForce || !workload.onDelete {
+		return nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(workload.selector)
+	if err != nil {
+		return err
+	}
+
+	pods, err := h.kubeclientset.CoreV1().Pods(workload.object.GetNamespace()).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods.Items {
+		if !metav1.IsControlledBy(&pod, workload.object) {
+			continue
+		}
+		if err = h.kubeclientset.CoreV1().Pods(pod.Namespace).Delete(pod.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getWorkloads returns the Deployments, StatefulSets and DaemonSets in the namespace from
+// the informer caches, so finding workloads to roll out does not list them in the API server
+func (h *Handler) getWorkloads(namespace string) ([]rolloutWorkload, error) {
+	var workloads []rolloutWorkload
+	apps := h.kubeclientset.AppsV1()
+
+	deployments, err := h.deploymentsLister.Deployments(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments {
+		name := deployment.Name
+		workloads = append(workloads, rolloutWorkload{
+			kind:     "Deployment",
+			object:   deployment,
+			runtime:  deployment,
+			podSpec:  &deployment.Spec.Template.Spec,
+			selector: deployment.Spec.Selector,
+			patch: func(data []byte) error {
+				_, err := apps.Deployments(namespace).Patch(name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+
+	statefulSets, err := h.statefulSetsLister.StatefulSets(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, statefulSet := range statefulSets {
+		name := statefulSet.Name
+		workloads = append(workloads, rolloutWorkload{
+			kind:     "StatefulSet",
+			object:   statefulSet,
+			runtime:  statefulSet,
+			podSpec:  &statefulSet.Spec.Template.Spec,
+			selector: statefulSet.Spec.Selector,
+			onDelete: statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType,
+			patch: func(data []byte) error {
+				_, err := apps.StatefulSets(namespace).Patch(name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+
+	daemonSets, err := h.daemonSetsLister.DaemonSets(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, daemonSet := range daemonSets {
+		name := daemonSet.Name
+		workloads = append(workloads, rolloutWorkload{
+			kind:     "DaemonSet",
+			object:   daemonSet,
+			runtime:  daemonSet,
+			podSpec:  &daemonSet.Spec.Template.Spec,
+			selector: daemonSet.Spec.Selector,
+			onDelete: daemonSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType,
+			patch: func(data []byte) error {
+				_, err := apps.DaemonSets(namespace).Patch(name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+
+	return workloads, nil
+}
+
+// podSpecUsesSecret returns true if the pod spec references secretName through
+// volumes, envFrom or secretKeyRef
+func podSpecUsesSecret(podSpec *corev1.PodSpec, secretName string) bool {
+	for _, volume := range podSpec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == secretName {
+			return true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...)
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
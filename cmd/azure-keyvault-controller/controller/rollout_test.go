@@ -0,0 +1,181 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func deployment(name string, annotations map[string]string, podSpec corev1.PodSpec) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   metav1.NamespaceDefault,
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: podSpec,
+			},
+		},
+	}
+}
+
+func podSpecWithEnvFrom(secretName string) corev1.PodSpec {
+	return corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "app",
+				EnvFrom: []corev1.EnvFromSource{
+					{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secretName}}},
+				},
+			},
+		},
+	}
+}
+
+func TestPodSpecUsesSecret(t *testing.T) {
+	volume := corev1.PodSpec{
+		Volumes: []corev1.Volume{
+			{Name: "secret", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "my-secret"}}},
+		},
+	}
+	keyRef := corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{
+				Name: "init",
+				Env: []corev1.EnvVar{
+					{Name: "VALUE", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "my-secret"}, Key: "value"}}},
+				},
+			},
+		},
+	}
+
+	for name, podSpec := range map[string]corev1.PodSpec{"volume": volume, "secretKeyRef": keyRef, "envFrom": podSpecWithEnvFrom("my-secret")} {
+		if !podSpecUsesSecret(&podSpec, "my-secret") {
+			t.Errorf("pod spec using secret through %s should be detected", name)
+		}
+		if podSpecUsesSecret(&podSpec, "other-secret") {
+			t.Errorf("pod spec using secret through %s should not match other secret", name)
+		}
+	}
+}
+
+func TestParseRolloutStrategy(t *testing.T) {
+	tests := map[string]RolloutStrategy{
+		"":        "",
+		"true":    RolloutStrategyRolling,
+		"rolling": RolloutStrategyRolling,
+		"false":   RolloutStrategyNone,
+		"force":   RolloutStrategyForce,
+	}
+	for value, expected := range tests {
+		strategy, err := parseRolloutStrategy(value)
+		if err != nil {
+			t.Error(err)
+		}
+		if strategy != expected {
+			t.Errorf("expected strategy '%s' for '%s' but got '%s'", expected, value, strategy)
+		}
+	}
+
+	if _, err := parseRolloutStrategy("unknown"); err == nil {
+		t.Error("should fail for unknown strategy")
+	}
+}
+
+func newIndexer(objects ...interface{}) cache.Indexer {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, object := range objects {
+		_ = indexer.Add(object)
+	}
+	return indexer
+}
+
+func TestRolloutWorkloads(t *testing.T) {
+	deployments := []*appsv1.Deployment{
+		deployment("opted-in", map[string]string{RolloutAnnotation: "true"}, podSpecWithEnvFrom("my-secret")),
+		deployment("opted-out", map[string]string{RolloutAnnotation: "false"}, podSpecWithEnvFrom("my-secret")),
+		deployment("not-opted-in", nil, podSpecWithEnvFrom("my-secret")),
+		deployment("other-secret", map[string]string{RolloutAnnotation: "true"}, podSpecWithEnvFrom("other-secret")),
+	}
+
+	var objects []runtime.Object
+	var cached []interface{}
+	for _, deployment := range deployments {
+		objects = append(objects, deployment)
+		cached = append(cached, deployment)
+	}
+	kubeClient := fake.NewSimpleClientset(objects...)
+
+	handler := &Handler{
+		kubeclientset:      kubeClient,
+		deploymentsLister:  appslisters.NewDeploymentLister(newIndexer(cached...)),
+		statefulSetsLister: appslisters.NewStatefulSetLister(newIndexer()),
+		daemonSetsLister:   appslisters.NewDaemonSetLister(newIndexer()),
+		recorder:           record.NewFakeRecorder(10),
+		clock:              &Clock{},
+	}
+
+	if rolledOut := handler.rolloutWorkloads(secret(), "my-secret"); rolledOut != 1 {
+		t.Errorf("expected 1 workload rolled out when opted in on workload, but got %d", rolledOut)
+	}
+
+	akvs := secret()
+	akvs.Annotations = map[string]string{RolloutAnnotation: "rolling"}
+	if rolledOut := handler.rolloutWorkloads(akvs, "my-secret"); rolledOut != 2 {
+		t.Errorf("expected 2 workloads rolled out when opted in on AzureKeyVaultSecret, but got %d", rolledOut)
+	}
+
+	patches := 0
+	for _, action := range kubeClient.Actions() {
+		switch action.GetVerb() {
+		case "patch":
+			patches++
+		case "list":
+			t.Errorf("expected workloads to be listed from the informer caches, but got %s", action)
+		}
+	}
+	if patches != 3 {
+		t.Errorf("expected 3 patches but got %d", patches)
+	}
+}
+
+func TestRolloutEnabled(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+
+	handler := NewHandler(kubeClient, nil, nil, nil, nil, record.NewFakeRecorder(10), &fakeVaultService{}, AzurePollFrequency{}, nil, 0, nil, nil)
+	if handler.rolloutEnabled() || len(handler.workloadsSynced) != 0 {
+		t.Error("expected rollout to be disabled and workloads not watched without workload informers")
+	}
+
+	informerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, 0)
+	handler = NewHandler(kubeClient, nil, nil, nil, informerFactory.Apps().V1(), record.NewFakeRecorder(10), &fakeVaultService{}, AzurePollFrequency{}, nil, 0, nil, nil)
+	if !handler.rolloutEnabled() || len(handler.workloadsSynced) != 3 {
+		t.Error("expected rollout to be enabled and workloads watched with workload informers")
+	}
+}
@@ -29,9 +29,15 @@ import (
 	corev1 "k8s.io/api/core/v1"
 )
 
+// caCertKey is the key of the certificate chain in Secrets of type kubernetes.io/tls,
+// when output.secret.splitChain is set
+const caCertKey = "ca.crt"
+
 // KubernetesSecretHandler handles getting and formatting secrets from Azure Key Vault to Kubernetes
 type KubernetesSecretHandler interface {
 	Handle() (map[string][]byte, error)
+	// Version returns the version of the object last handled, if known
+	Version() *vault.ObjectVersion
 }
 
 // AzureSecretHandler handles getting and formatting Azure Key Vault Secret from Azure Key Vault to Kubernetes
@@ -39,24 +45,30 @@ type AzureSecretHandler struct {
 	secretSpec    *akv.AzureKeyVaultSecret
 	vaultService  vault.Service
 	transformator transformers.Transformator
+	version       *vault.ObjectVersion
 }
 
 // AzureCertificateHandler handles getting and formatting Azure Key Vault Certificate from Azure Key Vault to Kubernetes
 type AzureCertificateHandler struct {
 	secretSpec   *akv.AzureKeyVaultSecret
 	vaultService vault.Service
+
+	// certificate is the certificate last handled
+	certificate *vault.Certificate
 }
 
 // AzureKeyHandler handles getting and formatting Azure Key Vault Key from Azure Key Vault to Kubernetes
 type AzureKeyHandler struct {
 	secretSpec   *akv.AzureKeyVaultSecret
 	vaultService vault.Service
+	version      *vault.ObjectVersion
 }
 
 // AzureMultiValueSecretHandler handles getting and formatting Azure Key Vault Secret containing multiple values from Azure Key Vault to Kubernetes
 type AzureMultiValueSecretHandler struct {
 	secretSpec   *akv.AzureKeyVaultSecret
 	vaultService vault.Service
+	version      *vault.ObjectVersion
 }
 
 // NewAzureSecretHandler return a new AzureSecretHandler
@@ -100,10 +112,11 @@ func (h *AzureSecretHandler) Handle() (map[string][]byte, error) {
 
 	values := make(map[string][]byte)
 
-	secret, err := h.vaultService.GetSecret(&h.secretSpec.Spec.Vault)
+	secret, version, err := h.vaultService.GetSecretWithVersion(&h.secretSpec.Spec.Vault)
 	if err != nil {
 		return nil, err
 	}
+	h.version = version
 
 	secret, err = h.transformator.Transform(secret)
 	if err != nil {
@@ -139,13 +152,45 @@ func (h *AzureSecretHandler) Handle() (map[string][]byte, error) {
 	return values, nil
 }
 
+// Version returns the version of the secret last handled
+func (h *AzureSecretHandler) Version() *vault.ObjectVersion {
+	return h.version
+}
+
+// Version returns the version of the certificate last handled
+func (h *AzureCertificateHandler) Version() *vault.ObjectVersion {
+	if h.certificate == nil {
+		return nil
+	}
+	return h.certificate.Version
+}
+
+// Version returns the version of the key last handled
+func (h *AzureKeyHandler) Version() *vault.ObjectVersion {
+	return h.version
+}
+
+// Version returns the version of the secret last handled
+func (h *AzureMultiValueSecretHandler) Version() *vault.ObjectVersion {
+	return h.version
+}
+
 // Handle getting and formating Azure Key Vault Certificate from Azure Key Vault to Kubernetes
 func (h *AzureCertificateHandler) Handle() (map[string][]byte, error) {
 	values := make(map[string][]byte)
 	var err error
+	outputSecret := h.secretSpec.Spec.Output.Secret
+
+	exportPrivateKey := outputSecret.Type == corev1.SecretTypeTLS
+	switch outputSecret.Format {
+	case "":
+		exportPrivateKey = exportPrivateKey || outputSecret.Type == corev1.SecretTypeOpaque
+	case akv.AzureKeyVaultOutputFormatJksTrustStore:
+	default:
+		exportPrivateKey = true
+	}
 
-	exportPrivateKey := h.secretSpec.Spec.Output.Secret.Type == corev1.SecretTypeTLS || h.secretSpec.Spec.Output.Secret.Type == corev1.SecretTypeOpaque
-	if !exportPrivateKey && h.secretSpec.Spec.Output.Secret.DataKey == "" {
+	if (outputSecret.Format != "" || !exportPrivateKey) && outputSecret.DataKey == "" {
 		return nil, fmt.Errorf("no datakey spesified for output secret")
 	}
 
@@ -156,20 +201,47 @@ func (h *AzureCertificateHandler) Handle() (map[string][]byte, error) {
 		return nil, err
 	}
 
-	if h.secretSpec.Spec.Output.Secret.Type == corev1.SecretTypeOpaque {
-		values[h.secretSpec.Spec.Output.Secret.DataKey] = cert.ExportRaw()
-	} else if exportPrivateKey {
-		if values[corev1.TLSCertKey], err = cert.ExportPublicKeyAsPem(); err != nil {
+	if exportPrivateKey {
+		if err = cert.VerifyKeyPair(); err != nil {
 			return nil, err
 		}
-		if values[corev1.TLSPrivateKeyKey], err = cert.ExportPrivateKeyAsPem(); err != nil {
+	}
+	if outputSecret.DropRoot {
+		cert.DropRoot()
+	}
+	h.certificate = cert
+
+	if outputSecret.Type == corev1.SecretTypeTLS {
+		if outputSecret.SplitChain {
+			if values[corev1.TLSCertKey], err = cert.ExportLeafAsPem(); err != nil {
+				return nil, err
+			}
+			if values[caCertKey], err = cert.ExportChainAsPem(); err != nil {
+				return nil, err
+			}
+		} else if values[corev1.TLSCertKey], err = cert.ExportPublicKeyAsPem(); err != nil {
 			return nil, err
 		}
-	} else {
-		values[h.secretSpec.Spec.Output.Secret.DataKey], err = cert.ExportPublicKeyAsPem()
+		if values[corev1.TLSPrivateKeyKey], err = cert.ExportPrivateKey(outputSecret.PrivateKeyFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case outputSecret.Format != "":
+		password, err := vault.GetCertificatePassword(h.vaultService, h.secretSpec, outputSecret.Format)
 		if err != nil {
 			return nil, err
 		}
+		if values[outputSecret.DataKey], err = cert.Export(outputSecret.Format, outputSecret.PrivateKeyFormat, h.secretSpec.Spec.Vault.Object.Name, password); err != nil {
+			return nil, err
+		}
+	case outputSecret.Type == corev1.SecretTypeOpaque:
+		values[outputSecret.DataKey] = cert.ExportRaw()
+	case outputSecret.Type != corev1.SecretTypeTLS:
+		if values[outputSecret.DataKey], err = cert.ExportPublicKeyAsPem(); err != nil {
+			return nil, err
+		}
 	}
 
 	return values, nil
@@ -177,13 +249,23 @@ func (h *AzureCertificateHandler) Handle() (map[string][]byte, error) {
 
 // Handle getting and formating Azure Key Vault Key from Azure Key Vault to Kubernetes
 func (h *AzureKeyHandler) Handle() (map[string][]byte, error) {
+	if h.secretSpec.Spec.Output.Secret.DataKey == "" {
+		return nil, fmt.Errorf("no datakey spesified for output secret")
+	}
+
 	key, err := h.vaultService.GetKey(&h.secretSpec.Spec.Vault)
 	if err != nil {
 		return nil, err
 	}
+	h.version = key.Version
+
+	exportedKey, err := key.Export(h.secretSpec.Spec.Output.Secret.Format)
+	if err != nil {
+		return nil, err
+	}
 
 	values := make(map[string][]byte)
-	values[h.secretSpec.Spec.Output.Secret.DataKey] = []byte(key)
+	values[h.secretSpec.Spec.Output.Secret.DataKey] = exportedKey
 	return values, nil
 }
 
@@ -195,10 +277,11 @@ func (h *AzureMultiValueSecretHandler) Handle() (map[string][]byte, error) {
 		return nil, fmt.Errorf("cannot use '%s' without also specifying content type", akv.AzureKeyVaultObjectTypeMultiKeyValueSecret)
 	}
 
-	secret, err := h.vaultService.GetSecret(&h.secretSpec.Spec.Vault)
+	secret, version, err := h.vaultService.GetSecretWithVersion(&h.secretSpec.Spec.Vault)
 	if err != nil {
 		return nil, err
 	}
+	h.version = version
 
 	var dat map[string]string
 
@@ -17,14 +17,24 @@ limitations under the License.
 package controller
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
@@ -35,24 +45,52 @@ var (
 type fakeVaultService struct {
 	fakeSecretValue string
 	fakeCertValue   string
+	fakeKeyValue    string
+	fakeSecretItems []vault.SecretItem
+	fakeSecretErr   error
 }
 
 func (f *fakeVaultService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
-	if f.fakeSecretValue != "" {
-		return f.fakeSecretValue, nil
+	value, _, err := f.GetSecretWithVersion(secret)
+	return value, err
+}
+func (f *fakeVaultService) GetSecretWithVersion(secret *akv.AzureKeyVault) (string, *vault.ObjectVersion, error) {
+	if f.fakeSecretErr != nil {
+		return "", nil, f.fakeSecretErr
 	}
-	return "", nil
+	return f.fakeSecretValue, &vault.ObjectVersion{Version: "some-version"}, nil
 }
-func (f *fakeVaultService) GetKey(secret *akv.AzureKeyVault) (string, error) {
-	return "", nil
+func (f *fakeVaultService) GetKey(secret *akv.AzureKeyVault) (*vault.Key, error) {
+	if f.fakeKeyValue != "" {
+		key, err := vault.NewKeyFromJwk([]byte(f.fakeKeyValue))
+		if err != nil {
+			return nil, err
+		}
+		key.Version = &vault.ObjectVersion{Version: "some-version"}
+		return key, nil
+	}
+	return nil, nil
 }
 func (f *fakeVaultService) GetCertificate(secret *akv.AzureKeyVault, exportPrivateKey bool) (*vault.Certificate, error) {
 	if f.fakeCertValue != "" {
-		return vault.NewCertificateFromPem(f.fakeCertValue)
+		cert, err := vault.NewCertificateFromPem(f.fakeCertValue)
+		if err != nil {
+			return nil, err
+		}
+		cert.Version = &vault.ObjectVersion{Version: "some-version"}
+		return cert, nil
 	}
 	return nil, nil
 }
 
+func (f *fakeVaultService) GetObjectVersion(secret *akv.AzureKeyVault) (*vault.ObjectVersion, error) {
+	return &vault.ObjectVersion{Version: "some-version"}, nil
+}
+
+func (f *fakeVaultService) ListSecrets(vaultSpec *akv.AzureKeyVault) ([]vault.SecretItem, error) {
+	return f.fakeSecretItems, nil
+}
+
 func secret() *akv.AzureKeyVaultSecret {
 	return &akv.AzureKeyVaultSecret{
 		TypeMeta: metav1.TypeMeta{APIVersion: akv.SchemeGroupVersion.String()},
@@ -247,6 +285,123 @@ func TestHandleCertificateWithRawOutput(t *testing.T) {
 	}
 }
 
+func TestHandleCertificateWithFormat(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeCertValue:   pemCert,
+		fakeSecretValue: "changeit",
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "certificate"
+	secret.Spec.Output.Secret.DataKey = "keystore"
+
+	for _, format := range []akv.AzureKeyVaultOutputFormat{akv.AzureKeyVaultOutputFormatPem, akv.AzureKeyVaultOutputFormatPkcs12, akv.AzureKeyVaultOutputFormatJks, akv.AzureKeyVaultOutputFormatJksTrustStore} {
+		secret.Spec.Output.Secret.Format = format
+		secret.Spec.Output.Secret.PasswordSecret = "keystore-password"
+
+		handler := NewAzureCertificateHandler(secret, fakeVault)
+		values, err := handler.Handle()
+		if err != nil {
+			t.Errorf("format '%s': %+v", format, err)
+		}
+		if len(values) != 1 || len(values["keystore"]) == 0 {
+			t.Errorf("format '%s': there should be only a value stored for key 'keystore'", format)
+		}
+
+		if format != akv.AzureKeyVaultOutputFormatPem {
+			secret.Spec.Output.Secret.PasswordSecret = ""
+			if _, err := NewAzureCertificateHandler(secret, fakeVault).Handle(); err == nil {
+				t.Errorf("format '%s': should fail when no passwordSecret is spesified", format)
+			}
+		}
+	}
+}
+
+func TestHandleCertificateWithTlsOutputAndSplitChain(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeCertValue: pemCert,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "certificate"
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeTLS
+	secret.Spec.Output.Secret.SplitChain = true
+
+	handler := NewAzureCertificateHandler(secret, fakeVault)
+	values, err := handler.Handle()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(values) != 3 {
+		t.Error("handler should have returned 3 key/values")
+	}
+	if values[corev1.TLSCertKey] == nil || values[corev1.TLSPrivateKeyKey] == nil {
+		t.Errorf("there should be values stored for keys '%s' and '%s'", corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+	}
+	if _, ok := values[caCertKey]; !ok {
+		t.Errorf("there should be a key '%s'", caCertKey)
+	}
+}
+
+func TestHandleCertificateWithMismatchedKey(t *testing.T) {
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mismatch"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &certKey.PublicKey, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyDer, err := x509.MarshalECPrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeVault := &fakeVaultService{
+		fakeCertValue: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: otherKeyDer})) +
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})),
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "certificate"
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeTLS
+
+	recorder := record.NewFakeRecorder(10)
+	handler := &Handler{
+		vaultService: fakeVault,
+		recorder:     recorder,
+		clock:        &Clock{},
+	}
+
+	values, _, _, err := handler.getSecretFromKeyVault(secret)
+	if err != vault.ErrKeyPairMismatch {
+		t.Errorf("expected ErrKeyPairMismatch, but got: %+v", err)
+	}
+	if values != nil {
+		t.Error("handler should not have returned values")
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, ErrCertificateKeyMismatch) {
+			t.Errorf("expected %s event, but got '%s'", ErrCertificateKeyMismatch, event)
+		}
+	default:
+		t.Errorf("expected %s event", ErrCertificateKeyMismatch)
+	}
+}
+
 func TestHandleSecretWithBasicAuthOutput(t *testing.T) {
 	fakeVault := &fakeVaultService{
 		fakeSecretValue: "myuser:mypassword",
@@ -354,3 +509,31 @@ func TestHandleSecretWithSSHAuthAsOutput(t *testing.T) {
 		t.Errorf("there should be a value stored for key '%s'", corev1.SSHAuthPrivateKey)
 	}
 }
+
+func TestHandleKeyWithFormat(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeKeyValue: `{"kty":"EC","crv":"P-256","x":"MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4","y":"4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM"}`,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.Secret.DataKey = "key"
+
+	for _, format := range []akv.AzureKeyVaultOutputFormat{akv.AzureKeyVaultOutputFormatJwk, akv.AzureKeyVaultOutputFormatPem, akv.AzureKeyVaultOutputFormatDer, akv.AzureKeyVaultOutputFormatOpenSSH} {
+		secret.Spec.Output.Secret.Format = format
+
+		handler := NewAzureKeyHandler(secret, fakeVault)
+		values, err := handler.Handle()
+		if err != nil {
+			t.Errorf("format '%s': %+v", format, err)
+		}
+		if len(values["key"]) == 0 {
+			t.Errorf("format '%s': there should be a value stored for key 'key'", format)
+		}
+	}
+
+	secret.Spec.Output.Secret.DataKey = ""
+	if _, err := NewAzureKeyHandler(secret, fakeVault).Handle(); err == nil {
+		t.Error("should fail when no datakey is spesified")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+// selectObjectEntries lists the secrets in Azure Key Vault, returning an entry for each
+// secret matching the selector of the AzureKeyVaultSecret. Since the vault is listed on
+// every poll, secrets added to or deleted from the vault are picked up.
+func (h *Handler) selectObjectEntries(azureKeyVaultSecret *akv.AzureKeyVaultSecret) ([]akv.AzureKeyVaultObjectEntry, error) {
+	selector := azureKeyVaultSecret.Spec.Vault.Selector
+
+	var nameRegex *regexp.Regexp
+	if selector.NameRegex != "" {
+		var err error
+		if nameRegex, err = regexp.Compile(selector.NameRegex); err != nil {
+			return nil, fmt.Errorf("invalid spec.vault.selector.nameRegex '%s', error: %+v", selector.NameRegex, err)
+		}
+	}
+
+	switch selector.KeyMapping.Case {
+	case "", akv.AzureKeyVaultKeyCaseUpper, akv.AzureKeyVaultKeyCaseLower:
+	default:
+		return nil, fmt.Errorf("invalid spec.vault.selector.keyMapping.case '%s', must be either '%s' or '%s'", selector.KeyMapping.Case, akv.AzureKeyVaultKeyCaseUpper, akv.AzureKeyVaultKeyCaseLower)
+	}
+
+	items, err := h.vaultService.ListSecrets(&azureKeyVaultSecret.Spec.Vault)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []akv.AzureKeyVaultObjectEntry
+	for _, item := range items {
+		if !selectorMatches(selector, nameRegex, item) {
+			continue
+		}
+
+		entries = append(entries, akv.AzureKeyVaultObjectEntry{
+			AzureKeyVaultObject: akv.AzureKeyVaultObject{
+				Name: item.Name,
+				Type: akv.AzureKeyVaultObjectTypeSecret,
+			},
+			DataKey:    mapSecretKey(selector, item.Name),
+			Transforms: azureKeyVaultSecret.Spec.Output.Transforms,
+		})
+	}
+
+	if len(entries) == 0 {
+		log.Warningf("No secrets in Azure Key Vault '%s' match the selector of AzureKeyVaultSecret %s/%s", azureKeyVaultSecret.Spec.Vault.Name, azureKeyVaultSecret.Namespace, azureKeyVaultSecret.Name)
+	}
+	return entries, nil
+}
+
+// selectorMatches returns true if the secret matches all criteria set in the selector
+func selectorMatches(selector *akv.AzureKeyVaultSecretSelector, nameRegex *regexp.Regexp, item vault.SecretItem) bool {
+	if !strings.HasPrefix(item.Name, selector.NamePrefix) {
+		return false
+	}
+	if nameRegex != nil && !nameRegex.MatchString(item.Name) {
+		return false
+	}
+	for k, v := range selector.Tags {
+		if value, ok := item.Tags[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mapSecretKey derives the key in the Secret from the name of a secret in Azure Key Vault
+func mapSecretKey(selector *akv.AzureKeyVaultSecretSelector, name string) string {
+	mapping := selector.KeyMapping
+
+	key := name
+	if mapping.TrimPrefix {
+		key = strings.TrimPrefix(key, selector.NamePrefix)
+	}
+	for _, replacement := range mapping.Replace {
+		key = strings.Replace(key, replacement.Old, replacement.New, -1)
+	}
+
+	switch mapping.Case {
+	case akv.AzureKeyVaultKeyCaseUpper:
+		key = strings.ToUpper(key)
+	case akv.AzureKeyVaultKeyCaseLower:
+		key = strings.ToLower(key)
+	}
+	return mapping.Prefix + key
+}
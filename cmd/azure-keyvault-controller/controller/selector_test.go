@@ -0,0 +1,84 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func TestMapSecretKey(t *testing.T) {
+	selector := &akv.AzureKeyVaultSecretSelector{
+		NamePrefix: "my-app-",
+		KeyMapping: akv.AzureKeyVaultKeyMapping{
+			TrimPrefix: true,
+			Replace:    []akv.AzureKeyVaultKeyReplacement{{Old: "-", New: "_"}},
+			Case:       akv.AzureKeyVaultKeyCaseUpper,
+			Prefix:     "APP_",
+		},
+	}
+
+	if key := mapSecretKey(selector, "my-app-db-password"); key != "APP_DB_PASSWORD" {
+		t.Errorf("expected key 'APP_DB_PASSWORD' but got '%s'", key)
+	}
+
+	if key := mapSecretKey(&akv.AzureKeyVaultSecretSelector{}, "my-app-db-password"); key != "my-app-db-password" {
+		t.Errorf("expected name to be used as key without mapping but got '%s'", key)
+	}
+}
+
+func TestSelectObjectEntries(t *testing.T) {
+	handler := &Handler{vaultService: &fakeVaultService{
+		fakeSecretValue: "some value",
+		fakeSecretItems: []vault.SecretItem{
+			{Name: "my-app-db-password", Tags: map[string]string{"env": "prod"}},
+			{Name: "my-app-api-key", Tags: map[string]string{"env": "test"}},
+			{Name: "my-app-old", Tags: map[string]string{"env": "prod"}},
+			{Name: "other-app-db-password", Tags: map[string]string{"env": "prod"}},
+		},
+	}}
+
+	akvs := secret()
+	akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+	akvs.Spec.Vault.Selector = &akv.AzureKeyVaultSecretSelector{
+		NamePrefix: "my-app-",
+		NameRegex:  "-(password|key)$",
+		Tags:       map[string]string{"env": "prod"},
+		KeyMapping: akv.AzureKeyVaultKeyMapping{TrimPrefix: true},
+	}
+
+	values, _, _, statuses, err := handler.getSecretsFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || len(statuses) != 1 {
+		t.Fatalf("expected 1 matching secret but got %d values and %d statuses", len(values), len(statuses))
+	}
+	if string(values["db-password"]) != "some value" {
+		t.Errorf("expected value for key 'db-password' but got %v", values)
+	}
+	if statuses[0].Name != "my-app-db-password" {
+		t.Errorf("expected status for 'my-app-db-password' but got '%s'", statuses[0].Name)
+	}
+
+	akvs.Spec.Vault.Selector.NameRegex = "("
+	if _, _, _, _, err = handler.getSecretsFromKeyVault(akvs); err == nil {
+		t.Error("should fail with invalid regex")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+// getObjectVersion returns the version of the object in Azure Key Vault, or nil if it
+// could not be resolved. When syncing multiple objects, the version of each object is
+// in the status of the object instead.
+func (h *Handler) getObjectVersion(azureKeyVaultSecret *akv.AzureKeyVaultSecret) *vault.ObjectVersion {
+	if hasMultipleObjects(azureKeyVaultSecret) {
+		return nil
+	}
+
+	version, err := h.vaultService.GetObjectVersion(&azureKeyVaultSecret.Spec.Vault)
+	if err != nil {
+		log.Warningf("Failed to get version of '%s' in Azure Key Vault '%s', error: %+v", azureKeyVaultSecret.Spec.Vault.Object.Name, azureKeyVaultSecret.Spec.Vault.Name, err)
+		return nil
+	}
+	return version
+}
+
+// azureObjectsUnchanged returns true if the Secret was synced with the current spec of the
+// AzureKeyVaultSecret, and the versions of all its objects in Azure Key Vault are the ones
+// recorded in the status when synced. Only the versions are read from Azure Key Vault, so
+// values are not fetched again unless they changed.
+func (h *Handler) azureObjectsUnchanged(azureKeyVaultSecret *akv.AzureKeyVaultSecret) bool {
+	status := azureKeyVaultSecret.Status
+	if status.SecretHash == "" || status.LastError != "" || status.SyncedGeneration != azureKeyVaultSecret.Generation {
+		return false
+	}
+
+	if !hasMultipleObjects(azureKeyVaultSecret) {
+		version := h.getObjectVersion(azureKeyVaultSecret)
+		return version != nil && versionUnchanged(version, status.ObjectVersion, status.ObjectUpdated)
+	}
+
+	entries := azureKeyVaultSecret.Spec.Vault.Objects
+	if azureKeyVaultSecret.Spec.Vault.Selector != nil {
+		var err error
+		if entries, err = h.selectObjectEntries(azureKeyVaultSecret); err != nil {
+			return false
+		}
+	}
+	if len(entries) != len(status.Objects) {
+		return false
+	}
+
+	for _, entry := range entries {
+		objectStatus := findObjectStatus(status.Objects, entry.Name, entry.Type)
+		if objectStatus == nil || objectStatus.Error != "" || objectStatus.DataKey != entry.DataKey {
+			return false
+		}
+
+		entrySecret := newObjectEntrySecret(azureKeyVaultSecret, entry)
+		version := h.getObjectVersion(entrySecret)
+		if version == nil || !versionUnchanged(version, objectStatus.Version, objectStatus.Updated) {
+			return false
+		}
+	}
+	return true
+}
+
+// versionUnchanged returns true if version is the synced version, and was not updated since.
+// The updated time is only compared when known on both sides.
+func versionUnchanged(version *vault.ObjectVersion, syncedVersion string, syncedUpdated *metav1.Time) bool {
+	if version.Version == "" || version.Version != syncedVersion {
+		return false
+	}
+	if version.Updated.IsZero() || syncedUpdated == nil {
+		return true
+	}
+	return version.Updated.Truncate(time.Second).Equal(syncedUpdated.Time)
+}
+
+// objectUpdatedTime returns the time an object version was updated for the status, or
+// nil if not known
+func objectUpdatedTime(version *vault.ObjectVersion) *metav1.Time {
+	if version == nil || version.Updated.IsZero() {
+		return nil
+	}
+	updated := metav1.NewTime(version.Updated.Truncate(time.Second))
+	return &updated
+}
+
+// syncedObjectStatuses returns copies of the certificate and object statuses last synced,
+// used to update the status when the objects are unchanged in Azure Key Vault
+func syncedObjectStatuses(azureKeyVaultSecret *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultCertificateStatus, []akv.AzureKeyVaultObjectStatus) {
+	var objectStatuses []akv.AzureKeyVaultObjectStatus
+	if azureKeyVaultSecret.Status.Objects != nil {
+		objectStatuses = make([]akv.AzureKeyVaultObjectStatus, len(azureKeyVaultSecret.Status.Objects))
+		for i := range azureKeyVaultSecret.Status.Objects {
+			azureKeyVaultSecret.Status.Objects[i].DeepCopyInto(&objectStatuses[i])
+		}
+	}
+	return azureKeyVaultSecret.Status.Certificate.DeepCopy(), objectStatuses
+}
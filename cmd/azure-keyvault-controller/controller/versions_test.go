@@ -0,0 +1,105 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func syncedSecret() *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Generation = 2
+	akvs.Status.SecretHash = "some-hash"
+	akvs.Status.SyncedGeneration = 2
+	akvs.Status.ObjectVersion = "some-version"
+	return akvs
+}
+
+func TestAzureObjectsUnchanged(t *testing.T) {
+	handler := &Handler{vaultService: &fakeVaultService{}}
+
+	if !handler.azureObjectsUnchanged(syncedSecret()) {
+		t.Error("expected object with the synced version to be unchanged")
+	}
+
+	akvs := syncedSecret()
+	akvs.Status.ObjectVersion = "other-version"
+	if handler.azureObjectsUnchanged(akvs) {
+		t.Error("expected object with a new version to be changed")
+	}
+
+	akvs = syncedSecret()
+	akvs.Generation = 3
+	if handler.azureObjectsUnchanged(akvs) {
+		t.Error("expected changed spec to fetch objects again")
+	}
+
+	akvs = syncedSecret()
+	akvs.Status.SecretHash = ""
+	if handler.azureObjectsUnchanged(akvs) {
+		t.Error("expected objects never synced to be fetched")
+	}
+}
+
+func TestAzureObjectsUnchangedWithMultipleObjects(t *testing.T) {
+	handler := &Handler{vaultService: &fakeVaultService{}}
+
+	akvs := multiObjectSecret(objectEntry("first-secret", "FIRST"), objectEntry("second-secret", "SECOND"))
+	akvs.Generation = 1
+	akvs.Status.SecretHash = "some-hash"
+	akvs.Status.SyncedGeneration = 1
+	akvs.Status.Objects = []akv.AzureKeyVaultObjectStatus{
+		{Name: "first-secret", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "FIRST", Version: "some-version"},
+		{Name: "second-secret", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "SECOND", Version: "some-version"},
+	}
+	if !handler.azureObjectsUnchanged(akvs) {
+		t.Error("expected objects with the synced versions to be unchanged")
+	}
+
+	akvs.Status.Objects[1].Version = "old-version"
+	if handler.azureObjectsUnchanged(akvs) {
+		t.Error("expected objects to be changed when one of them has a new version")
+	}
+
+	akvs.Status.Objects = akvs.Status.Objects[:1]
+	if handler.azureObjectsUnchanged(akvs) {
+		t.Error("expected objects to be changed when an object is added")
+	}
+}
+
+func TestVersionUnchanged(t *testing.T) {
+	updated := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	synced := metav1.NewTime(updated)
+
+	if !versionUnchanged(&vault.ObjectVersion{Version: "abc", Updated: updated}, "abc", &synced) {
+		t.Error("expected same version and updated time to be unchanged")
+	}
+	if versionUnchanged(&vault.ObjectVersion{Version: "abc", Updated: updated.Add(time.Minute)}, "abc", &synced) {
+		t.Error("expected updated version to be changed")
+	}
+	if !versionUnchanged(&vault.ObjectVersion{Version: "abc"}, "abc", nil) {
+		t.Error("expected same version without updated time to be unchanged")
+	}
+	if versionUnchanged(&vault.ObjectVersion{}, "", nil) {
+		t.Error("expected unknown version to be changed")
+	}
+}
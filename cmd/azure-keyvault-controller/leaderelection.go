@@ -0,0 +1,131 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// leaderElectionConfig controls Lease based leader election between controller replicas
+type leaderElectionConfig struct {
+	enabled       bool
+	leaseName     string
+	namespace     string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// runWithLeaderElection calls run only while holding the Lease, blocking until stopCh
+// is closed. The process exits when leadership is lost, letting a standby replica
+// with warm informer caches take over.
+func runWithLeaderElection(config leaderElectionConfig, kubeClient kubernetes.Interface, recorder record.EventRecorder, stopCh <-chan struct{}, run func(stopCh <-chan struct{})) {
+	if !config.enabled {
+		run(stopCh)
+		return
+	}
+
+	identity := config.identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Error getting hostname to use as leader election identity: %s", err.Error())
+		}
+		identity = hostname
+	}
+
+	namespace := config.namespace
+	if namespace == "" {
+		namespace = currentNamespace()
+	}
+
+	lock := &leaseLock{
+		leaseMeta: metav1.ObjectMeta{
+			Name:      config.leaseName,
+			Namespace: namespace,
+		},
+		client: kubeClient.CoordinationV1beta1(),
+		lockConfig: resourcelock.ResourceLockConfig{
+			Identity:      identity,
+			EventRecorder: recorder,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	log.Infof("Starting leader election for Lease %s/%s as '%s'", namespace, config.leaseName, identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: config.leaseDuration,
+		RenewDeadline: config.renewDeadline,
+		RetryPeriod:   config.retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("Started leading as '%s'", identity)
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+					log.Infof("Stopped leading as '%s'", identity)
+				default:
+					log.Fatalf("Lost leadership as '%s', exiting", identity)
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("Standing by, current leader is '%s'", leader)
+				}
+			},
+		},
+	})
+}
+
+// currentNamespace returns the namespace the controller is running in, defaulting to
+// the default namespace when running outside of Kubernetes
+func currentNamespace() string {
+	if namespace, ok := os.LookupEnv("POD_NAMESPACE"); ok && namespace != "" {
+		return namespace
+	}
+
+	if data, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return metav1.NamespaceDefault
+}
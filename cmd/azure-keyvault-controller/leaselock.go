@@ -0,0 +1,124 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaseLock is a leader election lock stored in a Lease. The client-go version used only
+// has locks stored in ConfigMaps and Endpoints, which are watched by many clients and
+// updated on every renewal, so this implements resourcelock.Interface for Leases.
+type leaseLock struct {
+	leaseMeta  metav1.ObjectMeta
+	client     coordinationclient.LeasesGetter
+	lockConfig resourcelock.ResourceLockConfig
+	lease      *coordinationv1beta1.Lease
+}
+
+// Get returns the election record from the Lease
+func (l *leaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	var err error
+	l.lease, err = l.client.Leases(l.leaseMeta.Namespace).Get(l.leaseMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return leaseSpecToLeaderElectionRecord(&l.lease.Spec), nil
+}
+
+// Create attempts to create a Lease with the election record
+func (l *leaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	var err error
+	l.lease, err = l.client.Leases(l.leaseMeta.Namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.leaseMeta.Name,
+			Namespace: l.leaseMeta.Namespace,
+		},
+		Spec: leaderElectionRecordToLeaseSpec(&ler),
+	})
+	return err
+}
+
+// Update updates the election record of an existing Lease
+func (l *leaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+	l.lease.Spec = leaderElectionRecordToLeaseSpec(&ler)
+
+	var err error
+	l.lease, err = l.client.Leases(l.leaseMeta.Namespace).Update(l.lease)
+	return err
+}
+
+// RecordEvent records an event for the Lease
+func (l *leaseLock) RecordEvent(s string) {
+	if l.lockConfig.EventRecorder == nil || l.lease == nil {
+		return
+	}
+	events := fmt.Sprintf("%v %v", l.lockConfig.Identity, s)
+	l.lockConfig.EventRecorder.Eventf(&coordinationv1beta1.Lease{ObjectMeta: l.lease.ObjectMeta}, corev1.EventTypeNormal, "LeaderElection", events)
+}
+
+// Describe returns the namespace and name of the Lease
+func (l *leaseLock) Describe() string {
+	return fmt.Sprintf("%v/%v", l.leaseMeta.Namespace, l.leaseMeta.Name)
+}
+
+// Identity returns the identity of this replica
+func (l *leaseLock) Identity() string {
+	return l.lockConfig.Identity
+}
+
+func leaseSpecToLeaderElectionRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	record := &resourcelock.LeaderElectionRecord{}
+	if spec.HolderIdentity != nil {
+		record.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		record.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		record.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		record.AcquireTime = metav1.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		record.RenewTime = metav1.Time{Time: spec.RenewTime.Time}
+	}
+	return record
+}
+
+func leaderElectionRecordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	leaseDurationSeconds := int32(ler.LeaseDurationSeconds)
+	leaseTransitions := int32(ler.LeaderTransitions)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &ler.HolderIdentity,
+		LeaseDurationSeconds: &leaseDurationSeconds,
+		AcquireTime:          &metav1.MicroTime{Time: ler.AcquireTime.Time},
+		RenewTime:            &metav1.MicroTime{Time: ler.RenewTime.Time},
+		LeaseTransitions:     &leaseTransitions,
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestLeaseLock(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	lock := &leaseLock{
+		leaseMeta:  metav1.ObjectMeta{Name: "some-lease", Namespace: "some-namespace"},
+		client:     kubeClient.CoordinationV1beta1(),
+		lockConfig: resourcelock.ResourceLockConfig{Identity: "replica-1", EventRecorder: record.NewFakeRecorder(10)},
+	}
+
+	if _, err := lock.Get(); err == nil {
+		t.Fatal("expected error getting lease before it is created")
+	}
+
+	now := metav1.NewTime(time.Now().Truncate(time.Second))
+	record := resourcelock.LeaderElectionRecord{
+		HolderIdentity:       "replica-1",
+		LeaseDurationSeconds: 15,
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+	if err := lock.Create(record); err != nil {
+		t.Fatalf("failed to create lease, error: %+v", err)
+	}
+
+	record.HolderIdentity = "replica-2"
+	record.LeaderTransitions = 1
+	if err := lock.Update(record); err != nil {
+		t.Fatalf("failed to update lease, error: %+v", err)
+	}
+
+	got, err := lock.Get()
+	if err != nil {
+		t.Fatalf("failed to get lease, error: %+v", err)
+	}
+	if got.HolderIdentity != "replica-2" || got.LeaderTransitions != 1 || got.LeaseDurationSeconds != 15 || !got.RenewTime.Equal(&now) {
+		t.Errorf("expected record %+v but got %+v", record, got)
+	}
+	if lock.Describe() != "some-namespace/some-lease" {
+		t.Errorf("unexpected description '%s'", lock.Describe())
+	}
+}
@@ -20,15 +20,21 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 
 	corev1 "k8s.io/api/core/v1"
 	kubeinformers "k8s.io/client-go/informers"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -36,6 +42,8 @@ import (
 	"k8s.io/client-go/tools/record"
 
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/cmd/azure-keyvault-controller/controller"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/health"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/policy"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
 	clientset "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned"
 	informers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/informers/externalversions"
@@ -43,18 +51,43 @@ import (
 )
 
 var (
-	masterURL   string
-	kubeconfig  string
-	cloudconfig string
-	logLevel    string
+	masterURL     string
+	kubeconfig    string
+	cloudconfig   string
+	logLevel      string
+	metricsAddr   string
+	healthAddr    string
+	eventGridAddr string
+
+	vaultBackend   string
+	vaultLocalPath string
 
 	azureVaultFastRate        time.Duration
 	azureVaultSlowRate        time.Duration
 	azureVaultMaxFastAttempts int
 	customAuth                bool
+	azureVaultThrottle        vault.ThrottleConfig
+	azureVaultCacheTTL        time.Duration
+	azureVaultFallbackRate    time.Duration
+	eventGridToken            string
+
+	certificateExpiryThresholds []time.Duration
+	secretHashKey               []byte
+	vaultNamespaces             policy.VaultNamespaces
+	rolloutWorkloads            bool
+
+	leaderElection leaderElectionConfig
 )
 
-const controllerAgentName = "azurekeyvaultcontroller"
+const (
+	controllerAgentName = "azurekeyvaultcontroller"
+
+	// credentialsCheckTimeout limits how long the credentials readiness check waits for Azure AD
+	credentialsCheckTimeout = 5 * time.Second
+
+	// credentialsCheckInterval is how long the result of the credentials readiness check is reused
+	credentialsCheckInterval = time.Minute
+)
 
 func main() {
 	flag.Parse()
@@ -89,6 +122,61 @@ func main() {
 		log.Fatalf("Error parsing env var AZURE_VAULT_MAX_FAILURE_ATTEMPTS: %s", err.Error())
 	}
 
+	if eventGridAddr != "" {
+		azureVaultFallbackRate, err = getEnvDuration("AZURE_VAULT_FALLBACK_POLL_INTERVALS", time.Hour)
+		if err != nil {
+			log.Fatalf("Error parsing env var AZURE_VAULT_FALLBACK_POLL_INTERVALS: %s", err.Error())
+		}
+
+		eventGridToken, err = getEnvStr("EVENT_GRID_WEBHOOK_TOKEN", "")
+		if err != nil {
+			log.Fatalf("Error parsing env var EVENT_GRID_WEBHOOK_TOKEN: %s", err.Error())
+		}
+		if eventGridToken == "" {
+			log.Fatal("EVENT_GRID_WEBHOOK_TOKEN must be set to receive Event Grid events")
+		}
+	}
+
+	azureVaultThrottle = vault.DefaultThrottleConfig()
+	azureVaultThrottle.RequestsPerSecond, err = getEnvFloat("AZURE_VAULT_REQUESTS_PER_SECOND", azureVaultThrottle.RequestsPerSecond)
+	if err != nil {
+		log.Fatalf("Error parsing env var AZURE_VAULT_REQUESTS_PER_SECOND: %s", err.Error())
+	}
+
+	azureVaultThrottle.Burst, err = getEnvInt("AZURE_VAULT_REQUEST_BURST", azureVaultThrottle.Burst)
+	if err != nil {
+		log.Fatalf("Error parsing env var AZURE_VAULT_REQUEST_BURST: %s", err.Error())
+	}
+
+	azureVaultThrottle.MaxBackoff, err = getEnvDuration("AZURE_VAULT_MAX_BACKOFF", azureVaultThrottle.MaxBackoff)
+	if err != nil {
+		log.Fatalf("Error parsing env var AZURE_VAULT_MAX_BACKOFF: %s", err.Error())
+	}
+
+	azureVaultCacheTTL, err = getEnvDuration("AZURE_VAULT_CACHE_TTL", 30*time.Second)
+	if err != nil {
+		log.Fatalf("Error parsing env var AZURE_VAULT_CACHE_TTL: %s", err.Error())
+	}
+
+	certificateExpiryThresholds, err = getEnvDays("CERTIFICATE_EXPIRY_WARNING_DAYS", []time.Duration{30 * 24 * time.Hour, 14 * 24 * time.Hour, 7 * 24 * time.Hour})
+	if err != nil {
+		log.Fatalf("Error parsing env var CERTIFICATE_EXPIRY_WARNING_DAYS: %s", err.Error())
+	}
+
+	secretHashKey, err = getSecretHashKey("SECRET_HASH_KEY")
+	if err != nil {
+		log.Fatalf("Error creating secret hash key: %s", err.Error())
+	}
+
+	vaultNamespacesValue, err := getEnvStr("VAULT_NAMESPACES", "")
+	if err != nil {
+		log.Fatalf("Error parsing env var VAULT_NAMESPACES: %s", err.Error())
+	}
+	vaultNamespaces, err = policy.ParseVaultNamespaces(vaultNamespacesValue)
+	if err != nil {
+		log.Fatalf("Error parsing env var VAULT_NAMESPACES: %s", err.Error())
+	}
+
 	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
 	if err != nil {
 		log.Fatalf("Error building kubeconfig: %s", err.Error())
@@ -110,6 +198,7 @@ func main() {
 		Normal:                       azureVaultFastRate,
 		Slow:                         azureVaultSlowRate,
 		MaxFailuresBeforeSlowingDown: azureVaultMaxFastAttempts,
+		Fallback:                     azureVaultFallbackRate,
 	}
 
 	log.Info("Creating event broadcaster")
@@ -118,19 +207,38 @@ func main() {
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
 
 	var vaultAuth *vault.AzureKeyVaultCredentials
-	if customAuth {
-		if vaultAuth, err = vault.NewAzureKeyVaultCredentialsFromEnvironment(); err != nil {
-			log.Fatalf("failed to create azure key vault credentials, error: %+v", err.Error())
-		}
-	} else {
-		if vaultAuth, err = vault.NewAzureKeyVaultCredentialsFromCloudConfig(cloudconfig); err != nil {
-			log.Fatalf("failed to create azure key vault credentials, error: %+v", err.Error())
+	if vaultBackend == vault.BackendAzure {
+		if customAuth {
+			if vaultAuth, err = vault.NewAzureKeyVaultCredentialsFromEnvironment(); err != nil {
+				log.Fatalf("failed to create azure key vault credentials, error: %+v", err.Error())
+			}
+		} else {
+			if vaultAuth, err = vault.NewAzureKeyVaultCredentialsFromCloudConfig(cloudconfig); err != nil {
+				log.Fatalf("failed to create azure key vault credentials, error: %+v", err.Error())
+			}
 		}
+
+		log.Infof("Using Azure cloud environment '%s' by default for Azure Key Vault", vaultAuth.Environment.Name)
 	}
 
-	vaultService := vault.NewService(vaultAuth)
+	log.Infof("Using vault backend '%s'", vaultBackend)
+	vaultService, err := vault.NewServiceForBackend(vaultBackend, vault.BackendConfig{
+		Credentials: vaultAuth,
+		Path:        vaultLocalPath,
+		Throttle:    &azureVaultThrottle,
+	})
+	if err != nil {
+		log.Fatalf("failed to create vault service, error: %+v", err.Error())
+	}
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
-	handler := controller.NewHandler(kubeClient, azureKeyVaultSecretClient, kubeInformerFactory.Core().V1().Secrets().Lister(), azureKeyVaultSecretInformerFactory.Azurekeyvault().V1alpha1().AzureKeyVaultSecrets().Lister(), recorder, vaultService, azurePollFrequency)
+
+	// Workloads are only watched when rolling them out is enabled, as it requires watching
+	// Deployments, StatefulSets and DaemonSets in all namespaces
+	var workloadInformers appsinformers.Interface
+	if rolloutWorkloads {
+		workloadInformers = kubeInformerFactory.Apps().V1()
+	}
+	handler := controller.NewHandler(kubeClient, azureKeyVaultSecretClient, kubeInformerFactory.Core().V1().Secrets().Lister(), azureKeyVaultSecretInformerFactory.Azurekeyvault().V1alpha1().AzureKeyVaultSecrets().Lister(), workloadInformers, recorder, vaultService, azurePollFrequency, certificateExpiryThresholds, azureVaultCacheTTL, secretHashKey, vaultNamespaces)
 
 	controller := controller.NewController(handler,
 		kubeInformerFactory.Core().V1().Secrets(),
@@ -142,9 +250,36 @@ func main() {
 	kubeInformerFactory.Start(stopCh)
 	azureKeyVaultSecretInformerFactory.Start(stopCh)
 
-	if err = controller.Run(2, stopCh); err != nil {
-		log.Fatalf("Error running controller: %s", err.Error())
+	healthHandler := health.NewHandler()
+	healthHandler.AddReadinessCheck("informers", func() error {
+		if !controller.HasSynced() {
+			return fmt.Errorf("informer caches not synced")
+		}
+		return nil
+	})
+	if vaultAuth != nil {
+		authorizer, err := vaultAuth.Authorizer()
+		if err != nil {
+			log.Fatalf("failed to create azure key vault authorizer, error: %+v", err.Error())
+		}
+		healthHandler.AddReadinessCheck("credentials", health.CachedCheck(func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), credentialsCheckTimeout)
+			defer cancel()
+			return vaultAuth.EnsureToken(ctx, authorizer)
+		}, credentialsCheckInterval))
 	}
+
+	go serveMetrics(metricsAddr)
+	go serveHealth(healthAddr, healthHandler)
+	go serveEventGrid(eventGridAddr, controller.EventGridHandler(eventGridToken))
+
+	// Informers are started regardless of leadership, so standby replicas keep
+	// warm caches and can take over right away
+	runWithLeaderElection(leaderElection, kubeClient, recorder, stopCh, func(stopCh <-chan struct{}) {
+		if err := controller.Run(2, stopCh); err != nil {
+			log.Fatalf("Error running controller: %s", err.Error())
+		}
+	})
 }
 
 func init() {
@@ -152,6 +287,58 @@ func init() {
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&logLevel, "log-level", "", "log level")
 	flag.StringVar(&cloudconfig, "cloudconfig", "/etc/kubernetes/azure.json", "Path to cloud config. Only required if this is not at default location /etc/kubernetes/azure.json")
+	flag.StringVar(&vaultBackend, "vault-backend", vault.BackendAzure, "Vault backend to get secrets, keys and certificates from. Use 'local' for development without Azure.")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":9000", "Address to serve Prometheus metrics on. Set to empty string to disable.")
+	flag.StringVar(&healthAddr, "health-addr", ":8080", "Address to serve liveness (/healthz) and readiness (/readyz) probes on.")
+	flag.StringVar(&eventGridAddr, "event-grid-addr", "", "Address to receive Azure Event Grid events for Azure Key Vault on (/events). Polling is then only a fallback. Disabled when empty.")
+	flag.BoolVar(&leaderElection.enabled, "leader-elect", false, "Use Lease based leader election, so only one of several controller replicas is active at a time.")
+	flag.StringVar(&leaderElection.leaseName, "leader-elect-lease-name", "azure-keyvault-controller", "Name of the Lease used for leader election.")
+	flag.StringVar(&leaderElection.namespace, "leader-elect-namespace", "", "Namespace of the Lease used for leader election. Defaults to the namespace the controller runs in.")
+	flag.StringVar(&leaderElection.identity, "leader-elect-identity", "", "Identity of this replica in leader election. Defaults to the hostname.")
+	flag.DurationVar(&leaderElection.leaseDuration, "leader-elect-lease-duration", 15*time.Second, "Duration standby replicas wait before trying to take over leadership when the leader stops renewing the Lease.")
+	flag.DurationVar(&leaderElection.renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "Duration the leader keeps trying to renew the Lease before giving up leadership. Must be less than the lease duration.")
+	flag.DurationVar(&leaderElection.retryPeriod, "leader-elect-retry-period", 2*time.Second, "Duration between attempts to acquire or renew the Lease.")
+	flag.BoolVar(&rolloutWorkloads, "rollout-workloads", false, "Roll out Deployments, StatefulSets and DaemonSets opting in with the spv.no/rollout annotation when their Secret changes in Azure Key Vault.")
+	flag.StringVar(&vaultLocalPath, "vault-local-path", "", "Directory containing vault files. Only required if vault-backend is 'local'.")
+}
+
+func serveMetrics(addr string) {
+	if addr == "" {
+		log.Info("Metrics disabled")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Error serving metrics: %s", err.Error())
+	}
+}
+
+func serveHealth(addr string, handler *health.Handler) {
+	mux := http.NewServeMux()
+	handler.Register(mux)
+
+	log.Infof("Serving health probes on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Error serving health probes: %s", err.Error())
+	}
+}
+
+func serveEventGrid(addr string, handler http.Handler) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/events", handler)
+
+	log.Infof("Receiving Event Grid events on %s/events", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Error serving Event Grid events: %s", err.Error())
+	}
 }
 
 func setLogLevel() {
@@ -178,6 +365,40 @@ func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
 	return fallback, nil
 }
 
+// getEnvDays parses a comma separated list of days, like 30,14,7
+func getEnvDays(key string, fallback []time.Duration) ([]time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	var durations []time.Duration
+	for _, day := range strings.Split(value, ",") {
+		if day = strings.TrimSpace(day); day == "" {
+			continue
+		}
+		days, err := strconv.Atoi(day)
+		if err != nil {
+			return nil, err
+		}
+		if days <= 0 {
+			return nil, fmt.Errorf("days must be positive, got %d", days)
+		}
+		durations = append(durations, time.Duration(days)*24*time.Hour)
+	}
+	return durations, nil
+}
+
+// getSecretHashKey returns the key for hashing Secret values in the status. The key is
+// required, since hashes must stay the same across restarts and replicas.
+func getSecretHashKey(key string) ([]byte, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil, fmt.Errorf("%s must be set", key)
+	}
+	return []byte(value), nil
+}
+
 func getEnvInt(key string, fallback int) (int, error) {
 	if value, ok := os.LookupEnv(key); ok {
 		intVal, err := strconv.Atoi(value)
@@ -186,6 +407,13 @@ func getEnvInt(key string, fallback int) (int, error) {
 	return fallback, nil
 }
 
+func getEnvFloat(key string, fallback float64) (float64, error) {
+	if value, ok := os.LookupEnv(key); ok {
+		return strconv.ParseFloat(value, 64)
+	}
+	return fallback, nil
+}
+
 func getEnvStr(key string, fallback string) (string, error) {
 	if value, ok := os.LookupEnv(key); ok {
 		return value, nil
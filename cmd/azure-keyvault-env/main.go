@@ -25,6 +25,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/policy"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
@@ -70,28 +71,48 @@ func main() {
 
 	log.Debugf("%s namespace: %s", logPrefix, namespace)
 
-	customAuth := strings.ToLower(os.Getenv("ENV_INJECTOR_CUSTOM_AUTH"))
-	log.Debugf("%s use custom auth: %s", logPrefix, customAuth)
+	vaultNamespaces, err := policy.ParseVaultNamespaces(os.Getenv("ENV_INJECTOR_VAULT_NAMESPACES"))
+	if err != nil {
+		log.Fatalf("%s failed to parse vault namespaces, error %+v", logPrefix, err)
+	}
+
+	vaultBackend := os.Getenv("ENV_INJECTOR_VAULT_BACKEND")
+	if vaultBackend == "" {
+		vaultBackend = vault.BackendAzure
+	}
+	log.Debugf("%s using vault backend: %s", logPrefix, vaultBackend)
 
 	var creds *vault.AzureKeyVaultCredentials
-	var err error
 
-	if customAuth == "true" {
-		log.Debugf("%s getting credentials for azure key vault using azure credentials supplied to pod", logPrefix)
+	if vaultBackend == vault.BackendAzure {
+		customAuth := strings.ToLower(os.Getenv("ENV_INJECTOR_CUSTOM_AUTH"))
+		log.Debugf("%s use custom auth: %s", logPrefix, customAuth)
 
-		creds, err = vault.NewAzureKeyVaultCredentialsFromEnvironment()
-		if err != nil {
-			log.Fatalf("%s failed to get credentials for azure key vault, error %+v", logPrefix, err)
-		}
-	} else {
-		log.Debugf("%s getting credentials for azure key vault using azure credentials from cloud config", logPrefix)
-		creds, err = vault.NewAzureKeyVaultCredentialsFromCloudConfig("/azure-keyvault/azure.json")
-		if err != nil {
-			log.Fatalf("%s failed to get credentials for azure key vault, error %+v", logPrefix, err)
+		if customAuth == "true" {
+			log.Debugf("%s getting credentials for azure key vault using azure credentials supplied to pod", logPrefix)
+
+			creds, err = vault.NewAzureKeyVaultCredentialsFromEnvironment()
+			if err != nil {
+				log.Fatalf("%s failed to get credentials for azure key vault, error %+v", logPrefix, err)
+			}
+		} else {
+			log.Debugf("%s getting credentials for azure key vault using azure credentials from cloud config", logPrefix)
+			creds, err = vault.NewAzureKeyVaultCredentialsFromCloudConfig("/azure-keyvault/azure.json")
+			if err != nil {
+				log.Fatalf("%s failed to get credentials for azure key vault, error %+v", logPrefix, err)
+			}
 		}
+
+		log.Debugf("%s using azure cloud environment '%s' by default", logPrefix, creds.Environment.Name)
 	}
 
-	vaultService := vault.NewService(creds)
+	vaultService, err := vault.NewServiceForBackend(vaultBackend, vault.BackendConfig{
+		Credentials: creds,
+		Path:        os.Getenv("ENV_INJECTOR_VAULT_LOCAL_PATH"),
+	})
+	if err != nil {
+		log.Fatalf("%s failed to create vault service, error %+v", logPrefix, err)
+	}
 
 	// Delete /azure-keyvault/
 	dirToRemove := "/azure-keyvault/"
@@ -145,6 +166,11 @@ func main() {
 				log.Fatalf("%s error getting azurekeyvaultsecret resource '%s', error: %s", logPrefix, secretName, err.Error())
 			}
 
+			// The vault is checked again, as the AzureKeyVaultSecret can have changed since the pod was admitted
+			if err := vaultNamespaces.Check(keyVaultSecretSpec); err != nil {
+				log.Fatalf("%s %s", logPrefix, err.Error())
+			}
+
 			log.Debugf("%s getting secret value for '%s' from azure key vault", logPrefix, keyVaultSecretSpec.Spec.Vault.Object.Name)
 			secret, err := getSecretFromKeyVault(keyVaultSecretSpec, secretQuery, vaultService)
 			if err != nil {
@@ -196,6 +222,10 @@ func clearDir(dir string) error {
 func getSecretFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret, query string, vaultService vault.Service) (string, error) {
 	var secretHandler EnvSecretHandler
 
+	if len(azureKeyVaultSecret.Spec.Vault.Objects) > 0 || azureKeyVaultSecret.Spec.Vault.Selector != nil {
+		return "", fmt.Errorf("azure key vault secret '%s' syncs multiple objects using spec.vault.objects or spec.vault.selector, which is only supported by the controller", azureKeyVaultSecret.Name)
+	}
+
 	switch azureKeyVaultSecret.Spec.Vault.Object.Type {
 	case akv.AzureKeyVaultObjectTypeSecret:
 		transformator, err := transformers.CreateTransformator(&azureKeyVaultSecret.Spec.Output)
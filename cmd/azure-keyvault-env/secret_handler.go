@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -29,6 +30,9 @@ import (
 	corev1 "k8s.io/api/core/v1"
 )
 
+// caCertKey is the query for the certificate chain of a certificate, without the leaf certificate
+const caCertKey = "ca.crt"
+
 // EnvSecretHandler handles getting and formatting secrets from Azure Key Vault to environment variables
 type EnvSecretHandler interface {
 	Handle() (string, error)
@@ -134,9 +138,19 @@ func (h *AzureKeyVaultSecretHandler) Handle() (string, error) {
 	}
 }
 
-// Handle getting and formating Azure Key Vault Certificate from Azure Key Vault to Kubernetes
+// Handle getting and formating Azure Key Vault Certificate from Azure Key Vault to Kubernetes.
+// Besides tls.crt, tls.key and raw, the query can be ca.crt for the certificate chain or one
+// of the certificate formats. Since environment variables cannot hold binary data, pkcs12 and
+// jks formats are base64 encoded.
 func (h *AzureKeyVaultCertificateHandler) Handle() (string, error) {
-	exportPrivateKey := h.query == corev1.TLSPrivateKeyKey
+	format := akv.AzureKeyVaultOutputFormat(h.query)
+	switch format {
+	case akv.AzureKeyVaultOutputFormatPem, akv.AzureKeyVaultOutputFormatPkcs12, akv.AzureKeyVaultOutputFormatJks, akv.AzureKeyVaultOutputFormatJksTrustStore:
+	default:
+		format = ""
+	}
+
+	exportPrivateKey := h.query == corev1.TLSPrivateKeyKey || (format != "" && format != akv.AzureKeyVaultOutputFormatJksTrustStore)
 	cert, err := h.vaultService.GetCertificate(&h.secretSpec.Spec.Vault, exportPrivateKey)
 
 	if err != nil {
@@ -147,30 +161,81 @@ func (h *AzureKeyVaultCertificateHandler) Handle() (string, error) {
 		return string(cert.ExportRaw()), nil
 	}
 
+	outputSecret := h.secretSpec.Spec.Output.Secret
+
+	if exportPrivateKey {
+		if err = cert.VerifyKeyPair(); err != nil {
+			return "", err
+		}
+	}
+	if outputSecret.DropRoot {
+		cert.DropRoot()
+	}
+
+	if format != "" {
+		password, err := vault.GetCertificatePassword(h.vaultService, h.secretSpec, format)
+		if err != nil {
+			return "", err
+		}
+		exported, err := cert.Export(format, outputSecret.PrivateKeyFormat, h.secretSpec.Spec.Vault.Object.Name, password)
+		if err != nil {
+			return "", err
+		}
+		if format == akv.AzureKeyVaultOutputFormatPem {
+			return string(exported), nil
+		}
+		return base64.StdEncoding.EncodeToString(exported), nil
+	}
+
 	var privKey []byte
 	var pubKey []byte
 
 	if exportPrivateKey {
-		if privKey, err = cert.ExportPrivateKeyAsPem(); err != nil {
+		if privKey, err = cert.ExportPrivateKey(outputSecret.PrivateKeyFormat); err != nil {
 			return "", err
 		}
 		return string(privKey), nil
 	}
 
-	if pubKey, err = cert.ExportPublicKeyAsPem(); err != nil {
+	switch {
+	case h.query == caCertKey:
+		pubKey, err = cert.ExportChainAsPem()
+	case h.query == corev1.TLSCertKey && outputSecret.SplitChain:
+		pubKey, err = cert.ExportLeafAsPem()
+	default:
+		pubKey, err = cert.ExportPublicKeyAsPem()
+	}
+	if err != nil {
 		return "", err
 	}
 	return string(pubKey), nil
 }
 
-// Handle getting and formating Azure Key Vault Key from Azure Key Vault to Kubernetes
+// Handle getting and formating Azure Key Vault Key from Azure Key Vault to Kubernetes.
+// The query can be one of the key formats, otherwise the modulus of the key is returned
+// as before. Since environment variables cannot hold binary data, der is base64 encoded.
 func (h *AzureKeyVaultKeyHandler) Handle() (string, error) {
 	key, err := h.vaultService.GetKey(&h.secretSpec.Spec.Vault)
 	if err != nil {
 		return "", err
 	}
 
-	return key, nil
+	format := akv.AzureKeyVaultOutputFormat(h.query)
+	switch format {
+	case akv.AzureKeyVaultOutputFormatJwk, akv.AzureKeyVaultOutputFormatPem, akv.AzureKeyVaultOutputFormatDer, akv.AzureKeyVaultOutputFormatOpenSSH:
+	default:
+		format = ""
+	}
+
+	exportedKey, err := key.Export(format)
+	if err != nil {
+		return "", fmt.Errorf("unable to handle azure key vault key with query '%s', error: %+v", h.query, err)
+	}
+
+	if format == akv.AzureKeyVaultOutputFormatDer {
+		return base64.StdEncoding.EncodeToString(exportedKey), nil
+	}
+	return string(exportedKey), nil
 }
 
 // Handle getting and formating Azure Key Vault Secret containing mulitple values from Azure Key Vault to Kubernetes
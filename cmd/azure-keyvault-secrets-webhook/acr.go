@@ -0,0 +1,324 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azurekeyvault/client"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/yaml.v2"
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/azure/auth"
+)
+
+const (
+	// acrRefreshTokenUsername is the username used with ACR refresh tokens
+	acrRefreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+	// acrRefreshTokenLifetime is how long ACR refresh tokens are used when their expiry
+	// can not be read from the token
+	acrRefreshTokenLifetime = time.Hour
+
+	// acrRefreshTokenExpiryMargin is how long before expiry ACR refresh tokens are renewed
+	acrRefreshTokenExpiryMargin = 5 * time.Minute
+
+	// Environment variables set by Azure AD Workload Identity
+	envFederatedTokenFile = "AZURE_FEDERATED_TOKEN_FILE"
+	envClientID           = "AZURE_CLIENT_ID"
+	envTenantID           = "AZURE_TENANT_ID"
+	envAuthorityHost      = "AZURE_AUTHORITY_HOST"
+)
+
+// aadToken is an Azure AD access token for Azure Resource Manager
+type aadToken struct {
+	accessToken string
+	tenantID    string
+}
+
+// acrCredentials are credentials for an Azure Container Registry and when they expire
+type acrCredentials struct {
+	credentials registryCredentials
+	expires     time.Time
+}
+
+// acrCredentialsProvider gets credentials for Azure Container Registries by exchanging an
+// Azure AD access token for an ACR refresh token, caching them until they expire
+type acrCredentialsProvider struct {
+	client      *http.Client
+	getAADToken func(ctx context.Context) (*aadToken, error)
+	now         func() time.Time
+
+	group   singleflight.Group
+	mu      sync.Mutex
+	entries map[string]acrCredentials
+}
+
+func newACRCredentialsProvider() *acrCredentialsProvider {
+	return &acrCredentialsProvider{
+		client:      http.DefaultClient,
+		getAADToken: getAADToken,
+		now:         time.Now,
+		entries:     make(map[string]acrCredentials),
+	}
+}
+
+var acrProvider = newACRCredentialsProvider()
+
+func getAcrCreds(host string) (registryCredentials, bool) {
+	if !hostIsAzureContainerRegistry(host) {
+		log.Infof("registry host '%s' is not a acr registry", host)
+		return registryCredentials{}, false
+	}
+
+	timeout := time.Duration(config.dockerPullTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creds, err := acrProvider.getCredentials(ctx, host)
+	if err != nil {
+		log.Infof("failed to get default credentials for acr registry '%s', error: %+v", host, err)
+		return registryCredentials{}, false
+	}
+	return creds, true
+}
+
+func hostIsAzureContainerRegistry(host string) bool {
+	for _, v := range []string{".azurecr.io", ".azurecr.cn", ".azurecr.de", ".azurecr.us"} {
+		if strings.HasSuffix(host, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCredentials returns cached credentials for the registry, or exchanges a new Azure AD
+// access token for a refresh token when they are about to expire
+func (p *acrCredentialsProvider) getCredentials(ctx context.Context, host string) (registryCredentials, error) {
+	p.mu.Lock()
+	entry, ok := p.entries[host]
+	p.mu.Unlock()
+
+	if ok && p.now().Add(acrRefreshTokenExpiryMargin).Before(entry.expires) {
+		return entry.credentials, nil
+	}
+
+	value, err, _ := p.group.Do(host, func() (interface{}, error) {
+		token, err := p.getAADToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		refreshToken, err := p.exchangeToken(ctx, host, token)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := acrCredentials{
+			credentials: registryCredentials{
+				Username: acrRefreshTokenUsername,
+				Password: refreshToken,
+			},
+			expires: getTokenExpiry(refreshToken, p.now()),
+		}
+		log.Infof("got refresh token for acr registry '%s', expiring %s", host, entry.expires.Format(time.RFC3339))
+
+		p.mu.Lock()
+		p.entries[host] = entry
+		p.mu.Unlock()
+		return entry.credentials, nil
+	})
+	if err != nil {
+		return registryCredentials{}, err
+	}
+	return value.(registryCredentials), nil
+}
+
+// exchangeToken exchanges an Azure AD access token for an ACR refresh token
+func (p *acrCredentialsProvider) exchangeToken(ctx context.Context, host string, token *aadToken) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"tenant":       {token.tenantID},
+		"access_token": {token.accessToken},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s/oauth2/exchange", host), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange aad token for acr refresh token, error: %+v", err)
+	}
+
+	body, err := readResponse(resp, maxManifestSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange aad token for acr refresh token, error: %+v", err)
+	}
+
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(body, &exchange); err != nil {
+		return "", fmt.Errorf("failed to parse acr refresh token, error: %+v", err)
+	}
+	if exchange.RefreshToken == "" {
+		return "", fmt.Errorf("acr registry '%s' returned an empty refresh token", host)
+	}
+	return exchange.RefreshToken, nil
+}
+
+// getTokenExpiry returns when a JWT expires, or acrRefreshTokenLifetime from now when
+// the expiry can not be read. The token is not verified, as it is only used to know
+// when to get a new one.
+func getTokenExpiry(token string, now time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err == nil {
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if err := json.Unmarshal(payload, &claims); err == nil && claims.Exp > 0 {
+				return time.Unix(claims.Exp, 0)
+			}
+		}
+	}
+	return now.Add(acrRefreshTokenLifetime)
+}
+
+// getAADToken gets an Azure AD access token for Azure Resource Manager, using Azure AD
+// Workload Identity when configured, or else the managed identity or service principal
+// in the cloud config of the node
+func getAADToken(ctx context.Context) (*aadToken, error) {
+	if tokenFile := os.Getenv(envFederatedTokenFile); tokenFile != "" {
+		return getWorkloadIdentityToken(ctx, http.DefaultClient, tokenFile)
+	}
+	return getCloudConfigToken(ctx)
+}
+
+// getWorkloadIdentityToken exchanges the service account token projected by Azure AD
+// Workload Identity for an Azure AD access token
+func getWorkloadIdentityToken(ctx context.Context, client *http.Client, tokenFile string) (*aadToken, error) {
+	clientID := os.Getenv(envClientID)
+	tenantID := os.Getenv(envTenantID)
+	if clientID == "" || tenantID == "" {
+		return nil, fmt.Errorf("%s and %s must be set to use workload identity", envClientID, envTenantID)
+	}
+
+	assertion, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read federated token file, error: %+v", err)
+	}
+
+	env, err := vault.GetAzureEnvironment(config.cloudEnvironment)
+	if err != nil {
+		return nil, err
+	}
+
+	authorityHost := os.Getenv(envAuthorityHost)
+	if authorityHost == "" {
+		authorityHost = env.ActiveDirectoryEndpoint
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+		"scope":                 {strings.TrimSuffix(env.ResourceManagerEndpoint, "/") + "/.default"},
+	}
+
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), tenantID)
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aad token using workload identity, error: %+v", err)
+	}
+
+	body, err := readResponse(resp, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aad token using workload identity, error: %+v", err)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return nil, fmt.Errorf("failed to parse aad token from workload identity, error: %+v", err)
+	}
+
+	log.Infof("using workload identity with clientid '%s' for acr registries", clientID)
+	return &aadToken{accessToken: token.AccessToken, tenantID: tenantID}, nil
+}
+
+// getCloudConfigToken gets an Azure AD access token using the managed identity or service
+// principal in azure.json
+func getCloudConfigToken(ctx context.Context) (*aadToken, error) {
+	bytes, err := ioutil.ReadFile(config.cloudConfigHostPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read azure.json to get default credentials, error: %+v", err)
+	}
+
+	azureConfig := auth.AzureAuthConfig{}
+	if err = yaml.Unmarshal(bytes, &azureConfig); err != nil {
+		return nil, fmt.Errorf("failed to unmarshall azure config, error: %+v", err)
+	}
+
+	if !azureConfig.UseManagedIdentityExtension && azureConfig.AADClientID == "" {
+		return nil, fmt.Errorf("neither managed identity nor aadclientid is set in azure config, so have no credentials to use")
+	}
+
+	env, err := auth.ParseAzureEnvironment(azureConfig.Cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := auth.GetServicePrincipalToken(&azureConfig, env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aad token from azure config, error: %+v", err)
+	}
+
+	if err := token.EnsureFreshWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get aad token from azure config, error: %+v", err)
+	}
+
+	if azureConfig.UseManagedIdentityExtension {
+		log.Info("using managed identity from azure config for acr registries")
+	} else {
+		log.Infof("using service principal with clientid '%s' from azure config for acr registries", azureConfig.AADClientID)
+	}
+	return &aadToken{accessToken: token.OAuthToken(), tenantID: azureConfig.TenantID}, nil
+}
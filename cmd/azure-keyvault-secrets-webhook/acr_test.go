@@ -0,0 +1,109 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRefreshToken returns an unsigned JWT expiring at expires
+func newRefreshToken(expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, expires.Unix())))
+	return "eyJhbGciOiJub25lIn0." + payload + ".signature"
+}
+
+func TestACRCredentialsExchangedAndCached(t *testing.T) {
+	now := time.Now()
+	exchanges := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/exchange" || r.FormValue("grant_type") != "access_token" || r.FormValue("access_token") != "some-aad-token" || r.FormValue("tenant") != "some-tenant" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		exchanges++
+		fmt.Fprintf(w, `{"refresh_token":"%s"}`, newRefreshToken(now.Add(3*time.Hour)))
+	}))
+	defer server.Close()
+
+	provider := newACRCredentialsProvider()
+	provider.client = server.Client()
+	provider.now = func() time.Time { return now }
+	provider.getAADToken = func(ctx context.Context) (*aadToken, error) {
+		return &aadToken{accessToken: "some-aad-token", tenantID: "some-tenant"}, nil
+	}
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	creds, err := provider.getCredentials(context.Background(), host)
+	if err != nil {
+		t.Fatalf("failed to get acr credentials, error: %+v", err)
+	}
+	if creds.Username != acrRefreshTokenUsername || creds.Password == "" {
+		t.Errorf("expected refresh token credentials but got %+v", creds)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := provider.getCredentials(context.Background(), host); err != nil {
+		t.Fatal(err)
+	}
+	if exchanges != 1 {
+		t.Errorf("expected credentials to be cached until expiry, but got %d exchanges", exchanges)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := provider.getCredentials(context.Background(), host); err != nil {
+		t.Fatal(err)
+	}
+	if exchanges != 2 {
+		t.Errorf("expected expired credentials to be exchanged again, but got %d exchanges", exchanges)
+	}
+}
+
+func TestACRCredentialsNotCachedOnError(t *testing.T) {
+	provider := newACRCredentialsProvider()
+	calls := 0
+	provider.getAADToken = func(ctx context.Context) (*aadToken, error) {
+		calls++
+		return nil, fmt.Errorf("no credentials")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := provider.getCredentials(context.Background(), "some.azurecr.io"); err == nil {
+			t.Error("expected error without aad token")
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected failures not to be cached, but got %d calls", calls)
+	}
+}
+
+func TestGetTokenExpiry(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(3 * time.Hour).Truncate(time.Second)
+
+	if expiry := getTokenExpiry(newRefreshToken(expires), now); !expiry.Equal(expires) {
+		t.Errorf("expected expiry %s but got %s", expires, expiry)
+	}
+	if expiry := getTokenExpiry("not-a-jwt", now); !expiry.Equal(now.Add(acrRefreshTokenLifetime)) {
+		t.Errorf("expected default expiry for invalid token but got %s", expiry)
+	}
+}
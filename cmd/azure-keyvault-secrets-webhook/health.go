@@ -0,0 +1,73 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/health"
+)
+
+const kubernetesHealthTimeout = 5 * time.Second
+
+// newHealthClientset creates the clientset used by the kubernetes readiness check,
+// timing out requests so a probe never hangs on an unreachable Kubernetes API
+func newHealthClientset() (kubernetes.Interface, error) {
+	kubeConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	kubeConfig.Timeout = kubernetesHealthTimeout
+	return kubernetes.NewForConfig(kubeConfig)
+}
+
+// newHealthHandler creates health probes for the webhook, being ready when the
+// TLS certificate can be loaded and the Kubernetes API is reachable
+func newHealthHandler(certFile, keyFile string, clientset kubernetes.Interface) *health.Handler {
+	handler := health.NewHandler()
+
+	handler.AddReadinessCheck("tls", func() error {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return fmt.Errorf("failed to load tls certificate, error: %+v", err)
+		}
+		return nil
+	})
+
+	handler.AddReadinessCheck("kubernetes", func() error {
+		if _, err := clientset.Discovery().ServerVersion(); err != nil {
+			return fmt.Errorf("kubernetes api not reachable, error: %+v", err)
+		}
+		return nil
+	})
+
+	return handler
+}
+
+func serveHealth(addr string, handler *health.Handler) {
+	mux := http.NewServeMux()
+	handler.Register(mux)
+
+	log.Infof("serving health probes on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("error serving health probes: %s", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+)
+
+// imageDigestCacheTTL is how long image configurations are cached by digest. Content
+// referenced by digest never changes, so these entries are mostly evicted as least
+// recently used.
+const imageDigestCacheTTL = 24 * time.Hour
+
+// imageConfigCache caches image configurations in the webhook process, both by image
+// reference and platform, and by the digest of the platform specific image manifest.
+// Tags can be moved to other images, so configurations cached by a tag expire after
+// ttl, while those cached by digest are kept until evicted. Entries are scoped by the
+// registry credentials used to get them, so a configuration is never returned to a pod
+// without access to the image.
+type imageConfigCache struct {
+	entries *utilcache.LRUExpireCache
+	ttl     time.Duration
+	group   singleflight.Group
+}
+
+func newImageConfigCache(size int, ttl time.Duration) *imageConfigCache {
+	return newImageConfigCacheWithClock(size, ttl, realClock{})
+}
+
+func newImageConfigCacheWithClock(size int, ttl time.Duration, clock utilcache.Clock) *imageConfigCache {
+	return &imageConfigCache{
+		entries: utilcache.NewLRUExpireCacheWithClock(size, clock),
+		ttl:     ttl,
+	}
+}
+
+// getByReference returns the cached configuration of an image reference on a platform
+func (c *imageConfigCache) getByReference(scope, reference string, platform imagePlatform) (*imageConfig, bool) {
+	return c.get(imageReferenceCacheKey(scope, reference, platform))
+}
+
+// addByReference caches the configuration of an image reference on a platform. Only
+// references by digest are cached longer than the ttl of the cache.
+func (c *imageConfigCache) addByReference(scope, reference string, platform imagePlatform, digested bool, config *imageConfig) {
+	ttl := c.ttl
+	if digested {
+		ttl = imageDigestCacheTTL
+	}
+	c.entries.Add(imageReferenceCacheKey(scope, reference, platform), config, ttl)
+}
+
+// getByDigest returns the cached configuration of the image with the manifest digest
+func (c *imageConfigCache) getByDigest(scope, repository, digest string) (*imageConfig, bool) {
+	return c.get(imageDigestCacheKey(scope, repository, digest))
+}
+
+// addByDigest caches the configuration of the image with the manifest digest
+func (c *imageConfigCache) addByDigest(scope, repository, digest string, config *imageConfig) {
+	c.entries.Add(imageDigestCacheKey(scope, repository, digest), config, imageDigestCacheTTL)
+}
+
+func (c *imageConfigCache) get(key string) (*imageConfig, bool) {
+	value, ok := c.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*imageConfig), true
+}
+
+func imageReferenceCacheKey(scope, reference string, platform imagePlatform) string {
+	return scope + "/" + reference + "|" + platform.String()
+}
+
+func imageDigestCacheKey(scope, repository, digest string) string {
+	return scope + "/" + repository + "@" + digest
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
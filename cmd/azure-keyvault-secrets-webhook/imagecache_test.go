@@ -0,0 +1,117 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (r *fakeRegistry) countRequests(kind string) int {
+	count := 0
+	for _, path := range r.requests {
+		if strings.Contains(path, "/"+kind+"/") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestImageConfigCachedByReference(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.server.Close()
+
+	client := &registryClient{client: registry.server.Client(), timeout: time.Minute, cache: newImageConfigCache(10, time.Minute)}
+	creds := &registryCredentials{Username: "some-user", Password: "some-password"}
+	platform := imagePlatform{OS: "linux", Architecture: "amd64"}
+
+	hits := testutil.ToFloat64(imageCacheLookups.WithLabelValues(metricsResultHit))
+	misses := testutil.ToFloat64(imageCacheLookups.WithLabelValues(metricsResultMiss))
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.getImageConfig(context.Background(), registry.image(), creds, platform); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := registry.countRequests("manifests"); count != 2 {
+		t.Errorf("expected manifest list and manifest to be requested once, but got %d requests", count)
+	}
+	if count := testutil.ToFloat64(imageCacheLookups.WithLabelValues(metricsResultHit)) - hits; count != 2 {
+		t.Errorf("expected 2 cache hits but got %v", count)
+	}
+	if count := testutil.ToFloat64(imageCacheLookups.WithLabelValues(metricsResultMiss)) - misses; count != 1 {
+		t.Errorf("expected 1 cache miss but got %v", count)
+	}
+}
+
+func TestImageConfigCachedByDigestWhenTagExpires(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.server.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	client := &registryClient{client: registry.server.Client(), timeout: time.Minute, cache: newImageConfigCacheWithClock(10, time.Minute, clock)}
+	creds := &registryCredentials{Username: "some-user", Password: "some-password"}
+	platform := imagePlatform{OS: "linux", Architecture: "amd64"}
+
+	if _, err := client.getImageConfig(context.Background(), registry.image(), creds, platform); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	config, err := client.getImageConfig(context.Background(), registry.image(), creds, platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Cmd) != 1 || config.Cmd[0] != "--amd64" {
+		t.Errorf("expected cached configuration of amd64 image but got %+v", config)
+	}
+
+	if count := registry.countRequests("manifests"); count != 3 {
+		t.Errorf("expected the tag to be resolved again after expiring, but got %d manifest requests", count)
+	}
+	if count := registry.countRequests("blobs"); count != 1 {
+		t.Errorf("expected the image configuration to be requested once, but got %d requests", count)
+	}
+}
+
+func TestImageConfigCacheScopedByCredentials(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.server.Close()
+
+	client := &registryClient{client: registry.server.Client(), timeout: time.Minute, cache: newImageConfigCache(10, time.Minute)}
+	platform := imagePlatform{OS: "linux", Architecture: "amd64"}
+
+	creds := &registryCredentials{Username: "some-user", Password: "some-password"}
+	if _, err := client.getImageConfig(context.Background(), registry.image(), creds, platform); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, other := range []*registryCredentials{nil, {Username: "some-user", Password: "wrong-password"}} {
+		if _, err := client.getImageConfig(context.Background(), registry.image(), other, platform); err == nil {
+			t.Errorf("expected error getting cached image config with credentials %+v", other)
+		}
+	}
+}
@@ -19,12 +19,10 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -35,17 +33,14 @@ import (
 	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
 	"github.com/slok/kubewebhook/pkg/webhook/mutating"
 	"github.com/spf13/viper"
-	"gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/kubernetes/pkg/cloudprovider/providers/azure/auth"
 
-	dockerref "github.com/docker/distribution/reference"
-	dockertypes "github.com/docker/docker/api/types"
-	dockerclient "github.com/docker/docker/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	akvClientset "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned"
 )
 
 const (
@@ -58,15 +53,20 @@ type azureKeyVaultConfig struct {
 	customAuthAutoInject     bool
 	credentials              *AzureKeyVaultCredentials
 	credentialsSecretName    string
-	namespace                string
 	aadPodBindingLabel       string
 	cloudConfigHostPath      string
 	cloudConfigContainerPath string
 	dockerPullTimeout        int
+	cloudEnvironment         string
+	vaultBackend             string
+	vaultLocalPath           string
+	policy                   *injectionPolicy
 }
 
 var config azureKeyVaultConfig
 
+var imageRegistry *registryClient
+
 const envVarReplacementKey = "@azurekeyvault"
 
 func setLogLevel(logLevel string) {
@@ -144,21 +144,20 @@ func getVolumes() []corev1.Volume {
 
 func vaultSecretsMutator(ctx context.Context, obj metav1.Object) (bool, error) {
 	req := whcontext.GetAdmissionRequest(ctx)
-	config.namespace = req.Namespace
 	var pod *corev1.Pod
 
 	switch v := obj.(type) {
 	case *corev1.Pod:
-		log.Infof("found pod to mutate in namespace '%s'", config.namespace)
+		log.Infof("found pod to mutate in namespace '%s'", req.Namespace)
 		pod = v
 	default:
 		return false, nil
 	}
 
-	return false, mutatePodSpec(pod)
+	return false, mutatePodSpec(pod, req.Namespace)
 }
 
-func mutateContainers(containers []corev1.Container, creds map[string]string) (bool, error) {
+func mutateContainers(containers []corev1.Container, creds map[string]registryCredentials, platform imagePlatform) (bool, error) {
 	mutated := false
 	for i, container := range containers {
 		log.Infof("found container '%s' to mutate", container.Name)
@@ -176,22 +175,20 @@ func mutateContainers(containers []corev1.Container, creds map[string]string) (b
 			continue
 		}
 
-		registryName := ""
-		imgParts := strings.Split(container.Image, "/")
-		if len(imgParts) >= 2 {
-			registryName = imgParts[0]
-		}
-
-		regCred, ok := creds[registryName]
+		registryName := getImageRegistryHost(container.Image)
 
-		if ok {
+		var regCred *registryCredentials
+		if cred, ok := creds[registryName]; ok {
 			log.Infof("found credentials to use with registry '%s'", registryName)
+			regCred = &cred
 		} else {
 			log.Infof("did not find credentials to use with registry '%s' - getting default credentials", registryName)
-			regCred, ok = getAcrCreds(registryName)
+			if cred, ok := getAcrCreds(registryName); ok {
+				regCred = &cred
+			}
 		}
 
-		autoArgs, err := getContainerCmd(container, regCred)
+		autoArgs, err := getContainerCmd(container, regCred, platform)
 		if err != nil {
 			return false, fmt.Errorf("failed to get auto cmd, error: %+v", err)
 		}
@@ -225,6 +222,33 @@ func mutateContainers(containers []corev1.Container, creds map[string]string) (b
 			},
 		}...)
 
+		if config.cloudEnvironment != "" {
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name:  "AZURE_ENVIRONMENT",
+				Value: config.cloudEnvironment,
+			})
+		}
+
+		if config.vaultBackend != "" {
+			container.Env = append(container.Env, []corev1.EnvVar{
+				{
+					Name:  "ENV_INJECTOR_VAULT_BACKEND",
+					Value: config.vaultBackend,
+				},
+				{
+					Name:  "ENV_INJECTOR_VAULT_LOCAL_PATH",
+					Value: config.vaultLocalPath,
+				},
+			}...)
+		}
+
+		if config.policy.usesVaultNamespaces() {
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name:  "ENV_INJECTOR_VAULT_NAMESPACES",
+				Value: config.policy.vaultNamespacesValue,
+			})
+		}
+
 		if config.customAuth && config.customAuthAutoInject && config.credentials.CredentialsType != CredentialsTypeManagedIdentitiesForAzureResources {
 			container.Env = append(container.Env, *config.credentials.GetEnvVarFromSecret(config.credentialsSecretName)...)
 		}
@@ -235,8 +259,8 @@ func mutateContainers(containers []corev1.Container, creds map[string]string) (b
 	return mutated, nil
 }
 
-func getContainerCmd(container corev1.Container, creds string) ([]string, error) {
-	var image *dockertypes.ImageInspect
+func getContainerCmd(container corev1.Container, creds *registryCredentials, platform imagePlatform) ([]string, error) {
+	var image *imageConfig
 	var err error
 	cmd := make([]string, 0)
 
@@ -246,22 +270,22 @@ func getContainerCmd(container corev1.Container, creds string) ([]string, error)
 		log.Infof("found container command %v", container.Command)
 		cmd = append(cmd, container.Command...)
 	} else {
-		image, err = getDockerImage(container, creds)
+		image, err = getImageConfig(container, creds, platform)
 		if err != nil {
 			return nil, err
 		}
 
 		if image == nil {
-			return nil, fmt.Errorf("when getting docker image description for %s, an empty description was returned", container.Image)
+			return nil, fmt.Errorf("when getting image configuration for %s, an empty configuration was returned", container.Image)
 		}
 
-		if image.Config.Entrypoint != nil {
-			log.Infof("found entrypoint: %v", []string(image.Config.Entrypoint))
-			cmd = append(cmd, []string(image.Config.Entrypoint)...)
+		if image.Entrypoint != nil {
+			log.Infof("found entrypoint: %v", image.Entrypoint)
+			cmd = append(cmd, image.Entrypoint...)
 		} else {
-			if image.Config.Cmd != nil {
-				log.Infof("using cmd from image: %v", []string(image.Config.Cmd))
-				cmd = append(cmd, []string(image.Config.Cmd)...)
+			if image.Cmd != nil {
+				log.Infof("using cmd from image: %v", image.Cmd)
+				cmd = append(cmd, image.Cmd...)
 			}
 		}
 	}
@@ -272,244 +296,154 @@ func getContainerCmd(container corev1.Container, creds string) ([]string, error)
 		cmd = append(cmd, container.Args...)
 	} else {
 		if image == nil {
-			log.Infof("getting docker image %s", container.Image)
-			image, err = getDockerImage(container, creds)
+			log.Infof("getting image configuration of %s", container.Image)
+			image, err = getImageConfig(container, creds, platform)
 			if err != nil {
 				return nil, err
 			}
 
 			if image == nil {
-				return nil, fmt.Errorf("when getting docker image description for %s, an empty description was returned", container.Image)
+				return nil, fmt.Errorf("when getting image configuration for %s, an empty configuration was returned", container.Image)
 			}
 		}
 
 		// if container.Command is set it will override image.Cmd
-		if container.Command == nil && image.Config.Cmd != nil {
-			log.Infof("using cmd from image: %v", []string(image.Config.Cmd))
-			cmd = append(cmd, []string(image.Config.Cmd)...)
+		if container.Command == nil && image.Cmd != nil {
+			log.Infof("using cmd from image: %v", image.Cmd)
+			cmd = append(cmd, image.Cmd...)
 		}
 	}
 
 	return cmd, nil
 }
 
-func getDockerImage(container corev1.Container, creds string) (*dockertypes.ImageInspect, error) {
+func getImageConfig(container corev1.Container, creds *registryCredentials, platform imagePlatform) (*imageConfig, error) {
 	timeout := time.Duration(config.dockerPullTimeout) * time.Second
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	opt := dockertypes.ImagePullOptions{
-		RegistryAuth: creds,
-	}
-
-	cli, err := dockerclient.NewEnvClient()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create docker client, error: %+v", err)
-	}
-
-	named, err := dockerref.ParseNormalizedNamed(container.Image)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse image name, error: %+v", err)
-	}
-
-	imageName := named.Name()
-
-	if !strings.Contains(imageName, "/") {
-		imageName = "docker.io/library/" + imageName
-	}
-
-	// pull image in case its not present on host yet
-	log.Infof("pulling docker image %s to get entrypoint and cmd, timeout is %d seconds", imageName, timeout/time.Second)
-	imgReader, err := cli.ImagePull(ctx, imageName, opt)
+	log.Infof("getting configuration of image %s from registry to get entrypoint and cmd, timeout is %d seconds", container.Image, timeout/time.Second)
+	image, err := imageRegistry.getImageConfig(ctx, container.Image, creds, platform)
 	if err != nil {
-		return nil, fmt.Errorf("failed to pull docker image '%s', error: %+v", imageName, err)
+		return nil, fmt.Errorf("failed to get configuration of image '%s', error: %+v", container.Image, err)
 	}
+	return image, nil
+}
 
-	if ctx.Err() != nil {
-		return nil, ctx.Err()
-	}
-
-	imgPullOutput, err := ioutil.ReadAll(imgReader)
-	log.Debugf("docker pull image output: %s", imgPullOutput)
-	// io.Copy(os.Stdout, imgReader)
-
-	log.Infof("docker image %s pulled successfully", imageName)
-	defer imgReader.Close()
-
-	log.Infof("inspecting container image %s, looking for entrypoint and cmd", imageName)
-	inspect, _, err := cli.ImageInspectWithRaw(ctx, imageName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to inspect docker image '%s', error: %+v", imageName, err)
+// getPodPlatform returns the platform the containers of a pod run on, from the node the
+// pod is assigned to or its node selector. Defaults to the platform of the webhook.
+func getPodPlatform(clientset kubernetes.Interface, podSpec *corev1.PodSpec) imagePlatform {
+	platform := imagePlatform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
 	}
 
-	if ctx.Err() != nil {
-		return nil, ctx.Err()
+	if podSpec.NodeName != "" {
+		node, err := clientset.CoreV1().Nodes().Get(podSpec.NodeName, metav1.GetOptions{})
+		if err == nil {
+			platform.OS = node.Status.NodeInfo.OperatingSystem
+			platform.Architecture = node.Status.NodeInfo.Architecture
+			return platform
+		}
+		log.Warnf("failed to get node '%s' to find platform of pod, error: %+v", podSpec.NodeName, err)
 	}
 
-	return &inspect, nil
-}
-
-func getRegistryCreds(clientset kubernetes.Clientset, podSpec *corev1.PodSpec) (map[string]string, error) {
-	creds := make(map[string]string)
-
-	var conf struct {
-		Auths map[string]struct {
-			Auth string
+	for _, label := range []string{"beta.kubernetes.io/os", "kubernetes.io/os"} {
+		if value, ok := podSpec.NodeSelector[label]; ok {
+			platform.OS = value
 		}
 	}
-
-	var decoded []byte
-	var ok bool
-	if podSpec.ImagePullSecrets != nil {
-		for _, secret := range podSpec.ImagePullSecrets {
-			secret, err := clientset.CoreV1().Secrets(config.namespace).Get(secret.Name, metav1.GetOptions{})
-			if err != nil {
-				return creds, err
-			}
-
-			switch secret.Type {
-			case corev1.SecretTypeDockerConfigJson:
-				decoded, ok = secret.Data[corev1.DockerConfigJsonKey]
-			default:
-				return creds, fmt.Errorf("unable to load image pull secret '%s', only type '%s' is supported", secret.Name, secret.Type)
-			}
-
-			if !ok {
-				continue
-			}
-
-			if err := json.Unmarshal(decoded, &conf); err != nil {
-				return creds, err
-			}
-
-			// If it's in k8s format, it won't have the surrounding "Auth". Try that too.
-			if len(conf.Auths) == 0 {
-				if err := json.Unmarshal(decoded, &conf.Auths); err != nil {
-					return creds, err
-				}
-			}
-
-			for host, entry := range conf.Auths {
-				decodedAuth, err := base64.StdEncoding.DecodeString(entry.Auth)
-				if err != nil {
-					return creds, err
-				}
-
-				authParts := strings.SplitN(string(decodedAuth), ":", 2)
-				if len(authParts) != 2 {
-					return creds, fmt.Errorf("decoded credential has wrong number of fields (expected 2, got %d)", len(authParts))
-				}
-
-				credsValue := dockertypes.AuthConfig{
-					Username: authParts[0],
-					Password: authParts[1],
-				}
-				encodedJSON, err := json.Marshal(credsValue)
-				if err != nil {
-					return creds, err
-				}
-
-				creds[host] = base64.URLEncoding.EncodeToString(encodedJSON)
-			}
+	for _, label := range []string{"beta.kubernetes.io/arch", "kubernetes.io/arch"} {
+		if value, ok := podSpec.NodeSelector[label]; ok {
+			platform.Architecture = value
 		}
 	}
-	return creds, nil
+	return platform
 }
 
-func getAcrCreds(host string) (string, bool) {
-	if !hostIsAzureContainerRegistry(host) {
-		log.Infof("registry host '%s' is not a acr registry", host)
-		return "", false
+// mutatePodSpec injects env vars into the containers of a pod being admitted in namespace
+func mutatePodSpec(pod *corev1.Pod, namespace string) error {
+	podSpec := &pod.Spec
+
+	if podInjectionDisabled(pod) {
+		log.Infof("pod is annotated with '%s: %s', skipping", injectionLabel, injectionDisabled)
+		return nil
 	}
 
-	bytes, err := ioutil.ReadFile(config.cloudConfigHostPath)
+	kubeConfig, err := rest.InClusterConfig()
 	if err != nil {
-		log.Infof("failed to read azure.json to get default credentials, error: %v", err)
-		return "", false //creds, fmt.Errorf("failed to read cloud config file in an effort to get credentials for azure key vault, error: %+v", err)
+		return err
 	}
 
-	azureConfig := auth.AzureAuthConfig{}
-	if err = yaml.Unmarshal(bytes, &azureConfig); err != nil {
-		log.Infof("failed to unmarshall azure config, error: %v", err)
-		return "", false // creds, fmt.Errorf("Unmarshall error: %v", err)
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
 	}
 
-	var credsValue dockertypes.AuthConfig
-	if azureConfig.AADClientID != "" {
-		log.Infof("using default credentials for docker registry with clientid: %s", azureConfig.AADClientID)
-		credsValue = dockertypes.AuthConfig{
-			Username: azureConfig.AADClientID,
-			Password: azureConfig.AADClientSecret,
+	if config.policy.usesNamespaceLabels() {
+		ns, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get namespace '%s' to check if env injection is enabled, error: %+v", namespace, err)
 		}
-	} else {
-		log.Info("aadclientid is not set i azure config, so have no credentials to use")
-		return "", false // nil, fmt.Errorf("Failed to find credentials for docker registry '%s'", regHost)
-	}
 
-	encodedJSON, err := json.Marshal(credsValue)
-	if err != nil {
-		log.Errorf("failed to marshall credentials, error: %v\n", err)
-		return "", false // creds, err
+		if !config.policy.namespaceEnabled(ns) {
+			log.Infof("env injection is not enabled for namespace '%s' (namespace policy is %s), skipping", namespace, config.policy.namespacePolicy)
+			return nil
+		}
 	}
-	return base64.URLEncoding.EncodeToString(encodedJSON), true
-}
 
-func hostIsAzureContainerRegistry(host string) bool {
-	for _, v := range []string{".azurecr.io", ".azurecr.cn", ".azurecr.de", ".azurecr.us"} {
-		if strings.HasSuffix(host, v) {
-			return true
+	if config.policy.usesVaultNamespaces() {
+		azureKeyVaultSecretClient, err := akvClientset.NewForConfig(kubeConfig)
+		if err != nil {
+			return err
 		}
-	}
-	return false
-}
 
-func mutatePodSpec(pod *corev1.Pod) error {
-	podSpec := &pod.Spec
+		getAzureKeyVaultSecret := func(name string) (*akv.AzureKeyVaultSecret, error) {
+			return azureKeyVaultSecretClient.AzurekeyvaultV1alpha1().AzureKeyVaultSecrets(namespace).Get(name, metav1.GetOptions{})
+		}
 
-	kubeConfig, err := rest.InClusterConfig()
-	if err != nil {
-		return err
+		containers := append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...)
+		if err := config.policy.checkVaults(namespace, containers, getAzureKeyVaultSecret); err != nil {
+			return err
+		}
 	}
 
-	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	regCred, err := getRegistryCreds(clientset, namespace, podSpec)
 	if err != nil {
 		return err
 	}
 
-	regCred, err := getRegistryCreds(*clientset, podSpec)
-	if err != nil {
-		return err
-	}
+	platform := getPodPlatform(clientset, podSpec)
 
-	initContainersMutated, err := mutateContainers(podSpec.InitContainers, regCred)
+	initContainersMutated, err := mutateContainers(podSpec.InitContainers, regCred, platform)
 	if err != nil {
 		return err
 	}
 
-	containersMutated, err := mutateContainers(podSpec.Containers, regCred)
+	containersMutated, err := mutateContainers(podSpec.Containers, regCred, platform)
 	if err != nil {
 		return err
 	}
 
 	if initContainersMutated || containersMutated {
-		if config.namespace != "" && config.customAuth && config.customAuthAutoInject {
+		if namespace != "" && config.customAuth && config.customAuthAutoInject {
 			if config.credentials.CredentialsType == CredentialsTypeManagedIdentitiesForAzureResources {
 				if pod.Labels == nil {
 					pod.Labels = make(map[string]string)
 					pod.Labels["aadpodidbinding"] = config.aadPodBindingLabel
 				}
 			} else {
-				log.Infof("creating secret in new namespace '%s'...", config.namespace)
+				log.Infof("creating secret in new namespace '%s'...", namespace)
 
 				keyVaultSecret, err := config.credentials.GetKubernetesSecret(config.credentialsSecretName)
 				if err != nil {
 					return err
 				}
 
-				_, err = clientset.CoreV1().Secrets(config.namespace).Create(keyVaultSecret)
+				_, err = clientset.CoreV1().Secrets(namespace).Create(keyVaultSecret)
 				if err != nil {
 					if errors.IsAlreadyExists(err) {
-						_, err = clientset.CoreV1().Secrets(config.namespace).Update(keyVaultSecret)
+						_, err = clientset.CoreV1().Secrets(namespace).Update(keyVaultSecret)
 						if err != nil {
 							return err
 						}
@@ -533,6 +467,10 @@ func mutatePodSpec(pod *corev1.Pod) error {
 func initConfig() {
 	viper.SetDefault("azurekeyvault_env_image", "spvest/azure-keyvault-env:latest")
 	viper.SetDefault("custom_docker_pull_timeout", 120)
+	viper.SetDefault("health_addr", ":8080")
+	viper.SetDefault("metrics_addr", ":9000")
+	viper.SetDefault("image_cache_size", 1000)
+	viper.SetDefault("image_cache_ttl", 5*time.Minute)
 	viper.AutomaticEnv()
 }
 
@@ -566,10 +504,20 @@ func main() {
 		customAuthAutoInject:     viper.GetBool("CUSTOM_AUTH_INJECT"),
 		credentialsSecretName:    viper.GetString("CUSTOM_AUTH_INJECT_SECRET_NAME"),
 		dockerPullTimeout:        viper.GetInt("CUSTOM_DOCKER_PULL_TIMEOUT"),
+		cloudEnvironment:         viper.GetString("AZURE_ENVIRONMENT"),
+		vaultBackend:             viper.GetString("VAULT_BACKEND"),
+		vaultLocalPath:           viper.GetString("VAULT_LOCAL_PATH"),
 		cloudConfigHostPath:      "/etc/kubernetes/azure.json",
 		cloudConfigContainerPath: "/azure-keyvault/azure.json",
 	}
 
+	policy, err := newInjectionPolicy(viper.GetString("INJECTION_NAMESPACE_POLICY"), viper.GetString("VAULT_NAMESPACES"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating injection policy: %s", err)
+		os.Exit(1)
+	}
+	config.policy = policy
+
 	if config.customAuth {
 		azureCreds, err := NewCredentials()
 		if err != nil {
@@ -584,6 +532,12 @@ func main() {
 		}
 	}
 
+	var imageCache *imageConfigCache
+	if cacheSize := viper.GetInt("IMAGE_CACHE_SIZE"); cacheSize > 0 {
+		imageCache = newImageConfigCache(cacheSize, viper.GetDuration("IMAGE_CACHE_TTL"))
+	}
+	imageRegistry = newRegistryClient(imageCache, time.Duration(config.dockerPullTimeout)*time.Second)
+
 	mutator := mutating.MutatorFunc(vaultSecretsMutator)
 
 	podHandler := handlerFor(mutating.WebhookConfig{Name: "azurekeyvault-secrets-pods", Obj: &corev1.Pod{}}, mutator, logger)
@@ -591,8 +545,17 @@ func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/pods", podHandler)
 
+	healthClientset, err := newHealthClientset()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating kubernetes client for health probes: %s", err)
+		os.Exit(1)
+	}
+
+	go serveMetrics(viper.GetString("metrics_addr"))
+	go serveHealth(viper.GetString("health_addr"), newHealthHandler(viper.GetString("tls_cert_file"), viper.GetString("tls_private_key_file"), healthClientset))
+
 	logger.Infof("listening on :443")
-	err := http.ListenAndServeTLS(":443", viper.GetString("tls_cert_file"), viper.GetString("tls_private_key_file"), mux)
+	err = http.ListenAndServeTLS(":443", viper.GetString("tls_cert_file"), viper.GetString("tls_private_key_file"), mux)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error serving webhook: %s", err)
 		os.Exit(1)
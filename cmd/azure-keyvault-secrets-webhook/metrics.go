@@ -0,0 +1,66 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metricsNamespace = "akv2k8s"
+	metricsSubsystem = "env_injector"
+
+	metricsResultHit  = "hit"
+	metricsResultMiss = "miss"
+)
+
+var imageCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: metricsSubsystem,
+	Name:      "image_cache_lookups_total",
+	Help:      "Total number of image configurations looked up in the image cache, by whether they were cached.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(imageCacheLookups)
+}
+
+// recordImageCacheLookup counts a lookup in the image cache as a hit or a miss
+func recordImageCacheLookup(hit bool) {
+	result := metricsResultMiss
+	if hit {
+		result = metricsResultHit
+	}
+	imageCacheLookups.WithLabelValues(result).Inc()
+}
+
+func serveMetrics(addr string) {
+	if addr == "" {
+		log.Info("metrics disabled")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("error serving metrics: %s", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/policy"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+const (
+	// injectionLabel is the label on namespaces, and the annotation on pods, enabling or
+	// disabling env injection
+	injectionLabel = "azure-key-vault-env-injection"
+
+	injectionEnabled  = "enabled"
+	injectionDisabled = "disabled"
+
+	// namespacePolicyOptIn only injects into pods in namespaces labeled with
+	// injectionLabel=enabled
+	namespacePolicyOptIn = "opt-in"
+
+	// namespacePolicyOptOut injects into pods in all namespaces, except those labeled
+	// with injectionLabel=disabled
+	namespacePolicyOptOut = "opt-out"
+)
+
+// injectionPolicy decides which pods env vars are injected into, and which vaults the
+// AzureKeyVaultSecrets they use can point to
+type injectionPolicy struct {
+	// namespacePolicy is namespacePolicyOptIn, namespacePolicyOptOut or empty to inject
+	// into pods in all namespaces the webhook is called for
+	namespacePolicy string
+
+	// vaultNamespaces are the namespaces allowed to use each vault, as given in
+	// vaultNamespacesValue. The value is passed on to the env injector in pods, which
+	// checks the vaults again when reading them.
+	vaultNamespaces      policy.VaultNamespaces
+	vaultNamespacesValue string
+}
+
+// newInjectionPolicy creates a policy from the namespace policy and the namespaces
+// allowed to use each vault, like 'vault-a=team-a;vault-b=team-b,team-c'
+func newInjectionPolicy(namespacePolicy, vaultNamespaces string) (*injectionPolicy, error) {
+	switch namespacePolicy {
+	case "", namespacePolicyOptIn, namespacePolicyOptOut:
+	default:
+		return nil, fmt.Errorf("invalid namespace policy '%s', must be '%s' or '%s'", namespacePolicy, namespacePolicyOptIn, namespacePolicyOptOut)
+	}
+
+	vaultNamespacesPolicy, err := policy.ParseVaultNamespaces(vaultNamespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	return &injectionPolicy{
+		namespacePolicy:      namespacePolicy,
+		vaultNamespaces:      vaultNamespacesPolicy,
+		vaultNamespacesValue: vaultNamespaces,
+	}, nil
+}
+
+// usesNamespaceLabels returns true if the labels of the namespace of pods are needed
+func (p *injectionPolicy) usesNamespaceLabels() bool {
+	return p.namespacePolicy != ""
+}
+
+// usesVaultNamespaces returns true if the vaults of AzureKeyVaultSecrets must be checked
+func (p *injectionPolicy) usesVaultNamespaces() bool {
+	return len(p.vaultNamespaces) > 0
+}
+
+// namespaceEnabled returns true if env vars can be injected into pods in the namespace
+func (p *injectionPolicy) namespaceEnabled(namespace *corev1.Namespace) bool {
+	switch p.namespacePolicy {
+	case namespacePolicyOptIn:
+		return namespace.Labels[injectionLabel] == injectionEnabled
+	case namespacePolicyOptOut:
+		return namespace.Labels[injectionLabel] != injectionDisabled
+	default:
+		return true
+	}
+}
+
+// checkVaults returns an error if any AzureKeyVaultSecret used by the containers of a pod
+// in the namespace uses a vault the namespace is not allowed to use
+func (p *injectionPolicy) checkVaults(namespace string, containers []corev1.Container, getAzureKeyVaultSecret func(name string) (*akv.AzureKeyVaultSecret, error)) error {
+	for _, name := range getAzureKeyVaultSecretNames(containers) {
+		azureKeyVaultSecret, err := getAzureKeyVaultSecret(name)
+		if err != nil {
+			return fmt.Errorf("failed to get AzureKeyVaultSecret '%s' to check its vault, error: %+v", name, err)
+		}
+
+		if !p.vaultNamespaces.Allowed(azureKeyVaultSecret.Spec.Vault.Name, namespace) {
+			return fmt.Errorf("AzureKeyVaultSecret '%s' uses vault '%s', which namespace '%s' is not allowed to use", name, azureKeyVaultSecret.Spec.Vault.Name, namespace)
+		}
+	}
+	return nil
+}
+
+// podInjectionDisabled returns true if the pod is annotated to skip env injection
+func podInjectionDisabled(pod *corev1.Pod) bool {
+	return pod.Annotations[injectionLabel] == injectionDisabled
+}
+
+// getAzureKeyVaultSecretNames returns the sorted names of the AzureKeyVaultSecrets used
+// in env vars of containers, like my-akv-secret-name@azurekeyvault?some-sub-key
+func getAzureKeyVaultSecretNames(containers []corev1.Container) []string {
+	names := make(map[string]bool)
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if !strings.Contains(env.Value, envVarReplacementKey) {
+				continue
+			}
+
+			name := strings.Join(strings.Split(env.Value, envVarReplacementKey), "")
+			name = strings.SplitN(name, "?", 2)[0]
+			if name != "" {
+				names[name] = true
+			}
+		}
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
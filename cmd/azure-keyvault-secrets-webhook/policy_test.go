@@ -0,0 +1,120 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func namespaceWithLabels(labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "some-namespace", Labels: labels}}
+}
+
+func TestNamespaceEnabled(t *testing.T) {
+	enabled := namespaceWithLabels(map[string]string{injectionLabel: injectionEnabled})
+	disabled := namespaceWithLabels(map[string]string{injectionLabel: injectionDisabled})
+	unlabeled := namespaceWithLabels(nil)
+
+	for _, test := range []struct {
+		namespacePolicy string
+		namespace       *corev1.Namespace
+		expected        bool
+	}{
+		{namespacePolicyOptIn, enabled, true},
+		{namespacePolicyOptIn, unlabeled, false},
+		{namespacePolicyOptIn, disabled, false},
+		{namespacePolicyOptOut, enabled, true},
+		{namespacePolicyOptOut, unlabeled, true},
+		{namespacePolicyOptOut, disabled, false},
+		{"", disabled, true},
+	} {
+		policy, err := newInjectionPolicy(test.namespacePolicy, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enabled := policy.namespaceEnabled(test.namespace); enabled != test.expected {
+			t.Errorf("expected namespace with labels %v to be enabled=%t with policy '%s', but got %t", test.namespace.Labels, test.expected, test.namespacePolicy, enabled)
+		}
+	}
+
+	if _, err := newInjectionPolicy("opt-sideways", ""); err == nil {
+		t.Error("expected error for invalid namespace policy")
+	}
+}
+
+func TestCheckVaults(t *testing.T) {
+	policy, err := newInjectionPolicy("", "Team-B-Vault=team-b, team-c;shared-vault=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vaults := map[string]string{
+		"team-b-secret": "team-b-vault",
+		"shared-secret": "shared-vault",
+		"other-secret":  "other-vault",
+	}
+	getAzureKeyVaultSecret := func(name string) (*akv.AzureKeyVaultSecret, error) {
+		vault, ok := vaults[name]
+		if !ok {
+			return nil, fmt.Errorf("not found")
+		}
+		return &akv.AzureKeyVaultSecret{Spec: akv.AzureKeyVaultSecretSpec{Vault: akv.AzureKeyVault{Name: vault}}}, nil
+	}
+
+	containers := func(values ...string) []corev1.Container {
+		var env []corev1.EnvVar
+		for _, value := range values {
+			env = append(env, corev1.EnvVar{Name: "SOME_VAR", Value: value})
+		}
+		return []corev1.Container{{Name: "some-container", Env: env}}
+	}
+
+	for _, test := range []struct {
+		namespace  string
+		containers []corev1.Container
+		allowed    bool
+	}{
+		{"team-b", containers("team-b-secret@azurekeyvault"), true},
+		{"team-c", containers("team-b-secret@azurekeyvault?tls.crt", "other-secret@azurekeyvault"), true},
+		{"team-a", containers("other-secret@azurekeyvault", "team-b-secret@azurekeyvault"), false},
+		{"team-b", containers("shared-secret@azurekeyvault"), false},
+		{"team-b", containers("missing-secret@azurekeyvault"), false},
+		{"team-a", containers("not-a-reference"), true},
+	} {
+		err := policy.checkVaults(test.namespace, test.containers, getAzureKeyVaultSecret)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("expected %v in namespace '%s' to be allowed=%t, but got error: %v", test.containers[0].Env, test.namespace, test.allowed, err)
+		}
+	}
+}
+
+func TestGetAzureKeyVaultSecretNames(t *testing.T) {
+	containers := []corev1.Container{
+		{Env: []corev1.EnvVar{{Value: "my-secret@azurekeyvault"}, {Value: "my-cert@azurekeyvault?tls.key"}}},
+		{Env: []corev1.EnvVar{{Value: "my-secret@azurekeyvault"}, {Value: "plain value"}}},
+	}
+
+	expected := []string{"my-cert", "my-secret"}
+	if names := getAzureKeyVaultSecretNames(containers); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected names %v but got %v", expected, names)
+	}
+}
@@ -0,0 +1,500 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	dockerref "github.com/docker/distribution/reference"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+
+	// dockerHubRegistryHost is where the registry API of Docker Hub is served
+	dockerHubRegistryHost = "registry-1.docker.io"
+
+	// maxManifestSize and maxImageConfigSize limit how much is read from a registry
+	maxManifestSize    = 4 << 20
+	maxImageConfigSize = 8 << 20
+)
+
+// registryCredentials are the username and password used to authenticate with a registry
+type registryCredentials struct {
+	Username string
+	Password string
+}
+
+// cacheScope identifies the credentials in cache keys, so configurations of private
+// images are only shared between pods using the same credentials
+func (c *registryCredentials) cacheScope() string {
+	if c == nil {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(c.Username + "\x00" + c.Password))
+	return hex.EncodeToString(sum[:])
+}
+
+// imagePlatform is the operating system and cpu architecture an image is run on
+type imagePlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p imagePlatform) String() string {
+	platform := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		platform = platform + "/" + p.Variant
+	}
+	return platform
+}
+
+// imageConfig is the part of an image configuration used to find the command of a container
+type imageConfig struct {
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+}
+
+type manifestDescriptor struct {
+	MediaType string         `json:"mediaType"`
+	Digest    string         `json:"digest"`
+	Platform  *imagePlatform `json:"platform,omitempty"`
+}
+
+// imageManifest is either an image manifest or a manifest list (image index), which
+// are told apart by the media type
+type imageManifest struct {
+	MediaType string               `json:"mediaType"`
+	Config    manifestDescriptor   `json:"config"`
+	Manifests []manifestDescriptor `json:"manifests"`
+}
+
+// registryClient reads image manifests and configurations using the OCI Distribution
+// API, without pulling the image layers. Configurations are cached when cache is set.
+type registryClient struct {
+	client  *http.Client
+	cache   *imageConfigCache
+	timeout time.Duration
+}
+
+func newRegistryClient(cache *imageConfigCache, timeout time.Duration) *registryClient {
+	return &registryClient{
+		client:  http.DefaultClient,
+		cache:   cache,
+		timeout: timeout,
+	}
+}
+
+// getImageConfig returns the configuration of an image for the given platform, fetching
+// only the manifest and config blob of the image from its registry. Concurrent requests
+// for an image not cached with the same credentials are sent as one, which is not
+// cancelled with ctx as other requests may be waiting for it.
+func (r *registryClient) getImageConfig(ctx context.Context, image string, creds *registryCredentials, platform imagePlatform) (*imageConfig, error) {
+	named, err := dockerref.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image name, error: %+v", err)
+	}
+	named = dockerref.TagNameOnly(named)
+
+	if r.cache == nil {
+		return r.resolveImageConfig(ctx, named, creds, platform)
+	}
+
+	scope := creds.cacheScope()
+	if config, ok := r.cache.getByReference(scope, named.String(), platform); ok {
+		log.Infof("using cached configuration of image %s for platform %s", image, platform)
+		recordImageCacheLookup(true)
+		return config, nil
+	}
+	recordImageCacheLookup(false)
+
+	result := r.cache.group.DoChan(imageReferenceCacheKey(scope, named.String(), platform), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+		return r.resolveImageConfig(ctx, named, creds, platform)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to get configuration of image %s, error: %+v", image, ctx.Err())
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*imageConfig), nil
+	}
+}
+
+// resolveImageConfig gets the configuration of an image from its registry, unless the
+// configuration is cached by the digest of the manifest the image reference points to
+func (r *registryClient) resolveImageConfig(ctx context.Context, named dockerref.Named, creds *registryCredentials, platform imagePlatform) (*imageConfig, error) {
+	image := dockerref.FamiliarString(named)
+
+	reference := "latest"
+	digested, isDigested := named.(dockerref.Digested)
+	if isDigested {
+		reference = digested.Digest().String()
+	} else if tagged, ok := named.(dockerref.Tagged); ok {
+		reference = tagged.Tag()
+	}
+
+	host := dockerref.Domain(named)
+	if normalizeRegistryHost(host) == dockerHubHost {
+		host = dockerHubRegistryHost
+	}
+
+	repo := &registryRepository{
+		client:      r.client,
+		host:        host,
+		name:        dockerref.Path(named),
+		credentials: creds,
+	}
+
+	log.Infof("getting manifest of image %s from registry %s", image, host)
+	manifest, digest, err := repo.getManifest(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	isManifestList := manifest.MediaType == mediaTypeDockerManifestList || manifest.MediaType == mediaTypeOCIIndex
+	if isManifestList {
+		descriptor, err := selectPlatformManifest(manifest.Manifests, platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find image %s for platform %s, error: %+v", image, platform, err)
+		}
+
+		log.Infof("using manifest %s of image %s for platform %s", descriptor.Digest, image, platform)
+		digest = descriptor.Digest
+	}
+
+	scope := creds.cacheScope()
+	if r.cache != nil {
+		if config, ok := r.cache.getByDigest(scope, named.Name(), digest); ok {
+			log.Infof("using cached configuration of image %s with digest %s", image, digest)
+			r.cache.addByReference(scope, named.String(), platform, isDigested, config)
+			return config, nil
+		}
+	}
+
+	if isManifestList {
+		manifest, _, err = repo.getManifest(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest.MediaType != mediaTypeDockerManifest && manifest.MediaType != mediaTypeOCIManifest {
+		return nil, fmt.Errorf("image %s has manifest of unsupported media type '%s'", image, manifest.MediaType)
+	}
+
+	blob, err := repo.getBlob(ctx, manifest.Config.Digest, maxImageConfigSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Config imageConfig `json:"config"`
+	}
+	if err := json.Unmarshal(blob, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration of image %s, error: %+v", image, err)
+	}
+
+	if r.cache != nil {
+		r.cache.addByDigest(scope, named.Name(), digest, &config.Config)
+		r.cache.addByReference(scope, named.String(), platform, isDigested, &config.Config)
+	}
+	return &config.Config, nil
+}
+
+// selectPlatformManifest returns the manifest in a manifest list matching the platform.
+// The variant only has to match when set on the platform.
+func selectPlatformManifest(manifests []manifestDescriptor, platform imagePlatform) (*manifestDescriptor, error) {
+	for i, manifest := range manifests {
+		if manifest.Platform == nil {
+			continue
+		}
+		if manifest.Platform.OS != platform.OS || manifest.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && manifest.Platform.Variant != platform.Variant {
+			continue
+		}
+		return &manifests[i], nil
+	}
+	return nil, fmt.Errorf("no manifest found for platform %s", platform)
+}
+
+// registryRepository is an image repository in a registry, authenticating requests using
+// the challenge given by the registry
+type registryRepository struct {
+	client        *http.Client
+	host          string
+	name          string
+	credentials   *registryCredentials
+	authorization string
+}
+
+// getManifest returns the manifest with the reference and its digest
+func (r *registryRepository) getManifest(ctx context.Context, reference string) (*imageManifest, string, error) {
+	accept := []string{mediaTypeOCIIndex, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeDockerManifest}
+	body, mediaType, err := r.get(ctx, "manifests/"+reference, accept, maxManifestSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.HasPrefix(reference, "sha256:") {
+		if err := verifyDigest(reference, body); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var manifest imageManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to parse manifest '%s' of image %s/%s, error: %+v", reference, r.host, r.name, err)
+	}
+
+	// The media type of the manifest is optional in the manifest itself
+	if manifest.MediaType == "" {
+		manifest.MediaType = mediaType
+	}
+
+	sum := sha256.Sum256(body)
+	return &manifest, "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func (r *registryRepository) getBlob(ctx context.Context, digest string, maxSize int64) ([]byte, error) {
+	body, _, err := r.get(ctx, "blobs/"+digest, nil, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyDigest(digest, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// get requests a path in the repository, authenticating and retrying once if the
+// registry requires it
+func (r *registryRepository) get(ctx context.Context, path string, accept []string, maxSize int64) ([]byte, string, error) {
+	reqURL := fmt.Sprintf("https://%s/v2/%s/%s", r.host, r.name, path)
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		req = req.WithContext(ctx)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if r.authorization != "" {
+			req.Header.Set("Authorization", r.authorization)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get %s, error: %+v", reqURL, err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+
+			if err := r.authorize(ctx, challenge); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+
+		body, err := readResponse(resp, maxSize)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get %s, error: %+v", reqURL, err)
+		}
+		return body, resp.Header.Get("Content-Type"), nil
+	}
+}
+
+// authorize sets the authorization used with the registry from its authentication
+// challenge, getting a bearer token from the token service of the registry if required
+func (r *registryRepository) authorize(ctx context.Context, challenge string) error {
+	scheme, params := parseAuthChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.credentials == nil {
+			return fmt.Errorf("registry %s requires credentials, but none were found", r.host)
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(r.credentials.Username, r.credentials.Password)
+		r.authorization = req.Header.Get("Authorization")
+		return nil
+
+	case "bearer":
+		token, err := r.getToken(ctx, params)
+		if err != nil {
+			return err
+		}
+		r.authorization = "Bearer " + token
+		return nil
+
+	default:
+		return fmt.Errorf("registry %s requires unsupported authentication '%s'", r.host, challenge)
+	}
+}
+
+// getToken gets a bearer token from the token service given in the challenge of a
+// registry, using the credentials when there are any
+func (r *registryRepository) getToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("registry %s gave invalid token realm '%s'", r.host, params["realm"])
+	}
+
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", r.name)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if r.credentials != nil {
+		req.SetBasicAuth(r.credentials.Username, r.credentials.Password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get token for registry %s, error: %+v", r.host, err)
+	}
+
+	body, err := readResponse(resp, maxManifestSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to get token for registry %s, error: %+v", r.host, err)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("failed to parse token from registry %s, error: %+v", r.host, err)
+	}
+
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", fmt.Errorf("registry %s returned an empty token", r.host)
+}
+
+// readResponse reads the body of a successful response, failing when it is larger than maxSize
+func readResponse(resp *http.Response, maxSize int64) ([]byte, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxSize))
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("response larger than %d bytes", maxSize)
+	}
+	return body, nil
+}
+
+// verifyDigest checks that content matches a sha256 digest
+func verifyDigest(digest string, content []byte) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("unsupported digest '%s'", digest)
+	}
+
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != strings.TrimPrefix(digest, "sha256:") {
+		return fmt.Errorf("content does not match digest '%s'", digest)
+	}
+	return nil
+}
+
+// parseAuthChallenge parses the scheme and parameters of a WWW-Authenticate header, like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+
+	challenge = strings.TrimSpace(challenge)
+	parts := strings.SplitN(challenge, " ", 2)
+	if len(parts) < 2 {
+		return challenge, params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", ")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end+1:]
+			}
+		}
+		params[key] = strings.TrimSpace(value)
+	}
+	return parts[0], params
+}
@@ -0,0 +1,193 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	dockerref "github.com/docker/distribution/reference"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// dockerConfigEntry is the credentials of a registry in a docker config
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// getRegistryCreds returns the credentials of the image pull secrets of a pod and of its
+// service account, by normalized registry host. When several secrets have credentials
+// for the same registry, the first one is used, starting with those of the pod.
+func getRegistryCreds(clientset kubernetes.Interface, namespace string, podSpec *corev1.PodSpec) (map[string]registryCredentials, error) {
+	creds := make(map[string]registryCredentials)
+
+	for _, secretName := range getImagePullSecretNames(clientset, namespace, podSpec) {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				log.Warnf("image pull secret '%s' not found in namespace '%s'", secretName, namespace)
+				continue
+			}
+			return creds, err
+		}
+
+		var secretCreds map[string]registryCredentials
+		switch secret.Type {
+		case corev1.SecretTypeDockerConfigJson:
+			secretCreds, err = parseDockerConfigJSON(secret.Data[corev1.DockerConfigJsonKey])
+		case corev1.SecretTypeDockercfg:
+			secretCreds, err = parseDockercfg(secret.Data[corev1.DockerConfigKey])
+		default:
+			log.Warnf("ignoring image pull secret '%s' of unsupported type '%s'", secretName, secret.Type)
+			continue
+		}
+
+		if err != nil {
+			log.Warnf("ignoring image pull secret '%s', error: %+v", secretName, err)
+			continue
+		}
+
+		for host, cred := range secretCreds {
+			if _, ok := creds[host]; !ok {
+				creds[host] = cred
+			}
+		}
+	}
+	return creds, nil
+}
+
+// getImagePullSecretNames returns the names of the image pull secrets of a pod followed
+// by those of its service account
+func getImagePullSecretNames(clientset kubernetes.Interface, namespace string, podSpec *corev1.PodSpec) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(refs []corev1.LocalObjectReference) {
+		for _, ref := range refs {
+			if ref.Name != "" && !seen[ref.Name] {
+				seen[ref.Name] = true
+				names = append(names, ref.Name)
+			}
+		}
+	}
+
+	add(podSpec.ImagePullSecrets)
+
+	serviceAccountName := podSpec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+
+	serviceAccount, err := clientset.CoreV1().ServiceAccounts(namespace).Get(serviceAccountName, metav1.GetOptions{})
+	if err != nil {
+		log.Warnf("failed to get service account '%s' to find its image pull secrets, error: %+v", serviceAccountName, err)
+		return names
+	}
+
+	add(serviceAccount.ImagePullSecrets)
+	return names
+}
+
+// parseDockerConfigJSON parses the credentials in a docker config.json, as stored in
+// secrets of type kubernetes.io/dockerconfigjson
+func parseDockerConfigJSON(data []byte) (map[string]registryCredentials, error) {
+	var conf struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, err
+	}
+
+	// If it's in k8s format, it won't have the surrounding "auths". Try that too.
+	if len(conf.Auths) == 0 {
+		return parseDockercfg(data)
+	}
+	return getDockerConfigCreds(conf.Auths)
+}
+
+// parseDockercfg parses the credentials in a legacy .dockercfg, as stored in secrets
+// of type kubernetes.io/dockercfg
+func parseDockercfg(data []byte) (map[string]registryCredentials, error) {
+	var auths map[string]dockerConfigEntry
+	if err := json.Unmarshal(data, &auths); err != nil {
+		return nil, err
+	}
+	return getDockerConfigCreds(auths)
+}
+
+func getDockerConfigCreds(auths map[string]dockerConfigEntry) (map[string]registryCredentials, error) {
+	creds := make(map[string]registryCredentials)
+
+	for host, entry := range auths {
+		cred := registryCredentials{
+			Username: entry.Username,
+			Password: entry.Password,
+		}
+
+		if entry.Auth != "" {
+			decodedAuth, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, err
+			}
+
+			authParts := strings.SplitN(string(decodedAuth), ":", 2)
+			if len(authParts) != 2 {
+				return nil, fmt.Errorf("decoded credential has wrong number of fields (expected 2, got %d)", len(authParts))
+			}
+
+			cred = registryCredentials{
+				Username: authParts[0],
+				Password: authParts[1],
+			}
+		}
+
+		creds[normalizeRegistryHost(host)] = cred
+	}
+	return creds, nil
+}
+
+// getImageRegistryHost returns the normalized host of the registry of an image
+func getImageRegistryHost(image string) string {
+	named, err := dockerref.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	return normalizeRegistryHost(dockerref.Domain(named))
+}
+
+// normalizeRegistryHost returns the host of a registry as given in docker configs or
+// image names, without scheme and path, and with all the names of Docker Hub as
+// dockerHubHost. Like docker.io, index.docker.io and https://index.docker.io/v1/.
+func normalizeRegistryHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+
+	switch host {
+	case oldDockerHubHost, dockerHubHost, dockerHubRegistryHost:
+		return dockerHubHost
+	}
+	return host
+}
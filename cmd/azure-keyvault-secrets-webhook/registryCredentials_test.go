@@ -0,0 +1,96 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNormalizeRegistryHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"docker.io":                   dockerHubHost,
+		"index.docker.io":             dockerHubHost,
+		"https://index.docker.io/v1/": dockerHubHost,
+		"registry-1.docker.io":        dockerHubHost,
+		"https://Some.azurecr.io":     "some.azurecr.io",
+		"localhost:5000":              "localhost:5000",
+	} {
+		if normalized := normalizeRegistryHost(host); normalized != expected {
+			t.Errorf("expected '%s' to be normalized to '%s' but got '%s'", host, expected, normalized)
+		}
+	}
+
+	for image, expected := range map[string]string{
+		"nginx":                      dockerHubHost,
+		"someuser/app:1.0":           dockerHubHost,
+		"some.azurecr.io/team/app":   "some.azurecr.io",
+		"localhost:5000/app@sha256:": "",
+	} {
+		if host := getImageRegistryHost(image); host != expected {
+			t.Errorf("expected registry of image '%s' to be '%s' but got '%s'", image, expected, host)
+		}
+	}
+}
+
+func TestGetRegistryCreds(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-secret", Namespace: "some-namespace"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				// some-user:some-password
+				corev1.DockerConfigJsonKey: []byte(`{"auths":{"https://index.docker.io/v1/":{"auth":"c29tZS11c2VyOnNvbWUtcGFzc3dvcmQ="}}}`),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "legacy-secret", Namespace: "some-namespace"},
+			Type:       corev1.SecretTypeDockercfg,
+			Data: map[string][]byte{
+				corev1.DockerConfigKey: []byte(`{"some.azurecr.io":{"username":"acr-user","password":"acr-password"},"docker.io":{"username":"other-user","password":"other-password"}}`),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "opaque-secret", Namespace: "some-namespace"},
+			Type:       corev1.SecretTypeOpaque,
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "some-account", Namespace: "some-namespace"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "legacy-secret"}, {Name: "missing-secret"}},
+		},
+	)
+
+	podSpec := &corev1.PodSpec{
+		ServiceAccountName: "some-account",
+		ImagePullSecrets:   []corev1.LocalObjectReference{{Name: "pod-secret"}, {Name: "opaque-secret"}},
+	}
+
+	creds, err := getRegistryCreds(clientset, "some-namespace", podSpec)
+	if err != nil {
+		t.Fatalf("failed to get registry credentials, error: %+v", err)
+	}
+
+	expected := map[string]registryCredentials{
+		dockerHubHost:     {Username: "some-user", Password: "some-password"},
+		"some.azurecr.io": {Username: "acr-user", Password: "acr-password"},
+	}
+	if !reflect.DeepEqual(creds, expected) {
+		t.Errorf("expected credentials %+v but got %+v", expected, creds)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright © 2019 Sparebanken Vest
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRegistry serves an image with a manifest list for linux/amd64 and linux/arm64,
+// requiring a bearer token from its token service
+type fakeRegistry struct {
+	server   *httptest.Server
+	contents map[string]string
+	requests []string // authorized requests
+}
+
+func newFakeRegistry() *fakeRegistry {
+	registry := &fakeRegistry{contents: make(map[string]string)}
+
+	amd64Config := registry.add("blobs", `{"architecture":"amd64","config":{"Entrypoint":["/app"],"Cmd":["--amd64"]}}`)
+	arm64Config := registry.add("blobs", `{"architecture":"arm64","config":{"Entrypoint":["/app"],"Cmd":["--arm64"]}}`)
+	amd64Manifest := registry.add("manifests", fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"digest":"%s"}}`, mediaTypeDockerManifest, amd64Config))
+	arm64Manifest := registry.add("manifests", fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"digest":"%s"}}`, mediaTypeOCIManifest, arm64Config))
+	registry.contents["/v2/team/app/manifests/1.0"] = fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","manifests":[{"digest":"%s","platform":{"os":"linux","architecture":"amd64"}},{"digest":"%s","platform":{"os":"linux","architecture":"arm64","variant":"v8"}}]}`,
+		mediaTypeDockerManifestList, amd64Manifest, arm64Manifest)
+
+	registry.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, password, ok := r.BasicAuth(); !ok || user != "some-user" || password != "some-password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:team/app:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"token":"some-token"}`)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer some-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="fake",scope="repository:team/app:pull"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.requests = append(registry.requests, r.URL.Path)
+
+		content, ok := registry.contents[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+
+	return registry
+}
+
+// add serves content by its digest, returning the digest
+func (r *fakeRegistry) add(kind, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	r.contents["/v2/team/app/"+kind+"/"+digest] = content
+	return digest
+}
+
+func (r *fakeRegistry) image() string {
+	return strings.TrimPrefix(r.server.URL, "https://") + "/team/app:1.0"
+}
+
+func TestGetImageConfigSelectsPlatform(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.server.Close()
+
+	client := &registryClient{client: registry.server.Client()}
+	creds := &registryCredentials{Username: "some-user", Password: "some-password"}
+
+	for arch, cmd := range map[string]string{"amd64": "--amd64", "arm64": "--arm64"} {
+		config, err := client.getImageConfig(context.Background(), registry.image(), creds, imagePlatform{OS: "linux", Architecture: arch})
+		if err != nil {
+			t.Fatalf("failed to get image config for %s, error: %+v", arch, err)
+		}
+
+		expected := &imageConfig{Entrypoint: []string{"/app"}, Cmd: []string{cmd}}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("expected image config %+v for %s, but got %+v", expected, arch, config)
+		}
+	}
+
+	if _, err := client.getImageConfig(context.Background(), registry.image(), creds, imagePlatform{OS: "windows", Architecture: "amd64"}); err == nil {
+		t.Error("expected error for image without manifest for platform")
+	}
+}
+
+func TestGetImageConfigRequiresCredentials(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.server.Close()
+
+	client := &registryClient{client: registry.server.Client()}
+	if _, err := client.getImageConfig(context.Background(), registry.image(), nil, imagePlatform{OS: "linux", Architecture: "amd64"}); err == nil {
+		t.Error("expected error without credentials")
+	}
+
+	for _, path := range registry.requests {
+		if strings.Contains(path, "/blobs/") {
+			t.Errorf("expected no blobs to be requested without credentials, but got %s", path)
+		}
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("expected scheme 'Bearer' but got '%s'", scheme)
+	}
+
+	expected := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/nginx:pull,push",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("expected params %v but got %v", expected, params)
+	}
+}
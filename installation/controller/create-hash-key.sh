@@ -0,0 +1,19 @@
+#!/usr/bin/env bash
+
+# Creates the azure-keyvault-controller-hash-key Secret holding SECRET_HASH_KEY of the
+# Controller, with a random key. An existing Secret is kept, since changing the key
+# makes the Controller update all Secrets.
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+NAMESPACE=${NAMESPACE:-spv-system}
+SECRET_NAME=azure-keyvault-controller-hash-key
+
+if kubectl -n "${NAMESPACE}" get secret "${SECRET_NAME}" > /dev/null 2>&1; then
+  echo "Secret ${NAMESPACE}/${SECRET_NAME} already exists"
+  exit 0
+fi
+
+kubectl -n "${NAMESPACE}" create secret generic "${SECRET_NAME}" --from-literal=key="$(openssl rand -hex 32)"
@@ -0,0 +1,120 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health serves liveness and readiness probes for the akv2k8s components
+package health
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// LivenessPath is the path serving the liveness probe
+	LivenessPath = "/healthz"
+
+	// ReadinessPath is the path serving the readiness probe
+	ReadinessPath = "/readyz"
+)
+
+// Check returns an error if the component is not ready
+type Check func() error
+
+// CachedCheck returns a Check that runs check at most once per ttl and returns the
+// previous result in between, for checks calling external services on every probe
+func CachedCheck(check Check, ttl time.Duration) Check {
+	var mu sync.Mutex
+	var checked time.Time
+	var result error
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			return result
+		}
+		result = check()
+		checked = time.Now()
+		return result
+	}
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Handler serves liveness and readiness probes
+type Handler struct {
+	mu     sync.RWMutex
+	checks []namedCheck
+}
+
+// NewHandler returns a new Handler with no readiness checks
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// AddReadinessCheck adds a named check that must pass for the component to be ready
+func (h *Handler) AddReadinessCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// Register adds the liveness and readiness probes to mux
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(LivenessPath, h.serveLiveness)
+	mux.HandleFunc(ReadinessPath, h.serveReadiness)
+}
+
+// serveLiveness reports the process as alive as long as it is able to serve requests
+func (h *Handler) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+// serveReadiness runs all readiness checks, responding with 503 if any fails. The
+// result of each check is listed in the response body.
+func (h *Handler) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	checks := h.checks
+	h.mu.RUnlock()
+
+	var body bytes.Buffer
+	failed := false
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failed = true
+			fmt.Fprintf(&body, "[-]%s failed: %s\n", c.name, err.Error())
+			continue
+		}
+		fmt.Fprintf(&body, "[+]%s ok\n", c.name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(&body, "readyz check failed")
+	} else {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(&body, "ok")
+	}
+	w.Write(body.Bytes())
+}
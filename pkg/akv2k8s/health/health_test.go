@@ -0,0 +1,94 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(handler *Handler, path string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	handler.Register(mux)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestLiveness(t *testing.T) {
+	handler := NewHandler()
+	handler.AddReadinessCheck("failing", func() error { return fmt.Errorf("not ready") })
+
+	if res := serve(handler, LivenessPath); res.Code != http.StatusOK {
+		t.Errorf("expected liveness to be ok regardless of readiness, but got %d", res.Code)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	ready := false
+	handler := NewHandler()
+	handler.AddReadinessCheck("always", func() error { return nil })
+	handler.AddReadinessCheck("sometimes", func() error {
+		if !ready {
+			return fmt.Errorf("not ready yet")
+		}
+		return nil
+	})
+
+	res := serve(handler, ReadinessPath)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d when a check fails, but got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	if !strings.Contains(res.Body.String(), "[-]sometimes failed: not ready yet") {
+		t.Errorf("expected failing check in body, but got '%s'", res.Body.String())
+	}
+
+	ready = true
+	if res = serve(handler, ReadinessPath); res.Code != http.StatusOK {
+		t.Errorf("expected %d when all checks pass, but got %d", http.StatusOK, res.Code)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := func() error {
+		calls++
+		return fmt.Errorf("call %d", calls)
+	}
+
+	cached := CachedCheck(check, time.Hour)
+	first, second := cached(), cached()
+	if calls != 1 {
+		t.Errorf("expected check to run once within ttl, but it ran %d times", calls)
+	}
+	if first == nil || second == nil || first.Error() != second.Error() {
+		t.Errorf("expected cached result '%v' to be returned, but got '%v'", first, second)
+	}
+
+	calls = 0
+	uncached := CachedCheck(check, 0)
+	uncached()
+	uncached()
+	if calls != 2 {
+		t.Errorf("expected check to run on every call when ttl has passed, but it ran %d times", calls)
+	}
+}
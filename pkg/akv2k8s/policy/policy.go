@@ -0,0 +1,73 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy decides which namespaces AzureKeyVaultSecrets can use each vault from,
+// so the Env Injector and Controller enforce the same policy
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+// VaultNamespaces are the namespaces allowed to use each vault, by lower case vault
+// name. Vaults not listed can be used from all namespaces.
+type VaultNamespaces map[string]map[string]bool
+
+// ParseVaultNamespaces parses the namespaces allowed to use each vault, like
+// 'vault-a=team-a;vault-b=team-b,team-c'
+func ParseVaultNamespaces(value string) (VaultNamespaces, error) {
+	vaultNamespaces := make(VaultNamespaces)
+
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		vault := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || vault == "" {
+			return nil, fmt.Errorf("invalid vault namespaces '%s', must be like 'vault=namespace1,namespace2'", entry)
+		}
+
+		if vaultNamespaces[vault] == nil {
+			vaultNamespaces[vault] = make(map[string]bool)
+		}
+		for _, namespace := range strings.Split(parts[1], ",") {
+			if namespace = strings.TrimSpace(namespace); namespace != "" {
+				vaultNamespaces[vault][namespace] = true
+			}
+		}
+	}
+	return vaultNamespaces, nil
+}
+
+// Allowed returns true if AzureKeyVaultSecrets in the namespace can use the vault
+func (v VaultNamespaces) Allowed(vaultName, namespace string) bool {
+	namespaces, ok := v[strings.ToLower(vaultName)]
+	return !ok || namespaces[namespace]
+}
+
+// Check returns an error if the AzureKeyVaultSecret uses a vault its namespace is not
+// allowed to use
+func (v VaultNamespaces) Check(azureKeyVaultSecret *akv.AzureKeyVaultSecret) error {
+	if !v.Allowed(azureKeyVaultSecret.Spec.Vault.Name, azureKeyVaultSecret.Namespace) {
+		return fmt.Errorf("AzureKeyVaultSecret '%s' uses vault '%s', which namespace '%s' is not allowed to use", azureKeyVaultSecret.Name, azureKeyVaultSecret.Spec.Vault.Name, azureKeyVaultSecret.Namespace)
+	}
+	return nil
+}
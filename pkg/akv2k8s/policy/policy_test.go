@@ -0,0 +1,60 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func TestVaultNamespaces(t *testing.T) {
+	vaultNamespaces, err := ParseVaultNamespaces("Team-B-Vault=team-b, team-c;shared-vault=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		vault     string
+		namespace string
+		allowed   bool
+	}{
+		{"team-b-vault", "team-b", true},
+		{"TEAM-B-VAULT", "team-c", true},
+		{"team-b-vault", "team-a", false},
+		{"shared-vault", "team-b", false},
+		{"other-vault", "team-a", true},
+	} {
+		azureKeyVaultSecret := &akv.AzureKeyVaultSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-secret", Namespace: test.namespace},
+			Spec:       akv.AzureKeyVaultSecretSpec{Vault: akv.AzureKeyVault{Name: test.vault}},
+		}
+		err := vaultNamespaces.Check(azureKeyVaultSecret)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("expected vault '%s' in namespace '%s' to be allowed=%t, but got error: %v", test.vault, test.namespace, test.allowed, err)
+		}
+	}
+
+	if _, err := ParseVaultNamespaces("=team-a"); err == nil {
+		t.Error("expected error for vault namespaces without vault name")
+	}
+	if _, err := ParseVaultNamespaces("vault-a"); err == nil {
+		t.Error("expected error for vault namespaces without namespaces")
+	}
+}
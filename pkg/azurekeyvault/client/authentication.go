@@ -1,10 +1,15 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
 
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"gopkg.in/yaml.v2"
 
 	"github.com/Azure/go-autorest/autorest/azure/auth"
@@ -12,11 +17,11 @@ import (
 	cloudAuth "k8s.io/kubernetes/pkg/cloudprovider/providers/azure/auth"
 )
 
-const azureKeyVaultResourceURI = "https://vault.azure.net"
-
 // AzureKeyVaultCredentials for service principal
 type AzureKeyVaultCredentials struct {
-	getAuthorizer func() (autorest.Authorizer, error)
+	// Environment is the Azure cloud environment used when an AzureKeyVault does not specify its own
+	Environment   *azure.Environment
+	getAuthorizer func(env *azure.Environment) (autorest.Authorizer, error)
 }
 
 // NewAzureKeyVaultCredentialsFromCloudConfig gets a credentials object from cloud config to use with Azure Key Vault
@@ -26,30 +31,63 @@ func NewAzureKeyVaultCredentialsFromCloudConfig(cloudConfigPath string) (*AzureK
 		return nil, err
 	}
 
-	return NewAzureKeyVaultCredentialsFromClient(config.AADClientID, config.AADClientSecret, config.TenantID)
+	cloudName := config.Cloud
+	if cloudName == "" {
+		cloudName = os.Getenv(auth.EnvironmentName)
+	}
+
+	env, err := GetAzureEnvironment(cloudName)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAzureKeyVaultCredentialsFromClient(config.AADClientID, config.AADClientSecret, config.TenantID, env), nil
 }
 
 // NewAzureKeyVaultCredentialsFromClient creates a credentials object from a servbice principal to use with Azure Key Vault
 func NewAzureKeyVaultCredentialsFromClient(clientID, clientSecret, tenantID string) (*AzureKeyVaultCredentials, error) {
-	cred := azureAuth.NewClientCredentialsConfig(clientID, clientSecret, tenantID)
-	cred.Resource = azureKeyVaultResourceURI
+	env, err := GetAzureEnvironment(os.Getenv(auth.EnvironmentName))
+	if err != nil {
+		return nil, err
+	}
+	return newAzureKeyVaultCredentialsFromClient(clientID, clientSecret, tenantID, env), nil
+}
 
+func newAzureKeyVaultCredentialsFromClient(clientID, clientSecret, tenantID string, defaultEnv *azure.Environment) *AzureKeyVaultCredentials {
 	return &AzureKeyVaultCredentials{
-		getAuthorizer: func() (autorest.Authorizer, error) {
+		Environment: defaultEnv,
+		getAuthorizer: func(env *azure.Environment) (autorest.Authorizer, error) {
+			cred := azureAuth.NewClientCredentialsConfig(clientID, clientSecret, tenantID)
+			cred.AADEndpoint = env.ActiveDirectoryEndpoint
+			cred.Resource = keyVaultResourceURI(env)
+
 			authorizer, err := cred.Authorizer()
 			if err != nil {
 				return nil, fmt.Errorf("failed to create authorizer based on service principal credentials, err: %+v", err)
 			}
 			return authorizer, nil
 		},
-	}, nil
+	}
 }
 
 // NewAzureKeyVaultCredentialsFromEnvironment creates a credentials object based on available environment settings to use with Azure Key Vault
 func NewAzureKeyVaultCredentialsFromEnvironment() (*AzureKeyVaultCredentials, error) {
+	env, err := GetAzureEnvironment(os.Getenv(auth.EnvironmentName))
+	if err != nil {
+		return nil, err
+	}
+
 	return &AzureKeyVaultCredentials{
-		getAuthorizer: func() (autorest.Authorizer, error) {
-			authorizer, err := auth.NewAuthorizerFromEnvironmentWithResource(azureKeyVaultResourceURI)
+		Environment: env,
+		getAuthorizer: func(env *azure.Environment) (autorest.Authorizer, error) {
+			settings, err := auth.GetSettingsFromEnvironment()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get settings from environment, err: %+v", err)
+			}
+			settings.Environment = *env
+			settings.Values[auth.Resource] = keyVaultResourceURI(env)
+
+			authorizer, err := settings.GetAuthorizer()
 			if err != nil {
 				return nil, fmt.Errorf("failed to create authorizer from environment, err: %+v", err)
 			}
@@ -58,9 +96,46 @@ func NewAzureKeyVaultCredentialsFromEnvironment() (*AzureKeyVaultCredentials, er
 	}, nil
 }
 
-// Authorizer gets an Authorizer from credentials
+// Authorizer gets an Authorizer from credentials for the default Azure cloud environment
 func (c AzureKeyVaultCredentials) Authorizer() (autorest.Authorizer, error) {
-	return c.getAuthorizer()
+	return c.getAuthorizer(c.Environment)
+}
+
+// AuthorizerForEnvironment gets an Authorizer from credentials for a specific Azure cloud environment
+func (c AzureKeyVaultCredentials) AuthorizerForEnvironment(env *azure.Environment) (autorest.Authorizer, error) {
+	return c.getAuthorizer(env)
+}
+
+// EnsureToken makes sure authorizer holds a valid token for Azure Key Vault in the default
+// Azure cloud environment, acquiring or refreshing it from Azure AD if needed
+func (c AzureKeyVaultCredentials) EnsureToken(ctx context.Context, authorizer autorest.Authorizer) error {
+	req, err := http.NewRequest(http.MethodGet, keyVaultResourceURI(c.Environment), nil)
+	if err != nil {
+		return err
+	}
+	if _, err = autorest.Prepare(req.WithContext(ctx), authorizer.WithAuthorization()); err != nil {
+		return fmt.Errorf("failed to get token for azure key vault, error: %+v", err)
+	}
+	return nil
+}
+
+// GetAzureEnvironment returns the Azure cloud environment matching name (like AzurePublicCloud or AzureChinaCloud),
+// defaulting to the public cloud if name is empty
+func GetAzureEnvironment(name string) (*azure.Environment, error) {
+	if name == "" {
+		return &azure.PublicCloud, nil
+	}
+
+	env, err := azure.EnvironmentFromName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get azure cloud environment '%s', error: %+v", name, err)
+	}
+	return &env, nil
+}
+
+// keyVaultResourceURI returns the resource to request tokens for when accessing Azure Key Vault in env
+func keyVaultResourceURI(env *azure.Environment) string {
+	return strings.TrimSuffix(env.KeyVaultEndpoint, "/")
 }
 
 func readCloudConfig(path string) (*cloudAuth.AzureAuthConfig, error) {
@@ -0,0 +1,98 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func TestGetAzureEnvironment(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		expected    string
+		dnsSuffix   string
+		resourceURI string
+	}{
+		{"", "AzurePublicCloud", "vault.azure.net", "https://vault.azure.net"},
+		{"AzurePublicCloud", "AzurePublicCloud", "vault.azure.net", "https://vault.azure.net"},
+		{"AzureChinaCloud", "AzureChinaCloud", "vault.azure.cn", "https://vault.azure.cn"},
+		{"azureusgovernmentcloud", "AzureUSGovernmentCloud", "vault.usgovcloudapi.net", "https://vault.usgovcloudapi.net"},
+		{"AzureGermanCloud", "AzureGermanCloud", "vault.microsoftazure.de", "https://vault.microsoftazure.de"},
+	} {
+		env, err := GetAzureEnvironment(test.name)
+		if err != nil {
+			t.Errorf("failed to get azure environment '%s', error: %+v", test.name, err)
+			continue
+		}
+		if env.Name != test.expected {
+			t.Errorf("expected azure environment '%s' to be '%s' but got '%s'", test.name, test.expected, env.Name)
+		}
+		if env.KeyVaultDNSSuffix != test.dnsSuffix {
+			t.Errorf("expected key vault dns suffix '%s' for '%s' but got '%s'", test.dnsSuffix, test.expected, env.KeyVaultDNSSuffix)
+		}
+		if uri := keyVaultResourceURI(env); uri != test.resourceURI {
+			t.Errorf("expected key vault resource uri '%s' for '%s' but got '%s'", test.resourceURI, test.expected, uri)
+		}
+	}
+
+	if _, err := GetAzureEnvironment("AzureMarsCloud"); err == nil {
+		t.Error("expected error for unknown azure environment")
+	}
+}
+
+func TestGetClientUsesVaultCloud(t *testing.T) {
+	var authorizedFor []string
+	credentials := &AzureKeyVaultCredentials{
+		Environment: &azure.USGovernmentCloud,
+		getAuthorizer: func(env *azure.Environment) (autorest.Authorizer, error) {
+			authorizedFor = append(authorizedFor, env.Name)
+			return autorest.NullAuthorizer{}, nil
+		},
+	}
+	service := NewService(credentials).(*azureKeyVaultService)
+
+	for _, test := range []struct {
+		cloud       string
+		expectedEnv string
+		expectedURL string
+	}{
+		{"", "AzureUSGovernmentCloud", "https://my-vault.vault.usgovcloudapi.net"},
+		{"AzurePublicCloud", "AzurePublicCloud", "https://my-vault.vault.azure.net"},
+		{"AzureChinaCloud", "AzureChinaCloud", "https://my-vault.vault.azure.cn"},
+	} {
+		authorizedFor = nil
+		_, baseURL, err := service.getClient(&akvs.AzureKeyVault{Name: "my-vault", Cloud: test.cloud})
+		if err != nil {
+			t.Errorf("failed to get client for cloud '%s', error: %+v", test.cloud, err)
+			continue
+		}
+		if baseURL != test.expectedURL {
+			t.Errorf("expected base url '%s' for cloud '%s' but got '%s'", test.expectedURL, test.cloud, baseURL)
+		}
+		if len(authorizedFor) != 1 || authorizedFor[0] != test.expectedEnv {
+			t.Errorf("expected authorizer for '%s' with cloud '%s' but got %v", test.expectedEnv, test.cloud, authorizedFor)
+		}
+	}
+
+	if _, _, err := service.getClient(&akvs.AzureKeyVault{Name: "my-vault", Cloud: "AzureMarsCloud"}); err == nil {
+		t.Error("expected error for vault in unknown azure environment")
+	}
+}
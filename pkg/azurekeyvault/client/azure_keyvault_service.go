@@ -19,9 +19,15 @@ package client
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/date"
 	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
 )
 
@@ -33,111 +39,408 @@ const (
 // Service is an interface for implementing vaults
 type Service interface {
 	GetSecret(secret *akvs.AzureKeyVault) (string, error)
-	GetKey(secret *akvs.AzureKeyVault) (string, error)
+	GetSecretWithVersion(secret *akvs.AzureKeyVault) (string, *ObjectVersion, error)
+	GetKey(secret *akvs.AzureKeyVault) (*Key, error)
 	GetCertificate(secret *akvs.AzureKeyVault, exportPrivateKey bool) (*Certificate, error)
+	GetObjectVersion(secret *akvs.AzureKeyVault) (*ObjectVersion, error)
+	ListSecrets(vaultSpec *akvs.AzureKeyVault) ([]SecretItem, error)
+}
+
+// SecretItem is a secret listed in a vault, without its value
+type SecretItem struct {
+	Name        string
+	ContentType string
+	Tags        map[string]string
+}
+
+// ObjectVersion identifies a version of an object in a vault
+type ObjectVersion struct {
+	// Version is the version id of the object
+	Version string
+	// Updated is when the object was last updated, if known
+	Updated time.Time
 }
 
 type azureKeyVaultService struct {
 	credentials *AzureKeyVaultCredentials
+	throttles   *vaultThrottles
 }
 
 // NewService creates a new AzureKeyVaultService using crednetials found in cloud config
 func NewService(credentials *AzureKeyVaultCredentials) Service {
+	return NewServiceWithThrottling(credentials, DefaultThrottleConfig())
+}
+
+// NewServiceWithThrottling creates a new AzureKeyVaultService, rate limiting requests to each
+// vault and backing off vaults throttling requests as set in throttleConfig
+func NewServiceWithThrottling(credentials *AzureKeyVaultCredentials, throttleConfig ThrottleConfig) Service {
 	return &azureKeyVaultService{
 		credentials: credentials,
+		throttles:   newVaultThrottles(throttleConfig),
 	}
 }
 
 // GetSecret download secrets from Azure Key Vault
 func (a *azureKeyVaultService) GetSecret(vaultSpec *akvs.AzureKeyVault) (string, error) {
+	secret, _, err := a.GetSecretWithVersion(vaultSpec)
+	return secret, err
+}
+
+// GetSecretWithVersion download secrets from Azure Key Vault, along with the version of the
+// secret the value was read from
+func (a *azureKeyVaultService) GetSecretWithVersion(vaultSpec *akvs.AzureKeyVault) (string, *ObjectVersion, error) {
 	if vaultSpec.Object.Name == "" {
-		return "", fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+		return "", nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
 	}
 
 	//Get secret value from Azure Key Vault
-	vaultClient, err := a.getClient("https://vault.azure.net")
+	vaultClient, baseURL, err := a.getClient(vaultSpec)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	baseURL := fmt.Sprintf("https://%s.vault.azure.net", vaultSpec.Name)
 	secretBundle, err := vaultClient.GetSecret(context.Background(), baseURL, vaultSpec.Object.Name, vaultSpec.Object.Version)
 
 	if err != nil {
-		return "", err
+		return "", nil, azureError(err)
 	}
-	return *secretBundle.Value, nil
+
+	var updated *date.UnixTime
+	if secretBundle.Attributes != nil {
+		updated = secretBundle.Attributes.Updated
+	}
+	return *secretBundle.Value, newObjectVersion(secretBundle.ID, updated), nil
 }
 
-// GetKey download encryption keys from Azure Key Vault
-func (a *azureKeyVaultService) GetKey(vaultSpec *akvs.AzureKeyVault) (string, error) {
+// GetKey download the public part of encryption keys from Azure Key Vault
+func (a *azureKeyVaultService) GetKey(vaultSpec *akvs.AzureKeyVault) (*Key, error) {
 	if vaultSpec.Object.Name == "" {
-		return "", fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+		return nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
 	}
 
-	vaultClient, err := a.getClient("https://vault.azure.net")
+	vaultClient, baseURL, err := a.getClient(vaultSpec)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	baseURL := fmt.Sprintf("https://%s.vault.azure.net", vaultSpec.Name)
 	keyBundle, err := vaultClient.GetKey(context.Background(), baseURL, vaultSpec.Object.Name, vaultSpec.Object.Version)
 
 	if err != nil {
-		return "", err
+		return nil, azureError(err)
+	}
+
+	if keyBundle.Key == nil {
+		return nil, fmt.Errorf("azure key vault returned no key for '%s'", vaultSpec.Object.Name)
+	}
+
+	jwk, err := json.Marshal(keyBundle.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key from azure key vault, error: %+v", err)
+	}
+	key, err := NewKeyFromJwk(jwk)
+	if err != nil {
+		return nil, err
 	}
 
-	return *keyBundle.Key.N, nil
+	var updated *date.UnixTime
+	if keyBundle.Attributes != nil {
+		updated = keyBundle.Attributes.Updated
+	}
+	key.Version = newObjectVersion(keyBundle.Key.Kid, updated)
+	return key, nil
 }
 
-// GetCertificate download public/private certificates from Azure Key Vault
+// GetCertificate download public/private certificates from Azure Key Vault. The private key
+// is read from the same version as the certificate.
 func (a *azureKeyVaultService) GetCertificate(vaultSpec *akvs.AzureKeyVault, exportPrivateKey bool) (*Certificate, error) {
-	vaultClient, err := a.getClient("https://vault.azure.net")
+	vaultClient, baseURL, err := a.getClient(vaultSpec)
 	if err != nil {
 		return nil, err
 	}
 
-	baseURL := fmt.Sprintf("https://%s.vault.azure.net", vaultSpec.Name)
-
 	certBundle, err := vaultClient.GetCertificate(context.Background(), baseURL, vaultSpec.Object.Name, vaultSpec.Object.Version)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get certificate from azure key vault, error: %+v", err)
+		return nil, wrapAzureError(err, "failed to get certificate from azure key vault")
+	}
+
+	var updated *date.UnixTime
+	if certBundle.Attributes != nil {
+		updated = certBundle.Attributes.Updated
 	}
+	version := newObjectVersion(certBundle.ID, updated)
 
+	var cert *Certificate
 	if exportPrivateKey {
 		if !*certBundle.Policy.KeyProperties.Exportable {
 			return nil, fmt.Errorf("cannot export private key because key is not exportable in azure key vault")
 		}
-		secretBundle, err := vaultClient.GetSecret(context.Background(), baseURL, vaultSpec.Object.Name, vaultSpec.Object.Version)
+
+		secretVersion := vaultSpec.Object.Version
+		if version != nil {
+			secretVersion = version.Version
+		}
+		cert, err = getPrivateCertificate(vaultClient, baseURL, vaultSpec.Object.Name, secretVersion)
+	} else {
+		cert, err = NewCertificateFromDer(*certBundle.Cer)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Version = version
+	return cert, nil
+}
+
+// getPrivateCertificate gets the certificate with its private key from the secret backing
+// the certificate in Azure Key Vault
+func getPrivateCertificate(vaultClient *keyvault.BaseClient, baseURL, name, version string) (*Certificate, error) {
+	secretBundle, err := vaultClient.GetSecret(context.Background(), baseURL, name, version)
+	if err != nil {
+		return nil, wrapAzureError(err, "failed to get private certificate from azure key vault")
+	}
+
+	switch *secretBundle.ContentType {
+	case certificateTypePem:
+		return NewCertificateFromPem(*secretBundle.Value)
+	case certificateTypePfx:
+		pfxRaw, err := base64.StdEncoding.DecodeString(*secretBundle.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 encoded pfx, error: %+v", err)
+		}
+		return NewCertificateFromPfx(pfxRaw)
+	default:
+		return nil, fmt.Errorf("failed to get certificate from azure key vault - unknown content type '%s'", *secretBundle.ContentType)
+	}
+}
+
+// GetObjectVersion gets the version currently resolved in Azure Key Vault for the object,
+// which is the latest version unless a version is set in vaultSpec
+func (a *azureKeyVaultService) GetObjectVersion(vaultSpec *akvs.AzureKeyVault) (*ObjectVersion, error) {
+	if vaultSpec.Object.Name == "" {
+		return nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+	}
+
+	vaultClient, baseURL, err := a.getClient(vaultSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	var id *string
+	var updated *date.UnixTime
+
+	switch vaultSpec.Object.Type {
+	case akvs.AzureKeyVaultObjectTypeCertificate:
+		certBundle, err := vaultClient.GetCertificate(context.Background(), baseURL, vaultSpec.Object.Name, vaultSpec.Object.Version)
+		if err != nil {
+			return nil, azureError(err)
+		}
+		id = certBundle.ID
+		if certBundle.Attributes != nil {
+			updated = certBundle.Attributes.Updated
+		}
+	case akvs.AzureKeyVaultObjectTypeKey:
+		keyBundle, err := vaultClient.GetKey(context.Background(), baseURL, vaultSpec.Object.Name, vaultSpec.Object.Version)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get private certificate from azure key vault, error: %+v", err)
+			return nil, azureError(err)
+		}
+		if keyBundle.Key != nil {
+			id = keyBundle.Key.Kid
+		}
+		if keyBundle.Attributes != nil {
+			updated = keyBundle.Attributes.Updated
 		}
+	default:
+		// Getting a secret includes its value, so the versions are listed instead
+		secret, err := getSecretVersion(vaultClient, baseURL, vaultSpec)
+		if err != nil {
+			return nil, err
+		}
+		id = secret.ID
+		if secret.Attributes != nil {
+			updated = secret.Attributes.Updated
+		}
+	}
+
+	version := newObjectVersion(id, updated)
+	if version == nil {
+		return nil, fmt.Errorf("azure key vault returned no id for object '%s'", vaultSpec.Object.Name)
+	}
+	return version, nil
+}
 
-		switch *secretBundle.ContentType {
-		case certificateTypePem:
-			return NewCertificateFromPem(*secretBundle.Value)
-		case certificateTypePfx:
-			pfxRaw, err := base64.StdEncoding.DecodeString(*secretBundle.Value)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode base64 encoded pfx, error: %+v", err)
+// getSecretVersion lists the versions of the secret in vaultSpec without their values,
+// returning the version set in vaultSpec or otherwise the latest created enabled version,
+// which is the current version of the secret
+func getSecretVersion(vaultClient *keyvault.BaseClient, baseURL string, vaultSpec *akvs.AzureKeyVault) (*keyvault.SecretItem, error) {
+	iterator, err := vaultClient.GetSecretVersionsComplete(context.Background(), baseURL, vaultSpec.Object.Name, nil)
+	if err != nil {
+		return nil, wrapAzureError(err, fmt.Sprintf("failed to list versions of secret '%s' in azure key vault '%s'", vaultSpec.Object.Name, vaultSpec.Name))
+	}
+
+	var latest *keyvault.SecretItem
+	var latestCreated time.Time
+	for ; iterator.NotDone(); err = iterator.Next() {
+		if err != nil {
+			return nil, wrapAzureError(err, fmt.Sprintf("failed to list versions of secret '%s' in azure key vault '%s'", vaultSpec.Object.Name, vaultSpec.Name))
+		}
+
+		secret := iterator.Value()
+		if secret.ID == nil {
+			continue
+		}
+		if vaultSpec.Object.Version != "" {
+			if versionFromID(*secret.ID) == vaultSpec.Object.Version {
+				return &secret, nil
 			}
-			return NewCertificateFromPfx(pfxRaw)
-		default:
-			return nil, fmt.Errorf("failed to get certificate from azure key vault - unknown content type '%s'", *secretBundle.ContentType)
+			continue
 		}
+
+		if secret.Attributes != nil && secret.Attributes.Enabled != nil && !*secret.Attributes.Enabled {
+			continue
+		}
+
+		var created time.Time
+		if secret.Attributes != nil && secret.Attributes.Created != nil {
+			created = time.Time(*secret.Attributes.Created)
+		}
+		if latest == nil || created.After(latestCreated) {
+			latest = &secret
+			latestCreated = created
+		}
+	}
+	if err != nil {
+		return nil, wrapAzureError(err, fmt.Sprintf("failed to list versions of secret '%s' in azure key vault '%s'", vaultSpec.Object.Name, vaultSpec.Name))
+	}
+
+	if vaultSpec.Object.Version != "" {
+		return nil, fmt.Errorf("version '%s' of secret '%s' not found in azure key vault '%s'", vaultSpec.Object.Version, vaultSpec.Object.Name, vaultSpec.Name)
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no enabled version of secret '%s' found in azure key vault '%s'", vaultSpec.Object.Name, vaultSpec.Name)
+	}
+	return latest, nil
+}
+
+// newObjectVersion returns the version of an object from the id and updated attribute of
+// the bundle returned by Azure Key Vault, or nil if there is no id
+func newObjectVersion(id *string, updated *date.UnixTime) *ObjectVersion {
+	if id == nil {
+		return nil
 	}
 
-	return NewCertificateFromDer(*certBundle.Cer)
+	version := &ObjectVersion{
+		Version: versionFromID(*id),
+	}
+	if updated != nil {
+		version.Updated = time.Time(*updated)
+	}
+	return version
 }
 
-func (a *azureKeyVaultService) getClient(resource string) (*keyvault.BaseClient, error) {
-	authorizer, err := a.credentials.Authorizer()
+// ListSecrets lists all enabled secrets in the Azure Key Vault of vaultSpec, sorted by name.
+// Secrets backing certificates are managed by Azure Key Vault and left out.
+func (a *azureKeyVaultService) ListSecrets(vaultSpec *akvs.AzureKeyVault) ([]SecretItem, error) {
+	vaultClient, baseURL, err := a.getClient(vaultSpec)
 	if err != nil {
 		return nil, err
 	}
 
+	iterator, err := vaultClient.GetSecretsComplete(context.Background(), baseURL, nil)
+	if err != nil {
+		return nil, wrapAzureError(err, fmt.Sprintf("failed to list secrets in azure key vault '%s'", vaultSpec.Name))
+	}
+
+	var items []SecretItem
+	for ; iterator.NotDone(); err = iterator.Next() {
+		if err != nil {
+			return nil, wrapAzureError(err, fmt.Sprintf("failed to list secrets in azure key vault '%s'", vaultSpec.Name))
+		}
+
+		secret := iterator.Value()
+		if secret.ID == nil {
+			continue
+		}
+		if secret.Managed != nil && *secret.Managed {
+			continue
+		}
+		if secret.Attributes != nil && secret.Attributes.Enabled != nil && !*secret.Attributes.Enabled {
+			continue
+		}
+
+		item := SecretItem{
+			Name: nameFromID(*secret.ID),
+			Tags: make(map[string]string),
+		}
+		if secret.ContentType != nil {
+			item.ContentType = *secret.ContentType
+		}
+		for k, v := range secret.Tags {
+			if v != nil {
+				item.Tags[k] = *v
+			}
+		}
+		items = append(items, item)
+	}
+	if err != nil {
+		return nil, wrapAzureError(err, fmt.Sprintf("failed to list secrets in azure key vault '%s'", vaultSpec.Name))
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+// versionFromID returns the version part of an Azure Key Vault object id,
+// like https://my-vault.vault.azure.net/secrets/my-secret/<version>
+func versionFromID(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// nameFromID returns the name part of the id of a listed Azure Key Vault object,
+// like https://my-vault.vault.azure.net/secrets/<name>
+func nameFromID(id string) string {
+	id = strings.TrimSuffix(id, "/")
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// azureError returns the ThrottledError causing err if the request was throttled, so callers
+// can recognise throttling, and otherwise err as it is
+func azureError(err error) error {
+	if detailed, ok := err.(autorest.DetailedError); ok {
+		if throttled, ok := IsThrottled(detailed.Original); ok {
+			return throttled
+		}
+	}
+	return err
+}
+
+// wrapAzureError adds msg to err, unless the request was throttled
+func wrapAzureError(err error, msg string) error {
+	if throttled, ok := IsThrottled(azureError(err)); ok {
+		return throttled
+	}
+	return fmt.Errorf("%s, error: %+v", msg, err)
+}
+
+// getClient returns a Key Vault client authorized for the Azure cloud environment of vaultSpec,
+// together with the base url of the vault in that environment
+func (a *azureKeyVaultService) getClient(vaultSpec *akvs.AzureKeyVault) (*keyvault.BaseClient, string, error) {
+	env := a.credentials.Environment
+	if vaultSpec.Cloud != "" {
+		var err error
+		if env, err = GetAzureEnvironment(vaultSpec.Cloud); err != nil {
+			return nil, "", err
+		}
+	}
+
+	authorizer, err := a.credentials.AuthorizerForEnvironment(env)
+	if err != nil {
+		return nil, "", err
+	}
+
 	keyClient := keyvault.New()
 	keyClient.Authorizer = authorizer
+	keyClient.Sender = a.throttles.sender(vaultSpec.Name, autorest.CreateSender())
 
-	return &keyClient, nil
+	baseURL := fmt.Sprintf("https://%s.%s", vaultSpec.Name, env.KeyVaultDNSSuffix)
+	return &keyClient, baseURL, nil
 }
@@ -0,0 +1,76 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+const testSecretVersions = `{"value":[
+	{"id":"https://my-vault.vault.azure.net/secrets/my-secret/first","attributes":{"enabled":true,"created":1500000000,"updated":1500000000}},
+	{"id":"https://my-vault.vault.azure.net/secrets/my-secret/disabled","attributes":{"enabled":false,"created":1700000000,"updated":1700000000}},
+	{"id":"https://my-vault.vault.azure.net/secrets/my-secret/current","attributes":{"enabled":true,"created":1600000000,"updated":1650000000}}
+]}`
+
+func TestGetSecretVersionListsVersions(t *testing.T) {
+	var paths []string
+	vaultClient := keyvault.New()
+	vaultClient.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		paths = append(paths, r.URL.Path)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(testSecretVersions)),
+			Request:    r,
+		}, nil
+	})
+
+	for _, test := range []struct {
+		version  string
+		expected string
+	}{
+		{"", "current"},
+		{"first", "first"},
+	} {
+		paths = nil
+		vaultSpec := &akvs.AzureKeyVault{Name: "my-vault", Object: akvs.AzureKeyVaultObject{Name: "my-secret", Version: test.version}}
+		secret, err := getSecretVersion(&vaultClient, "https://my-vault.vault.azure.net", vaultSpec)
+		if err != nil {
+			t.Fatalf("failed to get version '%s' of secret, error: %+v", test.version, err)
+		}
+		if version := versionFromID(*secret.ID); version != test.expected {
+			t.Errorf("expected version '%s' for '%s' but got '%s'", test.expected, test.version, version)
+		}
+
+		// Only the versions are listed, so the value of the secret is never transferred
+		if len(paths) != 1 || paths[0] != "/secrets/my-secret/versions" {
+			t.Errorf("expected only the versions to be listed, but got requests to %v", paths)
+		}
+	}
+
+	vaultSpec := &akvs.AzureKeyVault{Name: "my-vault", Object: akvs.AzureKeyVaultObject{Name: "my-secret", Version: "missing"}}
+	if _, err := getSecretVersion(&vaultClient, "https://my-vault.vault.azure.net", vaultSpec); err == nil {
+		t.Error("expected error for missing version of secret")
+	}
+}
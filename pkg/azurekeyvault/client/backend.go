@@ -0,0 +1,101 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// BackendAzure is the name of the backend getting objects from Azure Key Vault
+	BackendAzure = "azure"
+
+	// BackendLocal is the name of the backend getting objects from files in a local directory
+	BackendLocal = "local"
+)
+
+// BackendConfig contains settings used by backends when creating a vault Service
+type BackendConfig struct {
+	// Credentials are used by the azure backend to authenticate with Azure Key Vault
+	Credentials *AzureKeyVaultCredentials
+
+	// Path is used by the local backend as the directory to read vault objects from
+	Path string
+
+	// Throttle is used by the azure backend to rate limit requests to each vault, using
+	// DefaultThrottleConfig if not set
+	Throttle *ThrottleConfig
+}
+
+// BackendFactory creates a vault Service from a BackendConfig
+type BackendFactory func(config BackendConfig) (Service, error)
+
+var (
+	backendsMutex sync.RWMutex
+	backends      = make(map[string]BackendFactory)
+)
+
+func init() {
+	RegisterBackend(BackendAzure, func(config BackendConfig) (Service, error) {
+		if config.Credentials == nil {
+			return nil, fmt.Errorf("credentials are required for vault backend '%s'", BackendAzure)
+		}
+		if config.Throttle != nil {
+			return NewServiceWithThrottling(config.Credentials, *config.Throttle), nil
+		}
+		return NewService(config.Credentials), nil
+	})
+
+	RegisterBackend(BackendLocal, func(config BackendConfig) (Service, error) {
+		return NewLocalService(config.Path)
+	})
+}
+
+// RegisterBackend makes a vault backend available by name. Registering a
+// backend with the same name twice will replace the first registration.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	backends[name] = factory
+}
+
+// Backends returns the names of all registered vault backends
+func Backends() []string {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewServiceForBackend creates a vault Service using the backend registered as name
+func NewServiceForBackend(name string, config BackendConfig) (Service, error) {
+	backendsMutex.RLock()
+	factory, ok := backends[name]
+	backendsMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("vault backend '%s' not supported - supported backends are %v", name, Backends())
+	}
+	return factory(config)
+}
@@ -0,0 +1,271 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheCoalesceWindow is how long a cached object survives being invalidated, so several
+// callers refreshing the same object at about the same time share one read. Versions are
+// always removed, so a change is never missed.
+const cacheCoalesceWindow = 5 * time.Second
+
+// cacheVersionVariant is the variant versions of objects are cached as
+const cacheVersionVariant = "version"
+
+// CacheInvalidator is implemented by Services caching objects read from vaults
+type CacheInvalidator interface {
+	// Invalidate removes all cached versions of the object in vaultSpec, or of all
+	// objects in the vault if no object name is set
+	Invalidate(vaultSpec *akvs.AzureKeyVault)
+}
+
+// cacheObjectKey identifies an object in a vault, regardless of version
+type cacheObjectKey struct {
+	cloud  string
+	vault  string
+	name   string
+	object akvs.AzureKeyVaultObjectType
+}
+
+// cachedSecret is a secret value with the version it was read from
+type cachedSecret struct {
+	value   string
+	version *ObjectVersion
+}
+
+type cacheEntry struct {
+	value   interface{}
+	fetched time.Time
+}
+
+// CachedService is a Service caching objects read from another Service for a while, and
+// coalescing concurrent reads of the same object into one. Objects are cached by vault,
+// name, type and version.
+type CachedService struct {
+	service Service
+	ttl     time.Duration
+	now     func() time.Time
+	group   singleflight.Group
+
+	mu      sync.Mutex
+	entries map[cacheObjectKey]map[string]cacheEntry
+}
+
+// NewCachedService creates a CachedService caching objects read from service for ttl
+func NewCachedService(service Service, ttl time.Duration) *CachedService {
+	return &CachedService{
+		service: service,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[cacheObjectKey]map[string]cacheEntry),
+	}
+}
+
+// GetSecret returns the secret from the cache, or reads it from the vault
+func (c *CachedService) GetSecret(vaultSpec *akvs.AzureKeyVault) (string, error) {
+	secret, _, err := c.GetSecretWithVersion(vaultSpec)
+	return secret, err
+}
+
+// GetSecretWithVersion returns the secret and the version it was read from from the cache,
+// or reads them from the vault
+func (c *CachedService) GetSecretWithVersion(vaultSpec *akvs.AzureKeyVault) (string, *ObjectVersion, error) {
+	value, err := c.get(vaultSpec, "secret", func() (interface{}, error) {
+		secret, version, err := c.service.GetSecretWithVersion(vaultSpec)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedSecret{value: secret, version: version}, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	secret := value.(*cachedSecret)
+	return secret.value, secret.version, nil
+}
+
+// GetKey returns a copy of the key from the cache, or reads it from the vault
+func (c *CachedService) GetKey(vaultSpec *akvs.AzureKeyVault) (*Key, error) {
+	value, err := c.get(vaultSpec, "key", func() (interface{}, error) {
+		return c.service.GetKey(vaultSpec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	key := *value.(*Key)
+	return &key, nil
+}
+
+// GetCertificate returns a copy of the certificate from the cache, or reads it from the vault
+func (c *CachedService) GetCertificate(vaultSpec *akvs.AzureKeyVault, exportPrivateKey bool) (*Certificate, error) {
+	value, err := c.get(vaultSpec, fmt.Sprintf("certificate/%t", exportPrivateKey), func() (interface{}, error) {
+		return c.service.GetCertificate(vaultSpec, exportPrivateKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Callers may change the certificate chain, like when dropping the root
+	cert := *value.(*Certificate)
+	cert.Certificates = append([]*x509.Certificate(nil), cert.Certificates...)
+	return &cert, nil
+}
+
+// GetObjectVersion returns the version of the object from the cache, or reads it from the vault.
+// Values of the object cached from another version are removed when a new version is read.
+func (c *CachedService) GetObjectVersion(vaultSpec *akvs.AzureKeyVault) (*ObjectVersion, error) {
+	value, err := c.get(vaultSpec, cacheVersionVariant, func() (interface{}, error) {
+		version, err := c.service.GetObjectVersion(vaultSpec)
+		if err != nil {
+			return nil, err
+		}
+		if vaultSpec.Object.Version == "" {
+			c.removeOtherVersions(newCacheObjectKey(vaultSpec), version)
+		}
+		return version, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	version := *value.(*ObjectVersion)
+	return &version, nil
+}
+
+// ListSecrets lists the secrets in the vault, which is never cached
+func (c *CachedService) ListSecrets(vaultSpec *akvs.AzureKeyVault) ([]SecretItem, error) {
+	return c.service.ListSecrets(vaultSpec)
+}
+
+// Invalidate removes all cached versions of the object in vaultSpec, or of all objects in
+// the vault if no object name is set. Values read within the last few seconds are kept, but
+// the version of the object is always removed, so the next version lookup reads the vault.
+func (c *CachedService) Invalidate(vaultSpec *akvs.AzureKeyVault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for objectKey, entries := range c.entries {
+		if objectKey.cloud != vaultSpec.Cloud || objectKey.vault != vaultSpec.Name {
+			continue
+		}
+		if vaultSpec.Object.Name != "" && (objectKey.name != vaultSpec.Object.Name || objectKey.object != vaultSpec.Object.Type) {
+			continue
+		}
+
+		for variant, entry := range entries {
+			if strings.HasPrefix(variant, cacheVersionVariant+"/") || now.Sub(entry.fetched) >= cacheCoalesceWindow {
+				delete(entries, variant)
+			}
+		}
+		if len(entries) == 0 {
+			delete(c.entries, objectKey)
+		}
+	}
+}
+
+// get returns the cached value of the object in vaultSpec for variant, or reads it using
+// fetch, sharing the result with concurrent reads of the same value. Errors are not cached.
+func (c *CachedService) get(vaultSpec *akvs.AzureKeyVault, variant string, fetch func() (interface{}, error)) (interface{}, error) {
+	objectKey := newCacheObjectKey(vaultSpec)
+	variant = variant + "/" + vaultSpec.Object.Version
+
+	if value, ok := c.lookup(objectKey, variant); ok {
+		return value, nil
+	}
+
+	callKey := fmt.Sprintf("%s/%s/%s/%s/%s", objectKey.cloud, objectKey.vault, objectKey.object, objectKey.name, variant)
+	value, err, _ := c.group.Do(callKey, func() (interface{}, error) {
+		value, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		c.store(objectKey, variant, value)
+		return value, nil
+	})
+	return value, err
+}
+
+// removeOtherVersions removes the cached values of the latest version of the object, when
+// they were read from another version than version
+func (c *CachedService) removeOtherVersions(objectKey cacheObjectKey, version *ObjectVersion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.entries[objectKey]
+	for variant, entry := range entries {
+		if !strings.HasSuffix(variant, "/") || strings.HasPrefix(variant, cacheVersionVariant+"/") {
+			continue
+		}
+		if cached := cachedValueVersion(entry.value); cached != nil && cached.Version != version.Version {
+			delete(entries, variant)
+		}
+	}
+}
+
+// cachedValueVersion returns the version a cached value was read from, if known
+func cachedValueVersion(value interface{}) *ObjectVersion {
+	switch v := value.(type) {
+	case *cachedSecret:
+		return v.version
+	case *Key:
+		return v.Version
+	case *Certificate:
+		return v.Version
+	}
+	return nil
+}
+
+func newCacheObjectKey(vaultSpec *akvs.AzureKeyVault) cacheObjectKey {
+	return cacheObjectKey{
+		cloud:  vaultSpec.Cloud,
+		vault:  vaultSpec.Name,
+		name:   vaultSpec.Object.Name,
+		object: vaultSpec.Object.Type,
+	}
+}
+
+func (c *CachedService) lookup(objectKey cacheObjectKey, variant string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[objectKey][variant]
+	if !ok || c.now().Sub(entry.fetched) >= c.ttl {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *CachedService) store(objectKey cacheObjectKey, variant string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, ok := c.entries[objectKey]
+	if !ok {
+		entries = make(map[string]cacheEntry)
+		c.entries[objectKey] = entries
+	}
+	entries[variant] = cacheEntry{value: value, fetched: c.now()}
+}
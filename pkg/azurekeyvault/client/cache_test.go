@@ -0,0 +1,222 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+type countingService struct {
+	requests int32
+	release  chan struct{}
+	err      error
+	version  string
+}
+
+func (s *countingService) GetSecret(vaultSpec *akvs.AzureKeyVault) (string, error) {
+	secret, _, err := s.GetSecretWithVersion(vaultSpec)
+	return secret, err
+}
+
+func (s *countingService) GetSecretWithVersion(vaultSpec *akvs.AzureKeyVault) (string, *ObjectVersion, error) {
+	n := atomic.AddInt32(&s.requests, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	if s.err != nil {
+		return "", nil, s.err
+	}
+	return fmt.Sprintf("%s-%d", vaultSpec.Object.Name, n), &ObjectVersion{Version: s.version}, nil
+}
+
+func (s *countingService) GetKey(vaultSpec *akvs.AzureKeyVault) (*Key, error) {
+	atomic.AddInt32(&s.requests, 1)
+	return &Key{}, nil
+}
+
+func (s *countingService) GetCertificate(vaultSpec *akvs.AzureKeyVault, exportPrivateKey bool) (*Certificate, error) {
+	atomic.AddInt32(&s.requests, 1)
+	return &Certificate{Certificates: []*x509.Certificate{{}, {}}}, nil
+}
+
+func (s *countingService) GetObjectVersion(vaultSpec *akvs.AzureKeyVault) (*ObjectVersion, error) {
+	atomic.AddInt32(&s.requests, 1)
+	return &ObjectVersion{Version: s.version}, nil
+}
+
+func (s *countingService) ListSecrets(vaultSpec *akvs.AzureKeyVault) ([]SecretItem, error) {
+	atomic.AddInt32(&s.requests, 1)
+	return nil, nil
+}
+
+func newTestCache(service Service, now *time.Time) *CachedService {
+	cache := NewCachedService(service, time.Minute)
+	cache.now = func() time.Time { return *now }
+	return cache
+}
+
+func testVaultSpec(name string) *akvs.AzureKeyVault {
+	return &akvs.AzureKeyVault{
+		Name: "my-vault",
+		Object: akvs.AzureKeyVaultObject{
+			Name: name,
+			Type: akvs.AzureKeyVaultObjectTypeSecret,
+		},
+	}
+}
+
+func TestCachedServiceCachesUntilTTL(t *testing.T) {
+	now := time.Now()
+	service := &countingService{}
+	cache := newTestCache(service, &now)
+
+	first, _ := cache.GetSecret(testVaultSpec("my-secret"))
+	second, _ := cache.GetSecret(testVaultSpec("my-secret"))
+	if first != second || service.requests != 1 {
+		t.Errorf("expected one request, but got %d with values '%s' and '%s'", service.requests, first, second)
+	}
+
+	versioned := testVaultSpec("my-secret")
+	versioned.Object.Version = "abc"
+	cache.GetSecret(versioned)
+	if service.requests != 2 {
+		t.Errorf("expected each version to be cached separately")
+	}
+
+	now = now.Add(time.Minute)
+	if third, _ := cache.GetSecret(testVaultSpec("my-secret")); third == first {
+		t.Error("expected secret to be read again after the TTL")
+	}
+}
+
+func TestCachedServiceInvalidate(t *testing.T) {
+	now := time.Now()
+	service := &countingService{}
+	cache := newTestCache(service, &now)
+
+	cache.GetSecret(testVaultSpec("my-secret"))
+	cache.GetSecret(testVaultSpec("other-secret"))
+
+	// Objects read just now are shared with others polling them at the same time
+	cache.Invalidate(testVaultSpec("my-secret"))
+	cache.GetSecret(testVaultSpec("my-secret"))
+	if service.requests != 2 {
+		t.Errorf("expected object read within the coalesce window to stay cached")
+	}
+
+	now = now.Add(cacheCoalesceWindow)
+	cache.Invalidate(testVaultSpec("my-secret"))
+	cache.GetSecret(testVaultSpec("my-secret"))
+	cache.GetSecret(testVaultSpec("other-secret"))
+	if service.requests != 3 {
+		t.Errorf("expected only the invalidated object to be read again, but got %d requests", service.requests)
+	}
+
+	now = now.Add(cacheCoalesceWindow)
+	cache.Invalidate(testVaultSpec(""))
+	cache.GetSecret(testVaultSpec("my-secret"))
+	cache.GetSecret(testVaultSpec("other-secret"))
+	if service.requests != 5 {
+		t.Errorf("expected all objects in the vault to be read again, but got %d requests", service.requests)
+	}
+}
+
+func TestCachedServiceInvalidatesVersions(t *testing.T) {
+	now := time.Now()
+	service := &countingService{version: "v1"}
+	cache := newTestCache(service, &now)
+
+	first, _ := cache.GetSecret(testVaultSpec("my-secret"))
+	cache.GetObjectVersion(testVaultSpec("my-secret"))
+	if service.requests != 2 {
+		t.Fatalf("expected secret and version to be read, but got %d requests", service.requests)
+	}
+
+	// A change right after a poll is not hidden by the coalesce window
+	service.version = "v2"
+	cache.Invalidate(testVaultSpec("my-secret"))
+	version, _ := cache.GetObjectVersion(testVaultSpec("my-secret"))
+	if service.requests != 3 || version.Version != "v2" {
+		t.Errorf("expected version to be read again after invalidation, but got '%s' after %d requests", version.Version, service.requests)
+	}
+
+	if second, _ := cache.GetSecret(testVaultSpec("my-secret")); second == first || service.requests != 4 {
+		t.Errorf("expected secret cached from another version to be read again, but got '%s' after %d requests", second, service.requests)
+	}
+}
+
+func TestCachedServiceCoalescesRequests(t *testing.T) {
+	now := time.Now()
+	service := &countingService{release: make(chan struct{})}
+	cache := newTestCache(service, &now)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.GetSecret(testVaultSpec("my-secret"))
+		}()
+	}
+
+	// Give all callers time to join the request in flight before releasing it
+	time.Sleep(50 * time.Millisecond)
+	close(service.release)
+	wg.Wait()
+
+	if service.requests != 1 {
+		t.Errorf("expected concurrent reads to share one request, but got %d", service.requests)
+	}
+}
+
+func TestCachedServiceDoesNotCacheErrors(t *testing.T) {
+	now := time.Now()
+	service := &countingService{err: fmt.Errorf("some error")}
+	cache := newTestCache(service, &now)
+
+	if _, err := cache.GetSecret(testVaultSpec("my-secret")); err == nil {
+		t.Fatal("expected error")
+	}
+	service.err = nil
+	if _, err := cache.GetSecret(testVaultSpec("my-secret")); err != nil || service.requests != 2 {
+		t.Errorf("expected secret to be read again after error, got %d requests and error %v", service.requests, err)
+	}
+}
+
+func TestCachedServiceCopiesCertificates(t *testing.T) {
+	now := time.Now()
+	cache := newTestCache(&countingService{}, &now)
+
+	vaultSpec := testVaultSpec("my-cert")
+	vaultSpec.Object.Type = akvs.AzureKeyVaultObjectTypeCertificate
+
+	cert, _ := cache.GetCertificate(vaultSpec, true)
+	cert.Certificates = cert.Certificates[:1]
+	cert.Certificates[0] = nil
+
+	cached, _ := cache.GetCertificate(vaultSpec, true)
+	if len(cached.Certificates) != 2 || cached.Certificates[0] == nil {
+		t.Error("expected changes to a returned certificate not to change the cached certificate")
+	}
+}
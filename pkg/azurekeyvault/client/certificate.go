@@ -19,12 +19,15 @@ package client
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"strings"
 
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
 	"golang.org/x/crypto/pkcs12"
 )
 
@@ -37,16 +40,24 @@ const (
 
 	// CertificateKeyTypeEcdsa represents private key type ECDSA
 	CertificateKeyTypeEcdsa = "ecdsa"
+
+	// CertificateKeyTypeEd25519 represents private key type Ed25519
+	CertificateKeyTypeEd25519 CertificateKeyType = "ed25519"
 )
 
+// ErrKeyPairMismatch is returned by VerifyKeyPair when the private key does not match the leaf certificate
+var ErrKeyPairMismatch = errors.New("private key does not match certificate")
+
 // Certificate handles data on Certificates from Azure Key Vault
 type Certificate struct {
-	// Has the complete certificate with both public and private keys, if both exists
+	// Has the complete certificate with both public and private keys, if both exists.
+	// The leaf certificate is first, followed by the rest of the chain ordered leaf-first.
 	Certificates []*x509.Certificate
 
-	PrivateKeyRaw   []byte
-	PrivateKeyRsa   *rsa.PrivateKey
-	PrivateKeyEcdsa *ecdsa.PrivateKey
+	PrivateKeyRaw     []byte
+	PrivateKeyRsa     *rsa.PrivateKey
+	PrivateKeyEcdsa   *ecdsa.PrivateKey
+	PrivateKeyEd25519 ed25519.PrivateKey
 
 	raw []byte
 
@@ -54,6 +65,9 @@ type Certificate struct {
 
 	// Indicate if Certificate has private key
 	HasPrivateKey bool
+
+	// Version is the version of the certificate in the vault it was read from, if known
+	Version *ObjectVersion
 }
 
 // NewCertificateFromPem creates a new Certificate from a base64 encoded pem string
@@ -104,39 +118,117 @@ func NewCertificateFromDer(der []byte) (*Certificate, error) {
 
 	cert.HasPrivateKey = false
 	cert.Certificates = append(cert.Certificates, pubCerts...)
+	cert.orderCertificates()
 
 	cert.raw = der
 	return &cert, nil
 }
 
-// ExportPrivateKeyAsPem returns a pem formatted certificate
+// VerifyKeyPair returns ErrKeyPairMismatch if the private key does not match the public key
+// of the leaf certificate
+func (cert *Certificate) VerifyKeyPair() error {
+	if !cert.HasPrivateKey {
+		return fmt.Errorf("certificate has no private key")
+	}
+	if len(cert.Certificates) == 0 {
+		return fmt.Errorf("certificate has no public key")
+	}
+	if !cert.matchesPrivateKey(cert.Certificates[0]) {
+		return ErrKeyPairMismatch
+	}
+	return nil
+}
+
+// DropRoot removes the self-signed root certificate from the end of the chain, as clients
+// must already trust the root for the chain to be valid. A self-signed leaf is kept.
+func (cert *Certificate) DropRoot() {
+	if last := len(cert.Certificates) - 1; last > 0 && isSelfSigned(cert.Certificates[last]) {
+		cert.Certificates = cert.Certificates[:last]
+	}
+}
+
+// ExportPrivateKey returns the pem formatted private key in the given format,
+// defaulting to the traditional format of the key type
+func (cert *Certificate) ExportPrivateKey(format akvs.AzureKeyVaultPrivateKeyFormat) ([]byte, error) {
+	switch format {
+	case "", akvs.AzureKeyVaultPrivateKeyFormatTraditional:
+		return cert.ExportPrivateKeyAsPem()
+	case akvs.AzureKeyVaultPrivateKeyFormatPkcs8:
+		return cert.ExportPrivateKeyAsPkcs8Pem()
+	default:
+		return nil, fmt.Errorf("private key format '%s' not supported - supported formats are %s and %s", format, akvs.AzureKeyVaultPrivateKeyFormatTraditional, akvs.AzureKeyVaultPrivateKeyFormatPkcs8)
+	}
+}
+
+// ExportPrivateKeyAsPem returns the pem formatted private key in the traditional format
+// of the key type - PKCS#1 (RSA PRIVATE KEY) for rsa and SEC 1 (EC PRIVATE KEY) for ecdsa.
+// Ed25519 keys have no traditional format and are exported as PKCS#8.
 func (cert *Certificate) ExportPrivateKeyAsPem() ([]byte, error) {
 	if !cert.HasPrivateKey {
 		return nil, fmt.Errorf("certificate has no private key")
 	}
 
-	var derKey []byte
-	var err error
+	var privKeyBlock *pem.Block
 
 	switch cert.PrivateKeyType {
 	case CertificateKeyTypeRsa:
-		derKey = x509.MarshalPKCS1PrivateKey(cert.PrivateKeyRsa)
+		privKeyBlock = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKeyRsa),
+		}
 	case CertificateKeyTypeEcdsa:
-		derKey, err = x509.MarshalECPrivateKey(cert.PrivateKeyEcdsa)
+		derKey, err := x509.MarshalECPrivateKey(cert.PrivateKeyEcdsa)
 		if err != nil {
 			return nil, err
 		}
+		privKeyBlock = &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: derKey,
+		}
+	case CertificateKeyTypeEd25519:
+		return cert.ExportPrivateKeyAsPkcs8Pem()
 	default:
 		return nil, fmt.Errorf("private key type '%s' currently not supported for pem export", cert.PrivateKeyType)
 	}
 
+	return pem.EncodeToMemory(privKeyBlock), nil
+}
+
+// ExportPrivateKeyAsPkcs8Pem returns the pem formatted private key as PKCS#8 (PRIVATE KEY),
+// which is supported for all key types and required by Java
+func (cert *Certificate) ExportPrivateKeyAsPkcs8Pem() ([]byte, error) {
+	derKey, err := cert.exportPrivateKeyAsPkcs8Der()
+	if err != nil {
+		return nil, err
+	}
+
 	privKeyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
+		Type:  "PRIVATE KEY",
 		Bytes: derKey,
 	}
 	return pem.EncodeToMemory(privKeyBlock), nil
 }
 
+func (cert *Certificate) exportPrivateKeyAsPkcs8Der() ([]byte, error) {
+	if !cert.HasPrivateKey {
+		return nil, fmt.Errorf("certificate has no private key")
+	}
+
+	var privKey interface{}
+	switch cert.PrivateKeyType {
+	case CertificateKeyTypeRsa:
+		privKey = cert.PrivateKeyRsa
+	case CertificateKeyTypeEcdsa:
+		privKey = cert.PrivateKeyEcdsa
+	case CertificateKeyTypeEd25519:
+		privKey = cert.PrivateKeyEd25519
+	default:
+		return nil, fmt.Errorf("private key type '%s' currently not supported for pkcs#8 export", cert.PrivateKeyType)
+	}
+
+	return x509.MarshalPKCS8PrivateKey(privKey)
+}
+
 // ExportPublicKeyAsPem returns a pem formatted certificate
 func (cert *Certificate) ExportPublicKeyAsPem() ([]byte, error) {
 	if len(cert.Certificates) == 0 {
@@ -161,6 +253,229 @@ func (cert *Certificate) ExportRaw() []byte {
 	return cert.raw
 }
 
+// Export returns the certificate in the given format. The pem format is the certificate chain
+// followed by the private key, while pkcs12, jks and jks-truststore are password protected
+// bundles using alias as the friendly name of the entries.
+func (cert *Certificate) Export(format akvs.AzureKeyVaultOutputFormat, privateKeyFormat akvs.AzureKeyVaultPrivateKeyFormat, alias, password string) ([]byte, error) {
+	switch format {
+	case akvs.AzureKeyVaultOutputFormatPem:
+		return cert.ExportCombinedPem(privateKeyFormat)
+	case akvs.AzureKeyVaultOutputFormatPkcs12:
+		return cert.ExportPkcs12(alias, password)
+	case akvs.AzureKeyVaultOutputFormatJks:
+		return cert.ExportJksKeyStore(alias, password)
+	case akvs.AzureKeyVaultOutputFormatJksTrustStore:
+		return cert.ExportJksTrustStore(alias, password)
+	default:
+		return nil, fmt.Errorf("certificate format '%s' not supported - supported formats are %s, %s, %s and %s", format, akvs.AzureKeyVaultOutputFormatPem, akvs.AzureKeyVaultOutputFormatPkcs12, akvs.AzureKeyVaultOutputFormatJks, akvs.AzureKeyVaultOutputFormatJksTrustStore)
+	}
+}
+
+// ExportLeafAsPem returns the pem formatted leaf certificate, without the rest of the chain
+func (cert *Certificate) ExportLeafAsPem() ([]byte, error) {
+	if len(cert.Certificates) == 0 {
+		return nil, fmt.Errorf("certificate has no public key")
+	}
+	return exportCertificatesAsPem(cert.Certificates[:1]), nil
+}
+
+// ExportChainAsPem returns the pem formatted certificate chain, without the leaf certificate.
+// The result is empty if the certificate has no chain.
+func (cert *Certificate) ExportChainAsPem() ([]byte, error) {
+	if len(cert.Certificates) == 0 {
+		return nil, fmt.Errorf("certificate has no public key")
+	}
+	return exportCertificatesAsPem(cert.Certificates[1:]), nil
+}
+
+// ExportCombinedPem returns the pem formatted certificate chain followed by the private key
+// in the given format, as used by HAProxy and other consumers wanting a single file
+func (cert *Certificate) ExportCombinedPem(privateKeyFormat akvs.AzureKeyVaultPrivateKeyFormat) ([]byte, error) {
+	pubKey, err := cert.ExportPublicKeyAsPem()
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := cert.ExportPrivateKey(privateKeyFormat)
+	if err != nil {
+		return nil, err
+	}
+	return append(pubKey, privKey...), nil
+}
+
+// ExportPkcs12 returns the private key and certificate chain as a password protected PKCS#12
+// bundle. Salts are random, so the bundle differs for each export - the Controller only
+// exports again when the certificate changes in Azure Key Vault.
+func (cert *Certificate) ExportPkcs12(alias, password string) ([]byte, error) {
+	if len(cert.Certificates) == 0 {
+		return nil, fmt.Errorf("certificate has no public key")
+	}
+	derKey, err := cert.exportPrivateKeyAsPkcs8Der()
+	if err != nil {
+		return nil, err
+	}
+
+	return encodePkcs12(derKey, cert.Certificates, alias, password)
+}
+
+// ExportJksKeyStore returns the private key and certificate chain as a password protected
+// Java KeyStore, with alias as the alias of the key entry. Like ExportPkcs12, the key is
+// protected using a random salt.
+func (cert *Certificate) ExportJksKeyStore(alias, password string) ([]byte, error) {
+	if len(cert.Certificates) == 0 {
+		return nil, fmt.Errorf("certificate has no public key")
+	}
+	derKey, err := cert.exportPrivateKeyAsPkcs8Der()
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeJksKeyStore(derKey, cert.Certificates, strings.ToLower(alias), password, cert.Certificates[0].NotBefore)
+}
+
+// GetCertificatePassword gets the password for exporting the certificate of secretSpec in a
+// password protected format from the Azure Key Vault secret in output.secret.passwordSecret,
+// which is read from the same vault as the certificate. Pem is not password protected.
+func GetCertificatePassword(vaultService Service, secretSpec *akvs.AzureKeyVaultSecret, format akvs.AzureKeyVaultOutputFormat) (string, error) {
+	if format == akvs.AzureKeyVaultOutputFormatPem {
+		return "", nil
+	}
+
+	passwordSecret := secretSpec.Spec.Output.Secret.PasswordSecret
+	if passwordSecret == "" {
+		return "", fmt.Errorf("no passwordSecret spesified in output secret for format '%s'", format)
+	}
+
+	passwordVault := secretSpec.Spec.Vault.DeepCopy()
+	passwordVault.Object = akvs.AzureKeyVaultObject{
+		Name: passwordSecret,
+		Type: akvs.AzureKeyVaultObjectTypeSecret,
+	}
+
+	password, err := vaultService.GetSecret(passwordVault)
+	if err != nil {
+		return "", fmt.Errorf("failed to get password secret '%s', error: %+v", passwordSecret, err)
+	}
+	return password, nil
+}
+
+// ExportJksTrustStore returns the certificate chain as a password protected Java KeyStore
+// with trusted certificate entries only, not requiring the private key
+func (cert *Certificate) ExportJksTrustStore(alias, password string) ([]byte, error) {
+	if len(cert.Certificates) == 0 {
+		return nil, fmt.Errorf("certificate has no public key")
+	}
+	return encodeJksTrustStore(cert.Certificates, strings.ToLower(alias), password, cert.Certificates[0].NotBefore)
+}
+
+func exportCertificatesAsPem(certs []*x509.Certificate) []byte {
+	var pemCerts bytes.Buffer
+	for _, pubCert := range certs {
+		pemCerts.Write(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: pubCert.Raw,
+		}))
+	}
+	return pemCerts.Bytes()
+}
+
+// orderCertificates puts the leaf certificate first, followed by its issuers up to the root,
+// regardless of the order the certificates were imported in. The leaf is the certificate
+// matching the private key, or else the certificate not issuing any of the others.
+// Certificates not part of the chain are kept at the end.
+func (cert *Certificate) orderCertificates() {
+	certs := cert.Certificates
+	if len(certs) < 2 {
+		return
+	}
+
+	leaf := -1
+	if cert.HasPrivateKey {
+		for i, c := range certs {
+			if cert.matchesPrivateKey(c) {
+				leaf = i
+				break
+			}
+		}
+	}
+	if leaf < 0 {
+		leaf = 0
+		for i, c := range certs {
+			if !issuesAny(c, certs) {
+				leaf = i
+				break
+			}
+		}
+	}
+
+	used := make([]bool, len(certs))
+	used[leaf] = true
+	ordered := []*x509.Certificate{certs[leaf]}
+	for current := certs[leaf]; !isSelfSigned(current); {
+		issuer := -1
+		for i, c := range certs {
+			if used[i] || !bytes.Equal(c.RawSubject, current.RawIssuer) {
+				continue
+			}
+			if issuer < 0 || current.CheckSignatureFrom(c) == nil {
+				issuer = i
+			}
+		}
+		if issuer < 0 {
+			break
+		}
+
+		used[issuer] = true
+		current = certs[issuer]
+		ordered = append(ordered, current)
+	}
+
+	for i, c := range certs {
+		if !used[i] {
+			ordered = append(ordered, c)
+		}
+	}
+	cert.Certificates = ordered
+}
+
+// matchesPrivateKey returns true if the public key of c belongs to the private key
+func (cert *Certificate) matchesPrivateKey(c *x509.Certificate) bool {
+	var publicKey interface{}
+	switch cert.PrivateKeyType {
+	case CertificateKeyTypeRsa:
+		publicKey = &cert.PrivateKeyRsa.PublicKey
+	case CertificateKeyTypeEcdsa:
+		publicKey = &cert.PrivateKeyEcdsa.PublicKey
+	case CertificateKeyTypeEd25519:
+		publicKey = cert.PrivateKeyEd25519.Public()
+	default:
+		return false
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	certDer, err := x509.MarshalPKIXPublicKey(c.PublicKey)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(der, certDer)
+}
+
+// issuesAny returns true if c is the issuer of any of the other certificates
+func issuesAny(c *x509.Certificate, certs []*x509.Certificate) bool {
+	for _, other := range certs {
+		if other != c && bytes.Equal(other.RawIssuer, c.RawSubject) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSelfSigned(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawSubject, c.RawIssuer) && c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+}
+
 func importPem(pemCert string) (*Certificate, error) {
 	var cert Certificate
 	var publicDers []byte
@@ -187,6 +502,7 @@ func importPem(pemCert string) (*Certificate, error) {
 	if err != nil {
 		return nil, err
 	}
+	cert.orderCertificates()
 	return &cert, nil
 }
 
@@ -215,8 +531,14 @@ func parsePrivateKey(der []byte, out *Certificate) error {
 			out.PrivateKeyEcdsa = key
 			out.PrivateKeyType = CertificateKeyTypeEcdsa
 			return nil
+		case ed25519.PrivateKey:
+			out.HasPrivateKey = true
+			out.PrivateKeyRaw = der
+			out.PrivateKeyEd25519 = key
+			out.PrivateKeyType = CertificateKeyTypeEd25519
+			return nil
 		default:
-			return fmt.Errorf("unknown private key type found while parsing pkcs#8 - only rsa and ecdsa supported")
+			return fmt.Errorf("unknown private key type found while parsing pkcs#8 - only rsa, ecdsa and ed25519 supported")
 		}
 	}
 
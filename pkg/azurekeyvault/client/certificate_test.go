@@ -18,8 +18,25 @@ package client
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
 	"testing"
+	"time"
+
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	"golang.org/x/crypto/pkcs12"
 )
 
 var (
@@ -97,6 +114,80 @@ func TestGetPrivateKeyPem(t *testing.T) {
 	}
 }
 
+func TestExportPrivateKeyFormats(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		key             interface{}
+		keyType         CertificateKeyType
+		traditionalType string
+	}{
+		{name: "rsa", key: rsaKey, keyType: CertificateKeyTypeRsa, traditionalType: "RSA PRIVATE KEY"},
+		{name: "ecdsa", key: ecKey, keyType: CertificateKeyTypeEcdsa, traditionalType: "EC PRIVATE KEY"},
+		{name: "ed25519", key: edKey, keyType: CertificateKeyTypeEd25519, traditionalType: "PRIVATE KEY"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := NewCertificateFromPem(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.PrivateKeyType != test.keyType {
+				t.Fatalf("Expected private key type '%s', but got '%s'", test.keyType, cert.PrivateKeyType)
+			}
+
+			formats := map[akvs.AzureKeyVaultPrivateKeyFormat]string{
+				"": test.traditionalType,
+				akvs.AzureKeyVaultPrivateKeyFormatTraditional: test.traditionalType,
+				akvs.AzureKeyVaultPrivateKeyFormatPkcs8:       "PRIVATE KEY",
+			}
+			for format, blockType := range formats {
+				exported, err := cert.ExportPrivateKey(format)
+				if err != nil {
+					t.Fatalf("Failed to export private key as '%s', error: %+v", format, err)
+				}
+
+				block, _ := pem.Decode(exported)
+				if block == nil {
+					t.Fatalf("Failed to decode private key exported as '%s'", format)
+				}
+				if block.Type != blockType {
+					t.Errorf("Expected pem block type '%s' for format '%s', but got '%s'", blockType, format, block.Type)
+				}
+
+				var reimported Certificate
+				if err := parsePrivateKey(block.Bytes, &reimported); err != nil {
+					t.Fatalf("Failed to parse private key exported as '%s', error: %+v", format, err)
+				}
+				if reimported.PrivateKeyType != test.keyType {
+					t.Errorf("Expected reimported private key type '%s', but got '%s'", test.keyType, reimported.PrivateKeyType)
+				}
+			}
+
+			if _, err := cert.ExportPrivateKey("pkcs12"); err == nil {
+				t.Error("Expected error for unsupported private key format")
+			}
+		})
+	}
+}
+
 func TestGetPublicKeyPem(t *testing.T) {
 	pfxRaw, _ := base64.StdEncoding.DecodeString(pfxTestCert)
 	cert, err := NewCertificateFromPfx(pfxRaw)
@@ -128,3 +219,364 @@ func TestGetRawCert(t *testing.T) {
 		t.Error("Original cert does not match exported raw cert")
 	}
 }
+
+func TestExportPkcs12(t *testing.T) {
+	cert, err := NewCertificateFromPem(pemTestCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx, err := cert.Export(akvs.AzureKeyVaultOutputFormatPkcs12, "", "my-cert", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pkcs12.ToPEM(pfx, "wrong"); err == nil {
+		t.Error("Expected error decoding pkcs12 with wrong password")
+	}
+
+	privateKey, pubCert, err := pkcs12.Decode(pfx, "secret")
+	if err != nil {
+		t.Fatalf("Failed to decode pkcs12, error: %+v", err)
+	}
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); !ok || rsaKey.D.Cmp(cert.PrivateKeyRsa.D) != 0 {
+		t.Error("Private key in pkcs12 does not match certificate private key")
+	}
+	if !pubCert.Equal(cert.Certificates[0]) {
+		t.Error("Certificate in pkcs12 does not match certificate")
+	}
+
+	again, err := cert.ExportPkcs12("my-cert", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(pfx, again) {
+		t.Error("Expected random salts to give a different pkcs12 when exporting the same certificate twice")
+	}
+	if _, _, err := pkcs12.Decode(again, "secret"); err != nil {
+		t.Errorf("Failed to decode pkcs12 exported again, error: %+v", err)
+	}
+}
+
+func TestExportJks(t *testing.T) {
+	cert, err := NewCertificateFromPem(pemTestCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyStore, err := cert.Export(akvs.AzureKeyVaultOutputFormatJks, "", "My-Cert", "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readTestJks(t, keyStore, "changeit")
+	if len(entries) != 1 || entries[0].tag != jksPrivateKeyEntry || entries[0].alias != "my-cert" {
+		t.Fatalf("Expected one private key entry with alias 'my-cert', but got %+v", entries)
+	}
+	if len(entries[0].certs) != len(cert.Certificates) || !bytes.Equal(entries[0].certs[0], cert.Certificates[0].Raw) {
+		t.Error("Certificate chain in jks does not match certificate")
+	}
+
+	var keyInfo jksEncryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(entries[0].key, &keyInfo); err != nil {
+		t.Fatal(err)
+	}
+	if !keyInfo.Algorithm.Algorithm.Equal(oidJksKeyProtector) {
+		t.Errorf("Expected key protector algorithm, but got %s", keyInfo.Algorithm.Algorithm)
+	}
+
+	// Recover the key the same way as the Sun key protector
+	protected := keyInfo.EncryptedData
+	salt := protected[:jksKeyProtectorSaltSize]
+	encrypted := protected[jksKeyProtectorSaltSize : len(protected)-jksKeyProtectorHashSize]
+	derKey := make([]byte, len(encrypted))
+	digest := salt
+	for i := 0; i < len(encrypted); i += sha1.Size {
+		hash := sha1.Sum(append(jksPasswordBytes("changeit"), digest...))
+		digest = hash[:]
+		for j := 0; j < sha1.Size && i+j < len(encrypted); j++ {
+			derKey[i+j] = encrypted[i+j] ^ digest[j]
+		}
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(derKey)
+	if err != nil {
+		t.Fatalf("Failed to parse key recovered from jks, error: %+v", err)
+	}
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); !ok || rsaKey.D.Cmp(cert.PrivateKeyRsa.D) != 0 {
+		t.Error("Private key in jks does not match certificate private key")
+	}
+
+	trustStore, err := cert.Export(akvs.AzureKeyVaultOutputFormatJksTrustStore, "", "my-cert", "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = readTestJks(t, trustStore, "changeit")
+	if len(entries) != 1 || entries[0].tag != jksTrustedCertEntry || !bytes.Equal(entries[0].certs[0], cert.Certificates[0].Raw) {
+		t.Fatalf("Expected one trusted certificate entry, but got %+v", entries)
+	}
+}
+
+func TestExportLeafAndChain(t *testing.T) {
+	pfxRaw, _ := base64.StdEncoding.DecodeString(pfxTestCert)
+	cert, err := NewCertificateFromPfx(pfxRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := cert.ExportLeafAsPem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := cert.ExportChainAsPem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := cert.ExportPublicKeyAsPem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(leaf, chain...), all) {
+		t.Error("Expected leaf and chain to make up the complete certificate")
+	}
+
+	combined, err := cert.Export(akvs.AzureKeyVaultOutputFormatPem, akvs.AzureKeyVaultPrivateKeyFormatPkcs8, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	combinedCert, err := NewCertificateFromPem(string(combined))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !combinedCert.HasPrivateKey || len(combinedCert.Certificates) != len(cert.Certificates) {
+		t.Error("Expected combined pem to contain both certificates and private key")
+	}
+}
+
+type testJksEntry struct {
+	tag   uint32
+	alias string
+	key   []byte
+	certs [][]byte
+}
+
+func readTestJks(t *testing.T, data []byte, password string) []testJksEntry {
+	content, storedDigest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	digest := sha1.Sum(append(append(jksPasswordBytes(password), []byte(jksDigestWhitener)...), content...))
+	if !bytes.Equal(digest[:], storedDigest) {
+		t.Fatal("Invalid jks digest")
+	}
+
+	r := bytes.NewReader(content)
+	readUint32 := func() uint32 {
+		var v uint32
+		if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	readN := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	readUTF := func() string {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			t.Fatal(err)
+		}
+		return string(readN(int(n)))
+	}
+	readCert := func() []byte {
+		if certType := readUTF(); certType != jksCertificateType {
+			t.Fatalf("Unexpected certificate type '%s'", certType)
+		}
+		return readN(int(readUint32()))
+	}
+
+	if readUint32() != jksMagic || readUint32() != jksVersion {
+		t.Fatal("Invalid jks header")
+	}
+
+	var entries []testJksEntry
+	for count := readUint32(); count > 0; count-- {
+		entry := testJksEntry{tag: readUint32(), alias: readUTF()}
+		readN(8)
+		if entry.tag == jksPrivateKeyEntry {
+			entry.key = readN(int(readUint32()))
+			for chain := readUint32(); chain > 0; chain-- {
+				entry.certs = append(entry.certs, readCert())
+			}
+		} else {
+			entry.certs = append(entry.certs, readCert())
+		}
+		entries = append(entries, entry)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("Unexpected %d bytes after jks entries", r.Len())
+	}
+	return entries
+}
+
+func TestCertificateChainOrder(t *testing.T) {
+	chain, leafKey := createTestChain(t)
+	root, intermediate, leaf := chain[0], chain[1], chain[2]
+
+	leafKeyDer, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pemChain bytes.Buffer
+	pem.Encode(&pemChain, &pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	pem.Encode(&pemChain, &pem.Block{Type: "PRIVATE KEY", Bytes: leafKeyDer})
+	pem.Encode(&pemChain, &pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	pem.Encode(&pemChain, &pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})
+
+	cert, err := NewCertificateFromPem(pemChain.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*x509.Certificate{leaf, intermediate, root}
+	for i := range expected {
+		if !cert.Certificates[i].Equal(expected[i]) {
+			t.Fatalf("Expected certificate %d to be '%s', but got '%s'", i, expected[i].Subject.CommonName, cert.Certificates[i].Subject.CommonName)
+		}
+	}
+
+	if err := cert.VerifyKeyPair(); err != nil {
+		t.Errorf("Expected key pair to match, but got error: %+v", err)
+	}
+
+	cert.DropRoot()
+	if len(cert.Certificates) != 2 || !cert.Certificates[1].Equal(intermediate) {
+		t.Error("Expected root certificate to be dropped")
+	}
+	cert.DropRoot()
+	if len(cert.Certificates) != 2 {
+		t.Error("Expected intermediate certificate to be kept")
+	}
+
+	// Without a private key the leaf is the certificate not issuing any of the others
+	var pubChain []byte
+	for _, c := range []*x509.Certificate{intermediate, root, leaf} {
+		pubChain = append(pubChain, c.Raw...)
+	}
+	pubCert, err := NewCertificateFromDer(pubChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		if !pubCert.Certificates[i].Equal(expected[i]) {
+			t.Fatalf("Expected certificate %d to be '%s', but got '%s'", i, expected[i].Subject.CommonName, pubCert.Certificates[i].Subject.CommonName)
+		}
+	}
+}
+
+func TestCertificateKeyPairMismatch(t *testing.T) {
+	chain, _ := createTestChain(t)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyDer, err := x509.MarshalECPrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pemChain bytes.Buffer
+	pem.Encode(&pemChain, &pem.Block{Type: "EC PRIVATE KEY", Bytes: otherKeyDer})
+	for _, c := range chain {
+		pem.Encode(&pemChain, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+
+	cert, err := NewCertificateFromPem(pemChain.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyKeyPair(); err != ErrKeyPairMismatch {
+		t.Errorf("Expected ErrKeyPairMismatch, but got: %+v", err)
+	}
+	if !cert.Certificates[0].Equal(chain[2]) {
+		t.Errorf("Expected leaf certificate first, but got '%s'", cert.Certificates[0].Subject.CommonName)
+	}
+}
+
+// createTestChain returns a root, intermediate and leaf certificate, with the private key of the leaf
+func createTestChain(t *testing.T) ([]*x509.Certificate, *ecdsa.PrivateKey) {
+	var chain []*x509.Certificate
+	var parent *x509.Certificate
+	var parentKey *ecdsa.PrivateKey
+
+	for i, name := range []string{"root", "intermediate", "leaf"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(i + 1)),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			BasicConstraintsValid: true,
+			IsCA:                  name != "leaf",
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chain = append(chain, cert)
+		parent, parentKey = cert, key
+	}
+	return chain, parentKey
+}
+
+func TestGetCertificatePassword(t *testing.T) {
+	service := &countingService{}
+	secretSpec := &akvs.AzureKeyVaultSecret{
+		Spec: akvs.AzureKeyVaultSecretSpec{
+			Vault: akvs.AzureKeyVault{
+				Name:   "my-vault",
+				Object: akvs.AzureKeyVaultObject{Name: "my-cert", Type: akvs.AzureKeyVaultObjectTypeCertificate},
+			},
+			Output: akvs.AzureKeyVaultOutput{Secret: akvs.AzureKeyVaultOutputSecret{PasswordSecret: "my-password"}},
+		},
+	}
+
+	if password, err := GetCertificatePassword(service, secretSpec, akvs.AzureKeyVaultOutputFormatPem); err != nil || password != "" {
+		t.Errorf("expected no password for pem, but got '%s', error: %+v", password, err)
+	}
+	if service.requests != 0 {
+		t.Errorf("expected no requests for pem, but got %d", service.requests)
+	}
+
+	password, err := GetCertificatePassword(service, secretSpec, akvs.AzureKeyVaultOutputFormatPkcs12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "my-password-1" {
+		t.Errorf("expected password from secret 'my-password', but got '%s'", password)
+	}
+	if secretSpec.Spec.Vault.Object.Name != "my-cert" {
+		t.Errorf("expected certificate vault object to be unchanged, but got '%s'", secretSpec.Spec.Vault.Object.Name)
+	}
+
+	secretSpec.Spec.Output.Secret.PasswordSecret = ""
+	if _, err := GetCertificatePassword(service, secretSpec, akvs.AzureKeyVaultOutputFormatPkcs12); err == nil {
+		t.Error("expected error for pkcs12 without passwordSecret")
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+// The Java KeyStore (JKS) format is proprietary, but simple and stable. A store is a list of
+// entries followed by a SHA-1 digest keyed with the store password, and private keys are
+// protected with the SHA-1 based key protector of the Sun provider.
+
+const (
+	jksMagic                 = 0xfeedfeed
+	jksVersion               = 2
+	jksPrivateKeyEntry       = 1
+	jksTrustedCertEntry      = 2
+	jksCertificateType       = "X.509"
+	jksDigestWhitener        = "Mighty Aphrodite"
+	jksKeyProtectorSaltSize  = 20
+	jksKeyProtectorHashSize  = sha1.Size
+	jksMaxModifiedUTF8Length = 0xffff
+)
+
+var oidJksKeyProtector = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1})
+
+type jksEncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// jksWriter writes the binary JKS format, keeping the first error
+type jksWriter struct {
+	buf bytes.Buffer
+	err error
+}
+
+// encodeJksKeyStore encodes the private key with its certificate chain as a JKS key store
+// with one private key entry, protected by password. The salt of the key protector is
+// random, so the output differs every time.
+func encodeJksKeyStore(privateKeyDer []byte, certs []*x509.Certificate, alias, password string, created time.Time) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("jks key store requires at least one certificate")
+	}
+
+	salt, err := randomSalt(jksKeyProtectorSaltSize)
+	if err != nil {
+		return nil, err
+	}
+	protectedKey, err := jksProtectKey(privateKeyDer, password, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newJksWriter(1)
+	w.writeUint32(jksPrivateKeyEntry)
+	w.writeUTF(alias)
+	w.writeTime(created)
+	w.writeBytes(protectedKey)
+	w.writeUint32(uint32(len(certs)))
+	for _, cert := range certs {
+		w.writeCertificate(cert)
+	}
+	return w.finish(password)
+}
+
+// encodeJksTrustStore encodes the certificates as a JKS trust store with one trusted
+// certificate entry each, protected by password. The first certificate gets alias as
+// its alias, and the rest gets alias suffixed with their position in certs.
+func encodeJksTrustStore(certs []*x509.Certificate, alias, password string, created time.Time) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("jks trust store requires at least one certificate")
+	}
+
+	w := newJksWriter(len(certs))
+	for i, cert := range certs {
+		entryAlias := alias
+		if i > 0 {
+			entryAlias = fmt.Sprintf("%s-%d", alias, i)
+		}
+
+		w.writeUint32(jksTrustedCertEntry)
+		w.writeUTF(entryAlias)
+		w.writeTime(created)
+		w.writeCertificate(cert)
+	}
+	return w.finish(password)
+}
+
+// jksProtectKey protects the PKCS#8 encoded private key the same way as the key protector
+// of the Sun provider, by xor-ing it with a SHA-1 based key stream
+func jksProtectKey(privateKeyDer []byte, password string, salt []byte) ([]byte, error) {
+	if len(salt) != jksKeyProtectorSaltSize {
+		return nil, fmt.Errorf("jks key protector salt must be %d bytes", jksKeyProtectorSaltSize)
+	}
+
+	passwordBytes := jksPasswordBytes(password)
+
+	var keyStream []byte
+	digest := salt
+	for len(keyStream) < len(privateKeyDer) {
+		hash := sha1.Sum(append(append([]byte{}, passwordBytes...), digest...))
+		digest = hash[:]
+		keyStream = append(keyStream, digest...)
+	}
+
+	protected := make([]byte, 0, len(salt)+len(privateKeyDer)+jksKeyProtectorHashSize)
+	protected = append(protected, salt...)
+	for i, b := range privateKeyDer {
+		protected = append(protected, b^keyStream[i])
+	}
+	checksum := sha1.Sum(append(append([]byte{}, passwordBytes...), privateKeyDer...))
+	protected = append(protected, checksum[:]...)
+
+	return asn1.Marshal(jksEncryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJksKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: protected,
+	})
+}
+
+// jksPasswordBytes returns the password as UTF-16 big endian without terminator, which is
+// how Java passes char arrays to digests in the JKS format
+func jksPasswordBytes(password string) []byte {
+	var passwordBytes []byte
+	for _, c := range utf16.Encode([]rune(password)) {
+		passwordBytes = append(passwordBytes, byte(c>>8), byte(c))
+	}
+	return passwordBytes
+}
+
+func newJksWriter(entries int) *jksWriter {
+	w := &jksWriter{}
+	w.writeUint32(jksMagic)
+	w.writeUint32(jksVersion)
+	w.writeUint32(uint32(entries))
+	return w
+}
+
+func (w *jksWriter) writeUint32(value uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], value)
+	w.buf.Write(b[:])
+}
+
+func (w *jksWriter) writeTime(t time.Time) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	w.buf.Write(b[:])
+}
+
+// writeUTF writes s the same way as java.io.DataOutput.writeUTF, which is UTF-8 except for
+// null characters and characters outside the basic multilingual plane
+func (w *jksWriter) writeUTF(s string) {
+	var encoded []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		switch {
+		case c >= 0x0001 && c <= 0x007f:
+			encoded = append(encoded, byte(c))
+		case c <= 0x07ff:
+			encoded = append(encoded, byte(0xc0|(c>>6)), byte(0x80|(c&0x3f)))
+		default:
+			encoded = append(encoded, byte(0xe0|(c>>12)), byte(0x80|((c>>6)&0x3f)), byte(0x80|(c&0x3f)))
+		}
+	}
+
+	if len(encoded) > jksMaxModifiedUTF8Length {
+		if w.err == nil {
+			w.err = fmt.Errorf("string of %d bytes too long for jks", len(encoded))
+		}
+		return
+	}
+
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(len(encoded)))
+	w.buf.Write(b[:])
+	w.buf.Write(encoded)
+}
+
+func (w *jksWriter) writeBytes(data []byte) {
+	w.writeUint32(uint32(len(data)))
+	w.buf.Write(data)
+}
+
+func (w *jksWriter) writeCertificate(cert *x509.Certificate) {
+	w.writeUTF(jksCertificateType)
+	w.writeBytes(cert.Raw)
+}
+
+// finish appends the integrity digest of the key store, which is a SHA-1 hash of the
+// password, the whitener and the key store content
+func (w *jksWriter) finish(password string) ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	digest := sha1.New()
+	digest.Write(jksPasswordBytes(password))
+	digest.Write([]byte(jksDigestWhitener))
+	digest.Write(w.buf.Bytes())
+	w.buf.Write(digest.Sum(nil))
+	return w.buf.Bytes(), nil
+}
@@ -0,0 +1,288 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyType contains the public key type
+type KeyType string
+
+const (
+	// KeyTypeRsa represents public key type RSA
+	KeyTypeRsa KeyType = "RSA"
+
+	// KeyTypeEc represents public key type EC
+	KeyTypeEc KeyType = "EC"
+)
+
+// Key handles data on public keys from Azure Key Vault
+type Key struct {
+	// ID is the key id in Azure Key Vault, if known
+	ID string
+
+	// Version is the version of the key in the vault it was read from, if known
+	Version *ObjectVersion
+
+	Type KeyType
+
+	PublicKeyRsa   *rsa.PublicKey
+	PublicKeyEcdsa *ecdsa.PublicKey
+}
+
+// jsonWebKey is the public part of a JSON Web Key as defined in RFC 7517,
+// which is also the format Azure Key Vault returns keys in
+type jsonWebKey struct {
+	Kid string `json:"kid,omitempty"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// NewKeyFromJwk creates a new Key from a JSON Web Key. Only the public part of the
+// key is used, and HSM key types like RSA-HSM are treated as their software equivalents.
+func NewKeyFromJwk(jwk []byte) (*Key, error) {
+	var webKey jsonWebKey
+	if err := json.Unmarshal(jwk, &webKey); err != nil {
+		return nil, fmt.Errorf("failed to parse json web key, error: %+v", err)
+	}
+
+	key := &Key{ID: webKey.Kid}
+
+	switch strings.TrimSuffix(webKey.Kty, "-HSM") {
+	case string(KeyTypeRsa):
+		n, err := decodeJwkInt(webKey.N, "n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJwkInt(webKey.E, "e")
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > int64(^uint32(0)>>1) {
+			return nil, fmt.Errorf("json web key has too large rsa exponent")
+		}
+
+		key.Type = KeyTypeRsa
+		key.PublicKeyRsa = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case string(KeyTypeEc):
+		curve, ok := jwkCurves[webKey.Crv]
+		if !ok {
+			return nil, fmt.Errorf("json web key curve '%s' not supported - only P-256, P-384 and P-521 supported", webKey.Crv)
+		}
+		x, err := decodeJwkInt(webKey.X, "x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJwkInt(webKey.Y, "y")
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("json web key point is not on curve '%s'", webKey.Crv)
+		}
+
+		key.Type = KeyTypeEc
+		key.PublicKeyEcdsa = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+
+	default:
+		return nil, fmt.Errorf("json web key type '%s' not supported - only rsa and ec supported", webKey.Kty)
+	}
+
+	return key, nil
+}
+
+// NewKeyFromPem creates a new Key from a pem formatted public or private key. Only the
+// public part of a private key is used.
+func NewKeyFromPem(pemKey string) (*Key, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode pem formatted key")
+	}
+
+	var publicKey crypto.PublicKey
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		publicKey = key
+	} else if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		publicKey = key
+	} else {
+		var cert Certificate
+		if err := parsePrivateKey(block.Bytes, &cert); err != nil {
+			return nil, fmt.Errorf("failed to parse pem formatted key of type '%s'", block.Type)
+		}
+		switch cert.PrivateKeyType {
+		case CertificateKeyTypeRsa:
+			publicKey = &cert.PrivateKeyRsa.PublicKey
+		case CertificateKeyTypeEcdsa:
+			publicKey = &cert.PrivateKeyEcdsa.PublicKey
+		case CertificateKeyTypeEd25519:
+			publicKey = cert.PrivateKeyEd25519.Public()
+		}
+	}
+
+	return newKeyFromPublicKey(publicKey)
+}
+
+func newKeyFromPublicKey(publicKey crypto.PublicKey) (*Key, error) {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		return &Key{Type: KeyTypeRsa, PublicKeyRsa: publicKey}, nil
+	case *ecdsa.PublicKey:
+		if _, ok := jwkCurves[publicKey.Curve.Params().Name]; !ok {
+			return nil, fmt.Errorf("ec curve '%s' not supported - only P-256, P-384 and P-521 supported", publicKey.Curve.Params().Name)
+		}
+		return &Key{Type: KeyTypeEc, PublicKeyEcdsa: publicKey}, nil
+	default:
+		return nil, fmt.Errorf("key type %T not supported - only rsa and ec supported", publicKey)
+	}
+}
+
+// PublicKey returns the public key as a crypto.PublicKey
+func (key *Key) PublicKey() crypto.PublicKey {
+	if key.Type == KeyTypeEc {
+		return key.PublicKeyEcdsa
+	}
+	return key.PublicKeyRsa
+}
+
+// Export returns the public key in the given format, defaulting to the base64url
+// encoded modulus of RSA keys for backward compatibility
+func (key *Key) Export(format akvs.AzureKeyVaultOutputFormat) ([]byte, error) {
+	switch format {
+	case "":
+		return key.ExportModulus()
+	case akvs.AzureKeyVaultOutputFormatJwk:
+		return key.ExportJwk()
+	case akvs.AzureKeyVaultOutputFormatPem:
+		return key.ExportPublicKeyAsPem()
+	case akvs.AzureKeyVaultOutputFormatDer:
+		return key.ExportPublicKeyAsDer()
+	case akvs.AzureKeyVaultOutputFormatOpenSSH:
+		return key.ExportOpenSSH()
+	default:
+		return nil, fmt.Errorf("key format '%s' not supported - supported formats are %s, %s, %s and %s", format, akvs.AzureKeyVaultOutputFormatJwk, akvs.AzureKeyVaultOutputFormatPem, akvs.AzureKeyVaultOutputFormatDer, akvs.AzureKeyVaultOutputFormatOpenSSH)
+	}
+}
+
+// ExportModulus returns the base64url encoded modulus of a RSA public key
+func (key *Key) ExportModulus() ([]byte, error) {
+	if key.PublicKeyRsa == nil {
+		return nil, fmt.Errorf("key of type '%s' has no modulus - set the format to %s, %s, %s or %s", key.Type, akvs.AzureKeyVaultOutputFormatJwk, akvs.AzureKeyVaultOutputFormatPem, akvs.AzureKeyVaultOutputFormatDer, akvs.AzureKeyVaultOutputFormatOpenSSH)
+	}
+	return []byte(encodeJwkInt(key.PublicKeyRsa.N.Bytes())), nil
+}
+
+// ExportJwk returns the public key as a JSON Web Key
+func (key *Key) ExportJwk() ([]byte, error) {
+	webKey := jsonWebKey{
+		Kid: key.ID,
+		Kty: string(key.Type),
+	}
+
+	switch key.Type {
+	case KeyTypeRsa:
+		webKey.N = encodeJwkInt(key.PublicKeyRsa.N.Bytes())
+		webKey.E = encodeJwkInt(big.NewInt(int64(key.PublicKeyRsa.E)).Bytes())
+	case KeyTypeEc:
+		params := key.PublicKeyEcdsa.Curve.Params()
+		size := (params.BitSize + 7) / 8
+		webKey.Crv = params.Name
+		webKey.X = encodeJwkInt(padBytes(key.PublicKeyEcdsa.X.Bytes(), size))
+		webKey.Y = encodeJwkInt(padBytes(key.PublicKeyEcdsa.Y.Bytes(), size))
+	default:
+		return nil, fmt.Errorf("key type '%s' currently not supported for jwk export", key.Type)
+	}
+
+	return json.Marshal(webKey)
+}
+
+// ExportPublicKeyAsDer returns the public key as a DER encoded SubjectPublicKeyInfo
+func (key *Key) ExportPublicKeyAsDer() ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(key.PublicKey())
+}
+
+// ExportPublicKeyAsPem returns the public key as a pem formatted SubjectPublicKeyInfo
+func (key *Key) ExportPublicKeyAsPem() ([]byte, error) {
+	der, err := key.ExportPublicKeyAsDer()
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), nil
+}
+
+// ExportOpenSSH returns the public key in the OpenSSH authorized_keys format
+func (key *Key) ExportOpenSSH() ([]byte, error) {
+	sshKey, err := ssh.NewPublicKey(key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(sshKey), nil
+}
+
+func decodeJwkInt(value string, name string) (*big.Int, error) {
+	if value == "" {
+		return nil, fmt.Errorf("json web key is missing '%s'", name)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode '%s' in json web key, error: %+v", name, err)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func encodeJwkInt(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// padBytes left pads data with zeros to size, as required for ec coordinates in a JSON Web Key
+func padBytes(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(data):], data)
+	return padded
+}
@@ -0,0 +1,157 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	"golang.org/x/crypto/ssh"
+)
+
+// rfc7517RsaJwk is the example RSA public key from RFC 7517 appendix A.1
+const rfc7517RsaJwk = `{"kty":"RSA","kid":"2011-04-29","e":"AQAB","n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"}`
+
+func TestImportJwk(t *testing.T) {
+	key, err := NewKeyFromJwk([]byte(rfc7517RsaJwk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Type != KeyTypeRsa || key.PublicKeyRsa.E != 65537 || key.PublicKeyRsa.N.BitLen() != 2048 {
+		t.Errorf("expected 2048 bit rsa key with exponent 65537 but got %s key with %d bits and exponent %d", key.Type, key.PublicKeyRsa.N.BitLen(), key.PublicKeyRsa.E)
+	}
+
+	if _, err = NewKeyFromJwk([]byte(`{"kty":"RSA-HSM","n":"0vx7agoe","e":"AQAB"}`)); err != nil {
+		t.Errorf("should accept hsm key types, error: %+v", err)
+	}
+	if _, err = NewKeyFromJwk([]byte(`{"kty":"oct","k":"c2VjcmV0"}`)); err == nil {
+		t.Error("should fail for symmetric keys")
+	}
+}
+
+func TestExportKeyFormats(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKeys := map[string]interface{}{"rsa": &rsaKey.PublicKey}
+	for name, curve := range map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()} {
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKeys[name] = &ecKey.PublicKey
+	}
+
+	for name, publicKey := range publicKeys {
+		key, err := newKeyFromPublicKey(publicKey)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+
+		jwk, err := key.Export(akvs.AzureKeyVaultOutputFormatJwk)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		fromJwk, err := NewKeyFromJwk(jwk)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+
+		der, err := key.Export(akvs.AzureKeyVaultOutputFormatDer)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		derFromJwk, _ := fromJwk.ExportPublicKeyAsDer()
+		if !bytes.Equal(der, derFromJwk) {
+			t.Errorf("%s: expected same key after jwk round trip", name)
+		}
+		if _, err = x509.ParsePKIXPublicKey(der); err != nil {
+			t.Errorf("%s: expected valid der, error: %+v", name, err)
+		}
+
+		pemKey, err := key.Export(akvs.AzureKeyVaultOutputFormatPem)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if block, _ := pem.Decode(pemKey); block == nil || block.Type != "PUBLIC KEY" || !bytes.Equal(block.Bytes, der) {
+			t.Errorf("%s: expected pem formatted public key", name)
+		}
+
+		authorizedKey, err := key.Export(akvs.AzureKeyVaultOutputFormatOpenSSH)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if _, _, _, _, err = ssh.ParseAuthorizedKey(authorizedKey); err != nil {
+			t.Errorf("%s: expected valid authorized key, error: %+v", name, err)
+		}
+	}
+
+	key, _ := newKeyFromPublicKey(&rsaKey.PublicKey)
+	if _, err = key.Export("unknown"); err == nil {
+		t.Error("should fail for unknown format")
+	}
+
+	// The default is the base64url encoded modulus, as exported by previous versions
+	modulus, err := key.Export("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()); string(modulus) != expected {
+		t.Errorf("expected modulus '%s' by default, but got '%s'", expected, modulus)
+	}
+
+	ecKey, _ := newKeyFromPublicKey(publicKeys["P-256"])
+	if _, err = ecKey.Export(""); err == nil {
+		t.Error("should fail for ec key without format")
+	}
+}
+
+func TestImportKeyPem(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateDer, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []*pem.Block{{Type: "EC PRIVATE KEY", Bytes: privateDer}, {Type: "PUBLIC KEY", Bytes: publicDer}} {
+		key, err := NewKeyFromPem(string(pem.EncodeToMemory(block)))
+		if err != nil {
+			t.Fatalf("%s: %+v", block.Type, err)
+		}
+		if key.Type != KeyTypeEc || key.PublicKeyEcdsa.X.Cmp(ecKey.X) != 0 {
+			t.Errorf("%s: expected public part of ec key", block.Type)
+		}
+	}
+}
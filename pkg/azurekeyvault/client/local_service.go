@@ -0,0 +1,249 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var localVaultFileExtensions = []string{".yaml", ".yml", ".json"}
+
+// localVaultNamePattern matches valid Azure Key Vault names, which are 3-24 alphanumerics
+// and hyphens, starting with a letter and ending with a letter or digit. Vault names are
+// used as file names, so this also keeps them inside the local vault directory.
+var localVaultNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]{1,22}[a-zA-Z0-9]$`)
+
+// localVault is the content of a file representing a vault in the local backend
+type localVault struct {
+	Secrets      map[string]string `yaml:"secrets" json:"secrets"`
+	Keys         map[string]string `yaml:"keys" json:"keys"`
+	Certificates map[string]string `yaml:"certificates" json:"certificates"`
+	// SecretTags optionally sets tags on secrets, for listing secrets by tag
+	SecretTags map[string]map[string]string `yaml:"secretTags" json:"secretTags"`
+}
+
+type localService struct {
+	path string
+}
+
+// NewLocalService creates a new vault Service serving objects from files in a
+// local directory, intended for development and testing without Azure.
+//
+// Each vault is a yaml or json file named after the vault (e.g. my-vault.yaml)
+// with the sections 'secrets', 'keys' and 'certificates', each mapping object
+// names to values. Keys must be JSON Web Keys or pem formatted, and certificates
+// must be pem formatted. Tags can be set on secrets
+// in the optional 'secretTags' section, mapping secret names to tags. Files are
+// read on every request, so changes are picked up without restarting.
+func NewLocalService(path string) (Service, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path is required for vault backend '%s'", BackendLocal)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access local vault directory '%s', error: %+v", path, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("local vault path '%s' is not a directory", path)
+	}
+
+	return &localService{
+		path: path,
+	}, nil
+}
+
+// GetSecret gets a secret from the local vault file
+func (l *localService) GetSecret(vaultSpec *akvs.AzureKeyVault) (string, error) {
+	secret, _, err := l.GetSecretWithVersion(vaultSpec)
+	return secret, err
+}
+
+// GetSecretWithVersion gets a secret from the local vault file, along with a version derived
+// from its value
+func (l *localService) GetSecretWithVersion(vaultSpec *akvs.AzureKeyVault) (string, *ObjectVersion, error) {
+	vault, err := l.readVault(vaultSpec)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, ok := vault.Secrets[vaultSpec.Object.Name]
+	if !ok {
+		return "", nil, fmt.Errorf("secret '%s' not found in local vault '%s'", vaultSpec.Object.Name, vaultSpec.Name)
+	}
+	return secret, localObjectVersion(secret), nil
+}
+
+// GetKey gets a key from the local vault file, formatted either as a JSON Web Key
+// or as a pem formatted public or private key
+func (l *localService) GetKey(vaultSpec *akvs.AzureKeyVault) (*Key, error) {
+	vault, err := l.readVault(vaultSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := vault.Keys[vaultSpec.Object.Name]
+	if !ok {
+		return nil, fmt.Errorf("key '%s' not found in local vault '%s'", vaultSpec.Object.Name, vaultSpec.Name)
+	}
+
+	var key *Key
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		key, err = NewKeyFromJwk([]byte(value))
+	} else {
+		key, err = NewKeyFromPem(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key '%s' in local vault '%s', error: %+v", vaultSpec.Object.Name, vaultSpec.Name, err)
+	}
+	key.Version = localObjectVersion(value)
+	return key, nil
+}
+
+// GetCertificate gets a pem formatted certificate from the local vault file
+func (l *localService) GetCertificate(vaultSpec *akvs.AzureKeyVault, exportPrivateKey bool) (*Certificate, error) {
+	vault, err := l.readVault(vaultSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	pemCert, ok := vault.Certificates[vaultSpec.Object.Name]
+	if !ok {
+		return nil, fmt.Errorf("certificate '%s' not found in local vault '%s'", vaultSpec.Object.Name, vaultSpec.Name)
+	}
+
+	cert, err := NewCertificateFromPem(pemCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate '%s' in local vault '%s', error: %+v", vaultSpec.Object.Name, vaultSpec.Name, err)
+	}
+
+	if exportPrivateKey {
+		if !cert.HasPrivateKey {
+			return nil, fmt.Errorf("cannot export private key because certificate '%s' in local vault '%s' has no private key", vaultSpec.Object.Name, vaultSpec.Name)
+		}
+		cert.Version = localObjectVersion(pemCert)
+		return cert, nil
+	}
+
+	// Same as Azure Key Vault, only return the public part when not exporting private key
+	var der []byte
+	for _, pubCert := range cert.Certificates {
+		der = append(der, pubCert.Raw...)
+	}
+	if cert, err = NewCertificateFromDer(der); err != nil {
+		return nil, err
+	}
+	cert.Version = localObjectVersion(pemCert)
+	return cert, nil
+}
+
+// GetObjectVersion returns a version derived from the content of the object in the local
+// vault file, since local vaults do not keep versions
+func (l *localService) GetObjectVersion(vaultSpec *akvs.AzureKeyVault) (*ObjectVersion, error) {
+	vault, err := l.readVault(vaultSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := vault.Secrets
+	switch vaultSpec.Object.Type {
+	case akvs.AzureKeyVaultObjectTypeCertificate:
+		objects = vault.Certificates
+	case akvs.AzureKeyVaultObjectTypeKey:
+		objects = vault.Keys
+	}
+
+	value, ok := objects[vaultSpec.Object.Name]
+	if !ok {
+		return nil, fmt.Errorf("%s '%s' not found in local vault '%s'", vaultSpec.Object.Type, vaultSpec.Object.Name, vaultSpec.Name)
+	}
+
+	return localObjectVersion(value), nil
+}
+
+// localObjectVersion returns a version derived from the value of an object in a local
+// vault file, since local vaults do not keep versions
+func localObjectVersion(value string) *ObjectVersion {
+	hash := sha256.Sum256([]byte(value))
+	return &ObjectVersion{
+		Version: hex.EncodeToString(hash[:16]),
+	}
+}
+
+// ListSecrets lists all secrets in the local vault file, sorted by name
+func (l *localService) ListSecrets(vaultSpec *akvs.AzureKeyVault) ([]SecretItem, error) {
+	vault, err := l.readVaultFile(vaultSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]SecretItem, 0, len(vault.Secrets))
+	for name := range vault.Secrets {
+		tags := make(map[string]string)
+		for k, v := range vault.SecretTags[name] {
+			tags[k] = v
+		}
+		items = append(items, SecretItem{Name: name, Tags: tags})
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func (l *localService) readVault(vaultSpec *akvs.AzureKeyVault) (*localVault, error) {
+	if vaultSpec.Object.Name == "" {
+		return nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+	}
+	return l.readVaultFile(vaultSpec)
+}
+
+func (l *localService) readVaultFile(vaultSpec *akvs.AzureKeyVault) (*localVault, error) {
+	if !localVaultNamePattern.MatchString(vaultSpec.Name) || strings.Contains(vaultSpec.Name, "--") {
+		return nil, fmt.Errorf("invalid vault name '%s', must be 3-24 alphanumerics and hyphens, starting with a letter and ending with a letter or digit", vaultSpec.Name)
+	}
+
+	for _, ext := range localVaultFileExtensions {
+		file := filepath.Join(l.path, vaultSpec.Name+ext)
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read local vault file '%s', error: %+v", file, err)
+		}
+
+		var vault localVault
+		if err = yaml.Unmarshal(content, &vault); err != nil {
+			return nil, fmt.Errorf("failed to parse local vault file '%s', error: %+v", file, err)
+		}
+		return &vault, nil
+	}
+
+	return nil, fmt.Errorf("local vault '%s' not found in '%s'", vaultSpec.Name, l.path)
+}
@@ -0,0 +1,218 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+)
+
+func createLocalVault(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "akv2k8s-local-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := localVault{
+		Secrets:      map[string]string{"my-secret": "some secret value", "my-other-secret": "some other secret value"},
+		Keys:         map[string]string{"my-key": rfc7517RsaJwk},
+		Certificates: map[string]string{"my-cert": pemTestCert},
+		SecretTags:   map[string]map[string]string{"my-secret": {"app": "my-app"}},
+	}
+
+	content, err := json.Marshal(vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "my-vault.json"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func vaultSpec(name, objectName string) *akvs.AzureKeyVault {
+	return &akvs.AzureKeyVault{
+		Name: name,
+		Object: akvs.AzureKeyVaultObject{
+			Name: objectName,
+		},
+	}
+}
+
+func TestLocalServiceGetSecret(t *testing.T) {
+	dir := createLocalVault(t)
+	defer os.RemoveAll(dir)
+
+	service, err := NewServiceForBackend(BackendLocal, BackendConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := service.GetSecret(vaultSpec("my-vault", "my-secret"))
+	if err != nil {
+		t.Error(err)
+	}
+	if secret != "some secret value" {
+		t.Errorf("expected 'some secret value' but got '%s'", secret)
+	}
+
+	if _, err = service.GetSecret(vaultSpec("my-vault", "not-there")); err == nil {
+		t.Error("should fail when secret does not exist")
+	}
+
+	if _, err = service.GetSecret(vaultSpec("other-vault", "my-secret")); err == nil {
+		t.Error("should fail when vault does not exist")
+	}
+}
+
+func TestLocalServiceRejectsInvalidVaultNames(t *testing.T) {
+	dir := createLocalVault(t)
+	defer os.RemoveAll(dir)
+
+	// The vault file in dir must not be reachable from a service reading from a sub directory
+	path := filepath.Join(dir, "vaults")
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := NewServiceForBackend(BackendLocal, BackendConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../my-vault", "vaults/../../my-vault", "my/vault", "my\\vault", "..", "ab", "my--vault", "-my-vault", "my-vault-"} {
+		if _, err = service.GetSecret(vaultSpec(name, "my-secret")); err == nil {
+			t.Errorf("should fail for invalid vault name '%s'", name)
+		}
+	}
+}
+
+func TestLocalServiceGetCertificate(t *testing.T) {
+	dir := createLocalVault(t)
+	defer os.RemoveAll(dir)
+
+	service, err := NewLocalService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := service.GetCertificate(vaultSpec("my-vault", "my-cert"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.HasPrivateKey {
+		t.Error("certificate should have private key when exported")
+	}
+
+	cert, err = service.GetCertificate(vaultSpec("my-vault", "my-cert"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.HasPrivateKey {
+		t.Error("certificate should not have private key when not exported")
+	}
+	if len(cert.Certificates) != 1 {
+		t.Errorf("expected 1 certificate but got %d", len(cert.Certificates))
+	}
+}
+
+func TestLocalServiceGetKey(t *testing.T) {
+	dir := createLocalVault(t)
+	defer os.RemoveAll(dir)
+
+	service, err := NewLocalService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := service.GetKey(vaultSpec("my-vault", "my-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Type != KeyTypeRsa {
+		t.Errorf("expected rsa key but got '%s'", key.Type)
+	}
+}
+
+func TestLocalServiceGetObjectVersion(t *testing.T) {
+	dir := createLocalVault(t)
+	defer os.RemoveAll(dir)
+
+	service, err := NewLocalService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := vaultSpec("my-vault", "my-secret")
+	spec.Object.Type = akvs.AzureKeyVaultObjectTypeSecret
+	version, err := service.GetObjectVersion(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version == "" {
+		t.Error("expected version for secret in local vault")
+	}
+
+	_, valueVersion, err := service.GetSecretWithVersion(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valueVersion == nil || valueVersion.Version != version.Version {
+		t.Errorf("expected version '%s' with secret value, but got %+v", version.Version, valueVersion)
+	}
+
+	spec.Object.Type = akvs.AzureKeyVaultObjectTypeKey
+	if _, err = service.GetObjectVersion(spec); err == nil {
+		t.Error("should fail when looking up secret as key")
+	}
+}
+
+func TestLocalServiceListSecrets(t *testing.T) {
+	dir := createLocalVault(t)
+	defer os.RemoveAll(dir)
+
+	service, err := NewLocalService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := service.ListSecrets(vaultSpec("my-vault", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 secrets but got %d", len(items))
+	}
+	if items[0].Name != "my-other-secret" || items[1].Name != "my-secret" {
+		t.Errorf("expected secrets sorted by name but got '%s' and '%s'", items[0].Name, items[1].Name)
+	}
+	if items[1].Tags["app"] != "my-app" {
+		t.Errorf("expected tag 'app' to be 'my-app' but got '%s'", items[1].Tags["app"])
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := NewServiceForBackend("unknown", BackendConfig{}); err == nil {
+		t.Error("should fail for unknown backend")
+	}
+}
@@ -0,0 +1,326 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"unicode/utf16"
+)
+
+// The golang.org/x/crypto/pkcs12 package only decodes PKCS#12, so encoding is done here
+// using the same algorithms, which are the ones supported by Java, OpenSSL and Windows:
+// pbeWithSHAAnd3-KeyTripleDES-CBC for the private key and a HMAC-SHA1 integrity MAC
+
+const (
+	pkcs12Iterations = 2048
+	pkcs12SaltSize   = 8
+)
+
+var (
+	oidPkcs12DataContentType         = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 7, 1})
+	oidPkcs12FriendlyName            = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 20})
+	oidPkcs12LocalKeyID              = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 21})
+	oidPkcs12CertTypeX509            = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 22, 1})
+	oidPkcs12ShroudedKeyBag          = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 10, 1, 2})
+	oidPkcs12CertBag                 = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 10, 1, 3})
+	oidPkcs12PbeWithSHA3KeyTripleDES = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 1, 3})
+	oidPkcs12SHA1                    = asn1.ObjectIdentifier([]int{1, 3, 14, 3, 2, 26})
+)
+
+type pkcs12Pfx struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,omitempty"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12PbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// encodePkcs12 encodes the private key and certificates as a password protected PKCS#12
+// bundle, with the first certificate being the one matching the private key. Salts are
+// random, so the output differs every time.
+func encodePkcs12(privateKeyDer []byte, certs []*x509.Certificate, friendlyName, password string) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("pkcs12 requires at least one certificate")
+	}
+
+	keySalt, err := randomSalt(pkcs12SaltSize)
+	if err != nil {
+		return nil, err
+	}
+	macSalt, err := randomSalt(pkcs12SaltSize)
+	if err != nil {
+		return nil, err
+	}
+
+	bmpPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+
+	localKeyID := sha1.Sum(certs[0].Raw)
+	leafAttributes, err := pkcs12BagAttributes(friendlyName, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []pkcs12SafeBag
+	for i, cert := range certs {
+		bag, err := asn1.Marshal(pkcs12CertBag{
+			ID:   oidPkcs12CertTypeX509,
+			Data: cert.Raw,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		certBag := pkcs12SafeBag{
+			ID:    oidPkcs12CertBag,
+			Value: explicitContent(bag),
+		}
+		if i == 0 {
+			certBag.Attributes = leafAttributes
+		}
+		certBags = append(certBags, certBag)
+	}
+
+	encryptedKey, err := pkcs12Encrypt(privateKeyDer, bmpPassword, keySalt)
+	if err != nil {
+		return nil, err
+	}
+	keyAlgorithm, err := pkcs12PbeAlgorithm(keySalt)
+	if err != nil {
+		return nil, err
+	}
+	keyBag, err := asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{
+		Algorithm:     keyAlgorithm,
+		EncryptedData: encryptedKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []pkcs12SafeBag{{
+		ID:         oidPkcs12ShroudedKeyBag,
+		Value:      explicitContent(keyBag),
+		Attributes: leafAttributes,
+	}}
+
+	var authenticatedSafe []pkcs12ContentInfo
+	for _, bags := range [][]pkcs12SafeBag{certBags, keyBags} {
+		safeContents, err := asn1.Marshal(bags)
+		if err != nil {
+			return nil, err
+		}
+		authenticatedSafe = append(authenticatedSafe, pkcs12ContentInfo{
+			ContentType: oidPkcs12DataContentType,
+			Content:     safeContents,
+		})
+	}
+
+	authenticatedSafeDer, err := asn1.Marshal(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	macKey := pkcs12Pbkdf(macSalt, bmpPassword, pkcs12Iterations, 3, 20)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafeDer)
+
+	return asn1.Marshal(pkcs12Pfx{
+		Version: 3,
+		AuthSafe: pkcs12ContentInfo{
+			ContentType: oidPkcs12DataContentType,
+			Content:     authenticatedSafeDer,
+		},
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPkcs12SHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// pkcs12BagAttributes returns the friendlyName and localKeyId attributes used to pair
+// the private key with its certificate
+func pkcs12BagAttributes(friendlyName string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	bmpName, err := bmpString(friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := asn1.MarshalWithParams([]asn1.RawValue{{Tag: asn1.TagBMPString, Bytes: bmpName[:len(bmpName)-2]}}, "set")
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := asn1.MarshalWithParams([][]byte{localKeyID}, "set")
+	if err != nil {
+		return nil, err
+	}
+
+	return []pkcs12Attribute{
+		{ID: oidPkcs12FriendlyName, Value: asn1.RawValue{FullBytes: name}},
+		{ID: oidPkcs12LocalKeyID, Value: asn1.RawValue{FullBytes: keyID}},
+	}, nil
+}
+
+// randomSalt returns size random bytes for salting password based encryption
+func randomSalt(size int) ([]byte, error) {
+	salt := make([]byte, size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt, error: %+v", err)
+	}
+	return salt, nil
+}
+
+func pkcs12PbeAlgorithm(salt []byte) (pkix.AlgorithmIdentifier, error) {
+	params, err := asn1.Marshal(pkcs12PbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{
+		Algorithm:  oidPkcs12PbeWithSHA3KeyTripleDES,
+		Parameters: asn1.RawValue{FullBytes: params},
+	}, nil
+}
+
+// pkcs12Encrypt encrypts data using pbeWithSHAAnd3-KeyTripleDES-CBC
+func pkcs12Encrypt(data, bmpPassword, salt []byte) ([]byte, error) {
+	key := pkcs12Pbkdf(salt, bmpPassword, pkcs12Iterations, 1, 24)
+	iv := pkcs12Pbkdf(salt, bmpPassword, pkcs12Iterations, 2, 8)
+
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := block.BlockSize() - len(data)%block.BlockSize()
+	encrypted := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	return encrypted, nil
+}
+
+// pkcs12Pbkdf derives key material from a password as defined in RFC 7292 appendix B.2,
+// using SHA-1 (u=20 and v=64 bytes)
+func pkcs12Pbkdf(salt, bmpPassword []byte, iterations int, id byte, size int) []byte {
+	const v = 64
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fillWithRepeats(salt, v), fillWithRepeats(bmpPassword, v)...)
+
+	var a []byte
+	for len(a) < size {
+		hash := sha1.Sum(append(d, i...))
+		ai := hash[:]
+		for j := 1; j < iterations; j++ {
+			hash = sha1.Sum(ai)
+			ai = hash[:]
+		}
+		a = append(a, ai...)
+
+		b := new(big.Int).SetBytes(fillWithRepeats(ai, v)[:v])
+		b.Add(b, big.NewInt(1))
+		for j := 0; j < len(i); j += v {
+			ij := new(big.Int).SetBytes(i[j : j+v])
+			ij.Add(ij, b)
+			ijBytes := ij.Bytes()
+			if len(ijBytes) > v {
+				ijBytes = ijBytes[len(ijBytes)-v:]
+			}
+			copy(i[j:j+v], padBytes(ijBytes, v))
+		}
+	}
+	return a[:size]
+}
+
+// fillWithRepeats concatenates copies of pattern to a multiple of v bytes
+func fillWithRepeats(pattern []byte, v int) []byte {
+	if len(pattern) == 0 {
+		return nil
+	}
+	size := v * ((len(pattern) + v - 1) / v)
+	return bytes.Repeat(pattern, (size+len(pattern)-1)/len(pattern))[:size]
+}
+
+// bmpString returns s as a null terminated UCS-2 big endian string, which is how PKCS#12
+// encodes passwords and friendly names
+func bmpString(s string) ([]byte, error) {
+	bmp := make([]byte, 0, 2*len(s)+2)
+	for _, r := range s {
+		if t, _ := utf16.EncodeRune(r); t != 0xfffd {
+			return nil, fmt.Errorf("string contains characters that cannot be encoded in UCS-2")
+		}
+		bmp = append(bmp, byte(r>>8), byte(r))
+	}
+	return append(bmp, 0, 0), nil
+}
+
+// explicitContent wraps der in an explicit [0] tag
+func explicitContent(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitWait is the longest a request waits for the rate limiter of its vault before
+// failing with a ThrottledError, so workers are not stalled by one busy vault
+const maxRateLimitWait = time.Second
+
+// ThrottleConfig controls how requests to each vault are rate limited, and how long a vault
+// is backed off after throttling requests
+type ThrottleConfig struct {
+	// RequestsPerSecond is the rate of requests allowed to each vault, shared by all
+	// callers. Zero or less disables rate limiting.
+	RequestsPerSecond float64
+
+	// Burst is the number of requests allowed to each vault at once
+	Burst int
+
+	// InitialBackoff is the time to back off a vault throttling requests without
+	// Retry-After, doubled for each throttled request in a row
+	InitialBackoff time.Duration
+
+	// MaxBackoff limits the time to back off a vault throttling requests without Retry-After
+	MaxBackoff time.Duration
+}
+
+// DefaultThrottleConfig returns the throttle settings used unless others are given, which
+// are well below the service limits of Azure Key Vault
+func DefaultThrottleConfig() ThrottleConfig {
+	return ThrottleConfig{
+		RequestsPerSecond: 20,
+		Burst:             40,
+		InitialBackoff:    time.Second,
+		MaxBackoff:        5 * time.Minute,
+	}
+}
+
+// ThrottledError is returned when a request to a vault is not sent or not handled due to
+// throttling, either by the vault itself or by the rate limit of the vault
+type ThrottledError struct {
+	// Vault is the name of the vault
+	Vault string
+
+	// StatusCode is the status code of the throttled response from the vault, or 0 if the
+	// request was stopped by the rate limit or backoff of the vault
+	StatusCode int
+
+	// RetryAfter is the time to wait before sending requests to the vault again
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("requests to azure key vault '%s' are throttled - retry in %s", e.Vault, e.RetryAfter)
+	}
+	return fmt.Sprintf("azure key vault '%s' is throttling requests with status %d - retry in %s", e.Vault, e.StatusCode, e.RetryAfter)
+}
+
+// IsThrottled returns the ThrottledError if err is caused by throttling
+func IsThrottled(err error) (*ThrottledError, bool) {
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		return throttled, true
+	}
+	return nil, false
+}
+
+// httpSender sends http requests, like http.Client and the senders of the Azure SDK
+type httpSender interface {
+	Do(r *http.Request) (*http.Response, error)
+}
+
+// vaultThrottles keeps the rate limit and backoff of each vault
+type vaultThrottles struct {
+	config ThrottleConfig
+	now    func() time.Time
+
+	mu     sync.Mutex
+	vaults map[string]*vaultThrottle
+}
+
+type vaultThrottle struct {
+	limiter *rate.Limiter
+
+	mu           sync.Mutex
+	backoffUntil time.Time
+	failures     int
+}
+
+func newVaultThrottles(config ThrottleConfig) *vaultThrottles {
+	return &vaultThrottles{
+		config: config,
+		now:    time.Now,
+		vaults: make(map[string]*vaultThrottle),
+	}
+}
+
+func (t *vaultThrottles) vault(name string) *vaultThrottle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	throttle, ok := t.vaults[name]
+	if !ok {
+		limit := rate.Inf
+		if t.config.RequestsPerSecond > 0 {
+			limit = rate.Limit(t.config.RequestsPerSecond)
+		}
+		burst := t.config.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		throttle = &vaultThrottle{limiter: rate.NewLimiter(limit, burst)}
+		t.vaults[name] = throttle
+	}
+	return throttle
+}
+
+// sender returns a sender sending requests to the named vault through next, applying the
+// rate limit and backoff of the vault
+func (t *vaultThrottles) sender(vault string, next httpSender) httpSender {
+	return &throttlingSender{
+		throttles: t,
+		vault:     vault,
+		next:      next,
+	}
+}
+
+// wait waits for the rate limit of the vault, failing with a ThrottledError when the vault
+// is backed off or the wait would be too long
+func (t *vaultThrottles) wait(ctx context.Context, vault string) error {
+	throttle := t.vault(vault)
+	now := t.now()
+
+	throttle.mu.Lock()
+	backoffUntil := throttle.backoffUntil
+	throttle.mu.Unlock()
+	if now.Before(backoffUntil) {
+		return &ThrottledError{Vault: vault, RetryAfter: backoffUntil.Sub(now)}
+	}
+
+	reservation := throttle.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if !reservation.OK() || delay > maxRateLimitWait {
+		reservation.CancelAt(now)
+		return &ThrottledError{Vault: vault, RetryAfter: delay}
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+// backOff backs off the vault after a throttled response, for retryAfter if given by the
+// vault or otherwise exponentially by the number of throttled responses in a row
+func (t *vaultThrottles) backOff(vault string, retryAfter time.Duration) time.Duration {
+	throttle := t.vault(vault)
+
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	throttle.failures++
+	if retryAfter <= 0 {
+		retryAfter = t.config.InitialBackoff
+		for i := 1; i < throttle.failures && retryAfter < t.config.MaxBackoff; i++ {
+			retryAfter *= 2
+		}
+		if retryAfter > t.config.MaxBackoff {
+			retryAfter = t.config.MaxBackoff
+		}
+	}
+
+	if until := t.now().Add(retryAfter); until.After(throttle.backoffUntil) {
+		throttle.backoffUntil = until
+	}
+	return retryAfter
+}
+
+// reset clears the backoff of the vault after a request was handled
+func (t *vaultThrottles) reset(vault string) {
+	throttle := t.vault(vault)
+
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	throttle.failures = 0
+}
+
+// throttlingSender sends requests to one vault, turning throttled responses into a
+// ThrottledError. Returning an error instead of the response also stops the Azure SDK
+// from retrying throttled requests while holding on to the caller.
+type throttlingSender struct {
+	throttles *vaultThrottles
+	vault     string
+	next      httpSender
+}
+
+func (s *throttlingSender) Do(r *http.Request) (*http.Response, error) {
+	if err := s.throttles.wait(r.Context(), s.vault); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.next.Do(r)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter := s.throttles.backOff(s.vault, parseRetryAfter(resp.Header.Get("Retry-After"), s.throttles.now()))
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &ThrottledError{Vault: s.vault, StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+	}
+
+	s.throttles.reset(s.vault)
+	return resp, nil
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or a
+// http date, returning 0 if not set or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
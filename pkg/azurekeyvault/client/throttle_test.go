@@ -0,0 +1,152 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeSender struct {
+	statusCodes []int
+	retryAfter  string
+	requests    int
+}
+
+func (s *fakeSender) Do(r *http.Request) (*http.Response, error) {
+	statusCode := s.statusCodes[s.requests%len(s.statusCodes)]
+	s.requests++
+
+	resp := &http.Response{
+		StatusCode: statusCode,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}
+	if s.retryAfter != "" {
+		resp.Header.Set("Retry-After", s.retryAfter)
+	}
+	return resp, nil
+}
+
+func newTestThrottles(config ThrottleConfig, now *time.Time) *vaultThrottles {
+	throttles := newVaultThrottles(config)
+	throttles.now = func() time.Time { return *now }
+	return throttles
+}
+
+func sendTestRequest(t *testing.T, sender httpSender) error {
+	req, err := http.NewRequest(http.MethodGet, "https://my-vault.vault.azure.net/secrets/my-secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sender.Do(req)
+	return err
+}
+
+func TestThrottledResponseBacksOffVault(t *testing.T) {
+	now := time.Now()
+	throttles := newTestThrottles(ThrottleConfig{InitialBackoff: time.Second, MaxBackoff: time.Minute}, &now)
+
+	next := &fakeSender{statusCodes: []int{http.StatusTooManyRequests}, retryAfter: "10"}
+	sender := throttles.sender("my-vault", next)
+
+	err := sendTestRequest(t, sender)
+	throttled, ok := IsThrottled(fmt.Errorf("wrapped: %w", err))
+	if !ok {
+		t.Fatalf("expected ThrottledError, but got: %+v", err)
+	}
+	if throttled.StatusCode != http.StatusTooManyRequests || throttled.RetryAfter != 10*time.Second {
+		t.Errorf("unexpected throttled error %+v", throttled)
+	}
+
+	// The vault is backed off without sending requests, while other vaults are not
+	now = now.Add(5 * time.Second)
+	if err := sendTestRequest(t, sender); err == nil {
+		t.Error("expected request to backed off vault to fail")
+	}
+	if next.requests != 1 {
+		t.Errorf("expected no request sent to backed off vault, but got %d requests", next.requests)
+	}
+
+	other := &fakeSender{statusCodes: []int{http.StatusOK}}
+	if err := sendTestRequest(t, throttles.sender("other-vault", other)); err != nil {
+		t.Errorf("expected request to other vault to succeed, but got: %+v", err)
+	}
+
+	now = now.Add(5 * time.Second)
+	next.statusCodes = []int{http.StatusOK}
+	if err := sendTestRequest(t, sender); err != nil {
+		t.Errorf("expected request after backoff to succeed, but got: %+v", err)
+	}
+}
+
+func TestThrottledResponseWithoutRetryAfterBacksOffExponentially(t *testing.T) {
+	now := time.Now()
+	throttles := newTestThrottles(ThrottleConfig{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}, &now)
+	sender := throttles.sender("my-vault", &fakeSender{statusCodes: []int{http.StatusServiceUnavailable}})
+
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		throttled, _ := IsThrottled(sendTestRequest(t, sender))
+		if throttled == nil || throttled.RetryAfter != expected {
+			t.Fatalf("expected backoff of %s, but got %+v", expected, throttled)
+		}
+		now = now.Add(expected)
+	}
+}
+
+func TestRateLimitPerVault(t *testing.T) {
+	now := time.Now()
+	throttles := newTestThrottles(ThrottleConfig{RequestsPerSecond: 0.1, Burst: 2}, &now)
+	next := &fakeSender{statusCodes: []int{http.StatusOK}}
+	sender := throttles.sender("my-vault", next)
+
+	for i := 0; i < 2; i++ {
+		if err := sendTestRequest(t, sender); err != nil {
+			t.Fatalf("expected request within burst to succeed, but got: %+v", err)
+		}
+	}
+
+	throttled, ok := IsThrottled(sendTestRequest(t, sender))
+	if !ok || throttled.StatusCode != 0 || throttled.RetryAfter != 10*time.Second {
+		t.Errorf("expected request above rate limit to be throttled for 10s, but got %+v", throttled)
+	}
+	if next.requests != 2 {
+		t.Errorf("expected 2 requests sent, but got %d", next.requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := map[string]time.Duration{
+		"":                              0,
+		"30":                            30 * time.Second,
+		"-1":                            0,
+		"Wed, 01 Jan 2020 00:01:00 GMT": time.Minute,
+		"Tue, 31 Dec 2019 23:59:00 GMT": 0,
+		"soon":                          0,
+	}
+	for value, expected := range tests {
+		if actual := parseRetryAfter(value, now); actual != expected {
+			t.Errorf("expected Retry-After '%s' to be %s, but got %s", value, expected, actual)
+		}
+	}
+}
@@ -44,18 +44,101 @@ type AzureKeyVaultSecretSpec struct {
 type AzureKeyVault struct {
 	Name   string              `json:"name"`
 	Object AzureKeyVaultObject `json:"object"`
+	// Objects lists multiple objects to sync into the same Secret, used instead of Object
+	// +optional
+	Objects []AzureKeyVaultObjectEntry `json:"objects,omitempty"`
+	// Selector selects secrets to sync into the same Secret by listing the vault,
+	// used instead of Object
+	// +optional
+	Selector *AzureKeyVaultSecretSelector `json:"selector,omitempty"`
+	// Cloud overrides the Azure cloud environment (like AzureChinaCloud or
+	// AzureUSGovernmentCloud) the Azure Key Vault is located in
+	// +optional
+	Cloud string `json:"cloud,omitempty"`
 }
 
 // AzureKeyVaultObject has information about the Azure Key Vault
 // object to get from Azure Key Vault
 type AzureKeyVaultObject struct {
-	Name        string                         `json:"name"`
-	Type        AzureKeyVaultObjectType        `json:"type"`
-	Version     string                         `json:"version"`
-	Poll        bool                           `json:"bool"`
-	ContentType AzureKeyVaultObjectContentType `json:"contentType"`
+	Name    string                  `json:"name"`
+	Type    AzureKeyVaultObjectType `json:"type"`
+	Version string                  `json:"version"`
+	// Poll controls if Azure Key Vault is polled for changes to this object.
+	// Defaults to true, unless Version is set.
+	// +optional
+	Poll *bool `json:"poll,omitempty"`
+	// PollInterval overrides the default time between polls to Azure Key Vault for this object
+	// +optional
+	PollInterval *metav1.Duration               `json:"pollInterval,omitempty"`
+	ContentType  AzureKeyVaultObjectContentType `json:"contentType"`
+}
+
+// AzureKeyVaultObjectEntry is one of multiple Azure Key Vault objects
+// synced into the same Secret
+type AzureKeyVaultObjectEntry struct {
+	AzureKeyVaultObject `json:",inline"`
+	// DataKey is the key in the Secret to assign the value of this object to
+	// +optional
+	DataKey string `json:"dataKey,omitempty"`
+	// Transforms are applied to the value of this object only
+	// +optional
+	Transforms []string `json:"transforms,omitempty"`
+}
+
+// AzureKeyVaultSecretSelector selects Azure Key Vault secrets by name or tag. Secrets
+// must match all of NamePrefix, NameRegex and Tags that are set.
+type AzureKeyVaultSecretSelector struct {
+	// NamePrefix selects secrets with names starting with the prefix
+	// +optional
+	NamePrefix string `json:"namePrefix,omitempty"`
+	// NameRegex selects secrets with names matching the regular expression
+	// +optional
+	NameRegex string `json:"nameRegex,omitempty"`
+	// Tags selects secrets having all the tags with the same values
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+	// KeyMapping controls how keys in the Secret are derived from secret names
+	// +optional
+	KeyMapping AzureKeyVaultKeyMapping `json:"keyMapping,omitempty"`
+	// PollInterval overrides the default time between listing the vault for changes
+	// +optional
+	PollInterval *metav1.Duration `json:"pollInterval,omitempty"`
+}
+
+// AzureKeyVaultKeyMapping controls how keys in a Secret are derived from names of
+// Azure Key Vault secrets. Steps are applied in the order of the fields.
+type AzureKeyVaultKeyMapping struct {
+	// TrimPrefix removes the NamePrefix of the selector from the name
+	// +optional
+	TrimPrefix bool `json:"trimPrefix,omitempty"`
+	// Replace replaces all occurrences of each Old with New, in order
+	// +optional
+	Replace []AzureKeyVaultKeyReplacement `json:"replace,omitempty"`
+	// Case changes the case of the name, either upper or lower
+	// +optional
+	Case AzureKeyVaultKeyCase `json:"case,omitempty"`
+	// Prefix is added to the start of the key
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// AzureKeyVaultKeyReplacement replaces Old with New in key names
+type AzureKeyVaultKeyReplacement struct {
+	Old string `json:"old"`
+	New string `json:"new"`
 }
 
+// AzureKeyVaultKeyCase defines the case of keys in a Secret
+type AzureKeyVaultKeyCase string
+
+const (
+	// AzureKeyVaultKeyCaseUpper - keys are upper case
+	AzureKeyVaultKeyCaseUpper AzureKeyVaultKeyCase = "upper"
+
+	// AzureKeyVaultKeyCaseLower - keys are lower case
+	AzureKeyVaultKeyCaseLower AzureKeyVaultKeyCase = "lower"
+)
+
 // AzureKeyVaultObjectType defines which Object type to get from Azure Key Vault
 type AzureKeyVaultObjectType string
 
@@ -96,13 +179,159 @@ type AzureKeyVaultOutputSecret struct {
 	// +optional
 	Type    corev1.SecretType `json:"type,omitempty"`
 	DataKey string            `json:"dataKey"`
+	// Format of the exported object, used for keys and certificates - keys defaults to the base64url encoded modulus of RSA keys
+	// +optional
+	Format AzureKeyVaultOutputFormat `json:"format,omitempty"`
+	// Name of Azure Key Vault secret in the same vault holding the password of pkcs12 and jks formats
+	// +optional
+	PasswordSecret string `json:"passwordSecret,omitempty"`
+	// Put only the leaf certificate in tls.crt and the rest of the chain in ca.crt
+	// +optional
+	SplitChain bool `json:"splitChain,omitempty"`
+	// Leave the self-signed root certificate out of exported certificate chains
+	// +optional
+	DropRoot bool `json:"dropRoot,omitempty"`
+	// Format of exported certificate private keys - defaults to traditional
+	// +optional
+	PrivateKeyFormat AzureKeyVaultPrivateKeyFormat `json:"privateKeyFormat,omitempty"`
 }
 
+// AzureKeyVaultOutputFormat defines the format to export an object in
+type AzureKeyVaultOutputFormat string
+
+const (
+	// AzureKeyVaultOutputFormatJwk - export public key as a JSON Web Key
+	AzureKeyVaultOutputFormatJwk AzureKeyVaultOutputFormat = "jwk"
+
+	// AzureKeyVaultOutputFormatPem - export public key as a pem formatted SubjectPublicKeyInfo, or
+	// certificate chain followed by the private key as combined pem
+	AzureKeyVaultOutputFormatPem AzureKeyVaultOutputFormat = "pem"
+
+	// AzureKeyVaultOutputFormatDer - export public key as a DER encoded SubjectPublicKeyInfo
+	AzureKeyVaultOutputFormatDer AzureKeyVaultOutputFormat = "der"
+
+	// AzureKeyVaultOutputFormatOpenSSH - export public key in the OpenSSH authorized_keys format
+	AzureKeyVaultOutputFormatOpenSSH AzureKeyVaultOutputFormat = "openssh"
+
+	// AzureKeyVaultOutputFormatPkcs12 - export certificate with private key as a password protected PKCS#12 bundle
+	AzureKeyVaultOutputFormatPkcs12 AzureKeyVaultOutputFormat = "pkcs12"
+
+	// AzureKeyVaultOutputFormatJks - export certificate with private key as a password protected Java KeyStore
+	AzureKeyVaultOutputFormatJks AzureKeyVaultOutputFormat = "jks"
+
+	// AzureKeyVaultOutputFormatJksTrustStore - export certificate chain as a password protected Java KeyStore
+	// with trusted certificate entries only
+	AzureKeyVaultOutputFormatJksTrustStore AzureKeyVaultOutputFormat = "jks-truststore"
+)
+
+// AzureKeyVaultPrivateKeyFormat defines the format to export a certificate private key in
+type AzureKeyVaultPrivateKeyFormat string
+
+const (
+	// AzureKeyVaultPrivateKeyFormatTraditional - export private key as PKCS#1 (RSA PRIVATE KEY)
+	// for rsa and SEC 1 (EC PRIVATE KEY) for ecdsa, or PKCS#8 if the key type has no other format
+	AzureKeyVaultPrivateKeyFormatTraditional AzureKeyVaultPrivateKeyFormat = "traditional"
+
+	// AzureKeyVaultPrivateKeyFormatPkcs8 - export private key as PKCS#8 (PRIVATE KEY)
+	AzureKeyVaultPrivateKeyFormatPkcs8 AzureKeyVaultPrivateKeyFormat = "pkcs8"
+)
+
 // AzureKeyVaultSecretStatus is the status for a AzureKeyVaultSecret resource
 type AzureKeyVaultSecretStatus struct {
 	SecretHash      string      `json:"secretHash"`
 	LastAzureUpdate metav1.Time `json:"lastAzureUpdate,omitempty"`
 	SecretName      string      `json:"secretName"`
+	// ObservedGeneration is the generation of the spec last processed by the controller
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// ObjectVersion is the version of the Azure Key Vault object last synced
+	// +optional
+	ObjectVersion string `json:"objectVersion,omitempty"`
+	// ObjectUpdated is when the version of the Azure Key Vault object last synced was updated
+	// +optional
+	ObjectUpdated *metav1.Time `json:"objectUpdated,omitempty"`
+	// SyncedGeneration is the generation of the spec the Secret was last synced with Azure
+	// Key Vault for. Values are only fetched again when it or the version of an object changes.
+	// +optional
+	SyncedGeneration int64 `json:"syncedGeneration,omitempty"`
+	// LastError is the error from the last failed sync, cleared when a sync succeeds
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+	// +optional
+	Conditions []AzureKeyVaultSecretCondition `json:"conditions,omitempty"`
+	// Objects is the status of each object in spec.vault.objects
+	// +optional
+	Objects []AzureKeyVaultObjectStatus `json:"objects,omitempty"`
+	// Certificate is the certificate last synced, when the object is a certificate
+	// +optional
+	Certificate *AzureKeyVaultCertificateStatus `json:"certificate,omitempty"`
+}
+
+// AzureKeyVaultObjectStatus is the status of one of multiple Azure Key Vault
+// objects synced into the same Secret
+type AzureKeyVaultObjectStatus struct {
+	Name    string                  `json:"name"`
+	Type    AzureKeyVaultObjectType `json:"type"`
+	DataKey string                  `json:"dataKey,omitempty"`
+	// Version is the version of the object last synced
+	// +optional
+	Version string `json:"version,omitempty"`
+	// Updated is when the version of the object last synced was updated
+	// +optional
+	Updated *metav1.Time `json:"updated,omitempty"`
+	// Error is the error from the last attempt to get the object from Azure Key Vault
+	// +optional
+	Error string `json:"error,omitempty"`
+	// Certificate is the certificate last synced, when the object is a certificate
+	// +optional
+	Certificate *AzureKeyVaultCertificateStatus `json:"certificate,omitempty"`
+}
+
+// AzureKeyVaultCertificateStatus describes the leaf certificate of a certificate synced
+// from Azure Key Vault
+type AzureKeyVaultCertificateStatus struct {
+	Subject   string      `json:"subject"`
+	Issuer    string      `json:"issuer"`
+	NotBefore metav1.Time `json:"notBefore"`
+	NotAfter  metav1.Time `json:"notAfter"`
+	// Thumbprint is the hex encoded SHA-1 hash of the certificate, as shown in Azure Key Vault
+	Thumbprint string `json:"thumbprint"`
+	// SubjectAlternativeNames are the DNS names, IP addresses, email addresses and URIs
+	// of the certificate, prefixed by their type like in 'DNS:example.com'
+	// +optional
+	SubjectAlternativeNames []string `json:"subjectAlternativeNames,omitempty"`
+	// ExpiryWarningThreshold is the smallest threshold before expiry a Warning event has
+	// been recorded for, where 0 means the certificate has expired
+	// +optional
+	ExpiryWarningThreshold *metav1.Duration `json:"expiryWarningThreshold,omitempty"`
+}
+
+// AzureKeyVaultSecretConditionType is the type of a AzureKeyVaultSecretCondition
+type AzureKeyVaultSecretConditionType string
+
+const (
+	// AzureKeyVaultSecretReady is true when the Secret is synced with Kubernetes and
+	// Azure Key Vault is reachable
+	AzureKeyVaultSecretReady AzureKeyVaultSecretConditionType = "Ready"
+
+	// AzureKeyVaultSecretSynced is true when the Kubernetes Secret is created and up to date
+	AzureKeyVaultSecretSynced AzureKeyVaultSecretConditionType = "Synced"
+
+	// AzureKeyVaultSecretAzureReachable is true when the object was last successfully read
+	// from Azure Key Vault
+	AzureKeyVaultSecretAzureReachable AzureKeyVaultSecretConditionType = "AzureReachable"
+)
+
+// AzureKeyVaultSecretCondition describes the state of a AzureKeyVaultSecret at a certain point
+type AzureKeyVaultSecretCondition struct {
+	Type   AzureKeyVaultSecretConditionType `json:"type"`
+	Status corev1.ConditionStatus           `json:"status"`
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
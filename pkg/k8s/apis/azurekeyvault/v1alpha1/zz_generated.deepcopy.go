@@ -24,13 +24,26 @@ limitations under the License.
 package v1alpha1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVault) DeepCopyInto(out *AzureKeyVault) {
 	*out = *in
-	out.Object = in.Object
+	in.Object.DeepCopyInto(&out.Object)
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]AzureKeyVaultObjectEntry, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(AzureKeyVaultSecretSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -44,9 +57,84 @@ func (in *AzureKeyVault) DeepCopy() *AzureKeyVault {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultCertificateStatus) DeepCopyInto(out *AzureKeyVaultCertificateStatus) {
+	*out = *in
+	in.NotBefore.DeepCopyInto(&out.NotBefore)
+	in.NotAfter.DeepCopyInto(&out.NotAfter)
+	if in.SubjectAlternativeNames != nil {
+		in, out := &in.SubjectAlternativeNames, &out.SubjectAlternativeNames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExpiryWarningThreshold != nil {
+		in, out := &in.ExpiryWarningThreshold, &out.ExpiryWarningThreshold
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultCertificateStatus.
+func (in *AzureKeyVaultCertificateStatus) DeepCopy() *AzureKeyVaultCertificateStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultCertificateStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultKeyMapping) DeepCopyInto(out *AzureKeyVaultKeyMapping) {
+	*out = *in
+	if in.Replace != nil {
+		in, out := &in.Replace, &out.Replace
+		*out = make([]AzureKeyVaultKeyReplacement, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultKeyMapping.
+func (in *AzureKeyVaultKeyMapping) DeepCopy() *AzureKeyVaultKeyMapping {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultKeyMapping)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultKeyReplacement) DeepCopyInto(out *AzureKeyVaultKeyReplacement) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultKeyReplacement.
+func (in *AzureKeyVaultKeyReplacement) DeepCopy() *AzureKeyVaultKeyReplacement {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultKeyReplacement)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultObject) DeepCopyInto(out *AzureKeyVaultObject) {
 	*out = *in
+	if in.Poll != nil {
+		in, out := &in.Poll, &out.Poll
+		*out = new(bool)
+		**out = **in
+	}
+	if in.PollInterval != nil {
+		in, out := &in.PollInterval, &out.PollInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
 	return
 }
 
@@ -60,6 +148,53 @@ func (in *AzureKeyVaultObject) DeepCopy() *AzureKeyVaultObject {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultObjectEntry) DeepCopyInto(out *AzureKeyVaultObjectEntry) {
+	*out = *in
+	in.AzureKeyVaultObject.DeepCopyInto(&out.AzureKeyVaultObject)
+	if in.Transforms != nil {
+		in, out := &in.Transforms, &out.Transforms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultObjectEntry.
+func (in *AzureKeyVaultObjectEntry) DeepCopy() *AzureKeyVaultObjectEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultObjectEntry)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultObjectStatus) DeepCopyInto(out *AzureKeyVaultObjectStatus) {
+	*out = *in
+	if in.Updated != nil {
+		in, out := &in.Updated, &out.Updated
+		*out = (*in).DeepCopy()
+	}
+	if in.Certificate != nil {
+		in, out := &in.Certificate, &out.Certificate
+		*out = new(AzureKeyVaultCertificateStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultObjectStatus.
+func (in *AzureKeyVaultObjectStatus) DeepCopy() *AzureKeyVaultObjectStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultObjectStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultOutput) DeepCopyInto(out *AzureKeyVaultOutput) {
 	*out = *in
@@ -126,6 +261,23 @@ func (in *AzureKeyVaultSecret) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultSecretCondition) DeepCopyInto(out *AzureKeyVaultSecretCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultSecretCondition.
+func (in *AzureKeyVaultSecretCondition) DeepCopy() *AzureKeyVaultSecretCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultSecretCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultSecretList) DeepCopyInto(out *AzureKeyVaultSecretList) {
 	*out = *in
@@ -159,10 +311,39 @@ func (in *AzureKeyVaultSecretList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultSecretSelector) DeepCopyInto(out *AzureKeyVaultSecretSelector) {
+	*out = *in
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	in.KeyMapping.DeepCopyInto(&out.KeyMapping)
+	if in.PollInterval != nil {
+		in, out := &in.PollInterval, &out.PollInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultSecretSelector.
+func (in *AzureKeyVaultSecretSelector) DeepCopy() *AzureKeyVaultSecretSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultSecretSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultSecretSpec) DeepCopyInto(out *AzureKeyVaultSecretSpec) {
 	*out = *in
-	out.Vault = in.Vault
+	in.Vault.DeepCopyInto(&out.Vault)
 	in.Output.DeepCopyInto(&out.Output)
 	return
 }
@@ -181,6 +362,29 @@ func (in *AzureKeyVaultSecretSpec) DeepCopy() *AzureKeyVaultSecretSpec {
 func (in *AzureKeyVaultSecretStatus) DeepCopyInto(out *AzureKeyVaultSecretStatus) {
 	*out = *in
 	in.LastAzureUpdate.DeepCopyInto(&out.LastAzureUpdate)
+	if in.ObjectUpdated != nil {
+		in, out := &in.ObjectUpdated, &out.ObjectUpdated
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]AzureKeyVaultSecretCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]AzureKeyVaultObjectStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Certificate != nil {
+		in, out := &in.Certificate, &out.Certificate
+		*out = new(AzureKeyVaultCertificateStatus)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 